@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	accountDeletionGracePeriod = time.Hour * 24 * 30
+	maintenanceInterval        = time.Hour
+)
+
+// deleteAccount schedules the caller's account for deletion. The account is
+// deactivated straight away and purged once the grace period is over.
+func (cft *apiConfig) deleteAccount(w http.ResponseWriter, req *http.Request) {
+	type responseStruct struct {
+		Id                  int       `json:"id"`
+		DeletionScheduledAt time.Time `json:"deletion_scheduled_at"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	user, scheduleErr := cft.dbFor(req).ScheduleAccountDeletion(userId, time.Now().Add(accountDeletionGracePeriod))
+	if scheduleErr != nil {
+		respondWithError(w, http.StatusConflict, scheduleErr.Error())
+		return
+	}
+	sendErr := cft.mailer.Send(emailMessage{
+		To:      user.Email,
+		Subject: "Your Chirpy account will be deleted",
+		Body: fmt.Sprintf(
+			"Your Chirpy account and everything in it will be deleted on %s.\n\nIf you change your mind, sign in before then and the deletion will be cancelled.\n",
+			user.DeletionScheduledAt.Format(time.RFC1123),
+		),
+	})
+	if sendErr != nil {
+		slog.ErrorContext(req.Context(), "Error sending deletion notice", "user_id", user.Id, "error", sendErr)
+	}
+	respondWithJson(w, http.StatusAccepted, responseStruct{Id: user.Id, DeletionScheduledAt: user.DeletionScheduledAt})
+}
+
+// exportAccount streams a zip archive of everything stored about the
+// caller: data.json plus any uploaded media.
+func (cft *apiConfig) exportAccount(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	export, exportErr := cft.dbFor(req).ExportUserData(userId)
+	if exportErr != nil {
+		respondWithError(w, http.StatusInternalServerError, exportErr.Error())
+		return
+	}
+	data, marshalErr := json.MarshalIndent(export, "", "  ")
+	if marshalErr != nil {
+		respondWithError(w, http.StatusInternalServerError, marshalErr.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"chirpy-export-%d.zip\"", userId))
+	w.WriteHeader(http.StatusOK)
+	archive := zip.NewWriter(w)
+	dataFile, createErr := archive.Create("data.json")
+	if createErr == nil {
+		_, createErr = dataFile.Write(data)
+	}
+	if createErr == nil && export.Profile.AvatarFile != "" {
+		createErr = cft.addFileToArchive(archive, "media/avatars/"+export.Profile.AvatarFile, cft.avatarPath(export.Profile.AvatarFile))
+	}
+	for _, media := range export.Media {
+		if createErr != nil {
+			break
+		}
+		createErr = cft.addFileToArchive(archive, "media/attachments/"+media.File, cft.mediaPath(attachmentDir, media.File))
+	}
+	if createErr != nil {
+		slog.ErrorContext(req.Context(), "Error writing export", "user_id", userId, "error", createErr)
+		return
+	}
+	if closeErr := archive.Close(); closeErr != nil {
+		slog.ErrorContext(req.Context(), "Error writing export", "user_id", userId, "error", closeErr)
+	}
+}
+
+func (cft *apiConfig) addFileToArchive(archive *zip.Writer, name, path string) error {
+	file, openErr := os.Open(path)
+	if errors.Is(openErr, os.ErrNotExist) {
+		return nil
+	}
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	entry, createErr := archive.Create(name)
+	if createErr != nil {
+		return createErr
+	}
+	_, copyErr := io.Copy(entry, file)
+	return copyErr
+}
+
+func (cft *apiConfig) purgeDeletedAccounts() {
+	purged, purgeErr := cft.db.PurgeDeletedAccounts(time.Now())
+	if purgeErr != nil {
+		slog.Error("Error purging deleted accounts", "error", purgeErr)
+	}
+	for _, user := range purged {
+		cft.removeAvatar(user.AvatarFile)
+		slog.Info("Purged deleted account", "user_id", user.Id)
+	}
+}
+
+// runMaintenance runs for the lifetime of the server, purging accounts whose
+// deletion grace period is over, then any media they or their deleted
+// chirps left behind, downgrading lapsed Chirpy Red subscriptions and
+// dropping old webhooks and delivery logs and idle rate limit windows.
+func (cft *apiConfig) runMaintenance(interval time.Duration) {
+	for {
+		cft.purgeDeletedAccounts()
+		cft.pruneMedia()
+		cft.expireSubscriptions()
+		cft.pruneWebhooks()
+		cft.pruneOutboundDeliveries()
+		cft.loginLimiter.sweep()
+		cft.chirpLimiter.sweep(entitlementRateWindow)
+		cft.messageLimiter.sweep(entitlementRateWindow)
+		cft.resetLimiter.sweep(forgotPasswordWindow)
+		time.Sleep(interval)
+	}
+}
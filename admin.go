@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+type userRoleResponse struct {
+	Id    int    `json:"id"`
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type userStatusResponse struct {
+	Id        int        `json:"id"`
+	Email     string     `json:"email"`
+	Status    string     `json:"status"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newUserStatusResponse(user database.User) userStatusResponse {
+	response := userStatusResponse{
+		Id:     user.Id,
+		Email:  user.Email,
+		Status: user.EffectiveStatus(time.Now()),
+	}
+	if response.Status != database.StatusActive {
+		response.Reason = user.StatusReason
+		if !user.StatusExpiresAt.IsZero() {
+			response.ExpiresAt = &user.StatusExpiresAt
+		}
+	}
+	return response
+}
+
+func adminEmailsFromEnv() []string {
+	emails := []string{}
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+func (cft *apiConfig) bootstrapAdmins() {
+	if bootstrapErr := cft.db.BootstrapAdmins(cft.adminEmails); bootstrapErr != nil {
+		slog.Error("Error bootstrapping admins", "error", bootstrapErr)
+	}
+}
+
+// middlewareRequireRole only lets through session users holding at least
+// role. The authenticated user is stored in the request context.
+func (cft *apiConfig) middlewareRequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+		if authErr != nil {
+			respondWithError(w, http.StatusUnauthorized, authErr.Error())
+			return
+		}
+		userId, convErr := strconv.Atoi(id)
+		if convErr != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+			return
+		}
+		user, userErr := cft.dbFor(req).GetUserById(userId)
+		if userErr != nil {
+			respondWithError(w, http.StatusUnauthorized, userErr.Error())
+			return
+		}
+		if statusErr := user.CheckActive(time.Now()); statusErr != nil {
+			respondWithError(w, http.StatusForbidden, statusErr.Error())
+			return
+		}
+		if !user.HasRole(role) {
+			respondWithError(w, http.StatusForbidden, "Requires role "+role)
+			return
+		}
+		next(w, req.WithContext(context.WithValue(req.Context(), userContextKey, user)))
+	}
+}
+
+func (cft *apiConfig) setUserRole(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Role string `json:"role"`
+	}
+	userId, parseErr := strconv.Atoi(req.PathValue("userid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if !database.IsValidRole(params.Role) {
+		respondWithError(w, http.StatusBadRequest, "Unknown role")
+		return
+	}
+	cft.updateUserRole(w, req, userId, params.Role)
+}
+
+func (cft *apiConfig) revokeUserRole(w http.ResponseWriter, req *http.Request) {
+	userId, parseErr := strconv.Atoi(req.PathValue("userid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+	cft.updateUserRole(w, req, userId, database.RoleUser)
+}
+
+func (cft *apiConfig) updateUserRole(w http.ResponseWriter, req *http.Request, userId int, role string) {
+	user, roleErr := cft.dbFor(req).SetUserRole(userId, role)
+	if roleErr != nil {
+		respondWithError(w, http.StatusBadRequest, roleErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, userRoleResponse{Id: user.Id, Email: user.Email, Role: user.EffectiveRole()})
+}
+
+func (cft *apiConfig) getUserStatus(w http.ResponseWriter, req *http.Request) {
+	userId, parseErr := strconv.Atoi(req.PathValue("userid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		respondWithError(w, http.StatusNotFound, userErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, newUserStatusResponse(user))
+}
+
+// setUserStatus suspends, bans or reinstates a user. Suspensions and bans
+// without duration_seconds last until an admin reinstates the user.
+func (cft *apiConfig) setUserStatus(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Status          string `json:"status"`
+		Reason          string `json:"reason"`
+		DurationSeconds int    `json:"duration_seconds"`
+	}
+	userId, parseErr := strconv.Atoi(req.PathValue("userid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+	admin := req.Context().Value(userContextKey).(database.User)
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if !database.IsValidStatus(params.Status) {
+		respondWithError(w, http.StatusBadRequest, "Unknown status")
+		return
+	}
+	if userId == admin.Id {
+		respondWithError(w, http.StatusBadRequest, "Admins can't change their own status")
+		return
+	}
+	if params.Status != database.StatusActive && (params.Reason == "" || len(params.Reason) > maxReportReasonLen) {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Reason must be between 1 and %d characters", maxReportReasonLen))
+		return
+	}
+	if params.DurationSeconds < 0 {
+		respondWithError(w, http.StatusBadRequest, "Duration can't be negative")
+		return
+	}
+	expiresAt := time.Time{}
+	if params.DurationSeconds > 0 {
+		expiresAt = time.Now().Add(time.Duration(params.DurationSeconds) * time.Second).UTC()
+	}
+	user, statusErr := cft.dbFor(req).SetUserStatus(userId, admin.Id, params.Status, params.Reason, expiresAt)
+	if statusErr != nil {
+		respondWithError(w, http.StatusBadRequest, statusErr.Error())
+		return
+	}
+	cft.notifyStatusChange(user)
+	respondWithJson(w, http.StatusOK, newUserStatusResponse(user))
+}
+
+func (cft *apiConfig) notifyStatusChange(user database.User) {
+	body := "Your Chirpy account has been reinstated.\n"
+	if statusErr := user.CheckActive(time.Now()); statusErr != nil {
+		body = statusErr.Error() + "\n"
+	}
+	sendErr := cft.mailer.Send(emailMessage{
+		To:      user.Email,
+		Subject: "Your Chirpy account status has changed",
+		Body:    body,
+	})
+	if sendErr != nil {
+		slog.Error("Error sending status notice", "user_id", user.Id, "error", sendErr)
+	}
+}
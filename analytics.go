@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const (
+	analyticsFlushInterval = time.Second * 10
+	defaultAnalyticsDays   = 30
+	maxAnalyticsDays       = 365
+)
+
+// analyticsRecorder counts site visits in memory and periodically adds them
+// to the database, so a visit costs a mutex rather than a database write.
+// At most one flush interval of visits is lost if the server crashes.
+type analyticsRecorder struct {
+	mux     sync.Mutex
+	now     func() time.Time
+	pending map[string]database.DayAnalytics
+}
+
+func newAnalyticsRecorder(now func() time.Time) *analyticsRecorder {
+	return &analyticsRecorder{now: now, pending: make(map[string]database.DayAnalytics)}
+}
+
+// visitorHash identifies a visitor by IP address and user agent. Only the
+// hash reaches the visitor sketch.
+func visitorHash(req *http.Request) uint64 {
+	sum := sha256.Sum256([]byte(clientIp(req) + "|" + req.UserAgent()))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func (recorder *analyticsRecorder) record(path string, visitor uint64) {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	date := recorder.now().UTC().Format(database.AnalyticsDateFormat)
+	day := recorder.pending[date]
+	day.Record(path, visitor)
+	recorder.pending[date] = day
+}
+
+// flush writes the pending visits to db. If the write fails they are kept
+// for the next flush.
+func (recorder *analyticsRecorder) flush(db *database.DB) error {
+	recorder.mux.Lock()
+	pending := recorder.pending
+	recorder.pending = make(map[string]database.DayAnalytics)
+	recorder.mux.Unlock()
+	writeErr := db.RecordAnalytics(pending)
+	if writeErr != nil {
+		recorder.mux.Lock()
+		for date, counted := range pending {
+			day := recorder.pending[date]
+			day.Merge(counted)
+			recorder.pending[date] = day
+		}
+		recorder.mux.Unlock()
+	}
+	return writeErr
+}
+
+// reset drops visits that haven't been flushed yet.
+func (recorder *analyticsRecorder) reset() {
+	recorder.mux.Lock()
+	defer recorder.mux.Unlock()
+	recorder.pending = make(map[string]database.DayAnalytics)
+}
+
+func (cft *apiConfig) runAnalyticsFlusher(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if flushErr := cft.analytics.flush(cft.db); flushErr != nil {
+			slog.Error("Error saving analytics", "error", flushErr)
+		}
+	}
+}
+
+// flushOnShutdown saves pending visits and exports buffered spans when the
+// server is asked to stop, so a restart doesn't lose them.
+func (cft *apiConfig) flushOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	if flushErr := cft.analytics.flush(cft.db); flushErr != nil {
+		slog.Error("Error saving analytics", "error", flushErr)
+	}
+	if cft.tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if shutdownErr := cft.tracerProvider.Shutdown(ctx); shutdownErr != nil {
+			slog.Error("Error exporting spans", "error", shutdownErr)
+		}
+	}
+	os.Exit(0)
+}
+
+func (cft *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cft.analytics.record(r.URL.Path, visitorHash(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// analyticsReport flushes pending visits first so the report includes
+// every visit so far.
+func (cft *apiConfig) analyticsReport(req *http.Request, days int) (database.AnalyticsReport, error) {
+	if flushErr := cft.analytics.flush(cft.db); flushErr != nil {
+		return database.AnalyticsReport{}, flushErr
+	}
+	return cft.dbFor(req).GetAnalyticsReport(time.Now(), days)
+}
+
+func (cft *apiConfig) getMetrics(resp http.ResponseWriter, req *http.Request) {
+	report, err := cft.analyticsReport(req, defaultAnalyticsDays)
+	if err != nil {
+		respondWithError(resp, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte(fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p>", report.TotalHits)))
+	resp.Write([]byte(fmt.Sprintf("<p>In the last %d days: %d visits from about %d visitors.</p><ul>", defaultAnalyticsDays, report.Hits, report.UniqueVisitors)))
+	for _, path := range report.TopPaths(10) {
+		resp.Write([]byte(fmt.Sprintf("<li>%s: %d</li>", html.EscapeString(path), report.Paths[path])))
+	}
+	resp.Write([]byte("</ul></body></html>"))
+}
+
+func (cft *apiConfig) getAnalytics(w http.ResponseWriter, req *http.Request) {
+	days := defaultAnalyticsDays
+	if rawDays := req.URL.Query().Get("days"); rawDays != "" {
+		parsed, parseErr := strconv.Atoi(rawDays)
+		if parseErr != nil || parsed < 1 || parsed > maxAnalyticsDays {
+			respondWithError(w, http.StatusBadRequest, "days must be between 1 and "+strconv.Itoa(maxAnalyticsDays))
+			return
+		}
+		days = parsed
+	}
+	report, err := cft.analyticsReport(req, days)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, report)
+}
+
+func (cft *apiConfig) resetMetrics(resp http.ResponseWriter, req *http.Request) {
+	cft.analytics.reset()
+	if resetErr := cft.dbFor(req).ResetAnalytics(); resetErr != nil {
+		respondWithError(resp, http.StatusInternalServerError, resetErr.Error())
+		return
+	}
+	resp.WriteHeader(http.StatusOK)
+	resp.Write([]byte("Hits reset to 0"))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	scopeSessionOnly  = ""
+	scopeChirpsRead   = "chirps:read"
+	scopeChirpsWrite  = "chirps:write"
+	scopeProfileWrite = "profile:write"
+)
+
+var apiTokenScopes = []string{scopeChirpsRead, scopeChirpsWrite, scopeProfileWrite}
+
+type apiTokenResponse struct {
+	Id        int       `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	Token     string    `json:"token,omitempty"`
+}
+
+func (cft *apiConfig) getUserIdFromApiToken(req *http.Request, token, scope string) (string, error) {
+	apiToken, tokenErr := cft.dbFor(req).AuthenticateApiToken(token)
+	if tokenErr != nil {
+		return "", tokenErr
+	}
+	if scope == scopeSessionOnly {
+		return "", errors.New("API tokens can't be used for this endpoint")
+	}
+	if !apiToken.HasScope(scope) {
+		return "", errors.New("API token is missing scope " + scope)
+	}
+	return strconv.Itoa(apiToken.UserId), nil
+}
+
+func (cft *apiConfig) createApiToken(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Token name is required")
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one scope is required")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, "Unknown scope: "+scope)
+			return
+		}
+	}
+	slices.Sort(params.Scopes)
+	apiToken, plaintext, createErr := cft.dbFor(req).CreateApiToken(userId, params.Name, slices.Compact(params.Scopes))
+	if createErr != nil {
+		respondWithError(w, http.StatusInternalServerError, createErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusCreated, apiTokenResponse{
+		Id:        apiToken.Id,
+		Name:      apiToken.Name,
+		Scopes:    apiToken.Scopes,
+		CreatedAt: apiToken.CreatedAt,
+		Token:     plaintext,
+	})
+}
+
+func (cft *apiConfig) getApiTokens(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	apiTokens, getErr := cft.dbFor(req).GetApiTokens(userId)
+	if getErr != nil {
+		respondWithError(w, http.StatusInternalServerError, getErr.Error())
+		return
+	}
+	response := make([]apiTokenResponse, 0, len(apiTokens))
+	for _, apiToken := range apiTokens {
+		response = append(response, apiTokenResponse{
+			Id:        apiToken.Id,
+			Name:      apiToken.Name,
+			Scopes:    apiToken.Scopes,
+			CreatedAt: apiToken.CreatedAt,
+		})
+	}
+	respondWithJson(w, http.StatusOK, response)
+}
+
+func (cft *apiConfig) revokeApiToken(w http.ResponseWriter, req *http.Request) {
+	tokenId, parseErr := strconv.Atoi(req.PathValue("tokenid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing tokenId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	// Like logging out, revoking a token stays allowed while the account is
+	// suspended.
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	revokeErr := cft.dbFor(req).RevokeApiToken(userId, tokenId)
+	if revokeErr != nil {
+		respondWithError(w, http.StatusNotFound, revokeErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+func TestSuspendedUserCanRevokeApiToken(t *testing.T) {
+	cft := newTestConfig(t)
+	handler := cft.routes()
+	admin, _ := createTestUser(t, cft, "admin@example.com")
+	user, token := createTestUser(t, cft, "user@example.com")
+	apiToken, _, createErr := cft.db.CreateApiToken(user.Id, "reader", []string{scopeChirpsRead})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	if _, statusErr := cft.db.SetUserStatus(user.Id, admin.Id, database.StatusSuspended, "spam", time.Now().Add(time.Hour)); statusErr != nil {
+		t.Fatal(statusErr)
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/api/tokens/"+strconv.Itoa(apiToken.Id), nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNoContent {
+		t.Errorf("revoking while suspended returned %d, want %d: %s", recorder.Code, http.StatusNoContent, recorder.Body)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const (
+	defaultReportMonths = 12
+	maxReportMonths     = 36
+)
+
+// getBilling returns the user's subscription together with their invoices,
+// newest first, and the net amount paid in each currency.
+func (cft *apiConfig) getBilling(w http.ResponseWriter, req *http.Request) {
+	type responseStruct struct {
+		IsChirpyRed    bool                   `json:"is_chirpy_red"`
+		Subscription   database.Subscription  `json:"subscription"`
+		Invoices       []database.LedgerEntry `json:"invoices"`
+		TotalPaidCents map[string]int64       `json:"total_paid_cents"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		respondWithError(w, http.StatusNotFound, userErr.Error())
+		return
+	}
+	ledger, ledgerErr := cft.dbFor(req).GetLedger(userId)
+	if ledgerErr != nil {
+		respondWithError(w, http.StatusInternalServerError, ledgerErr.Error())
+		return
+	}
+	response := responseStruct{
+		IsChirpyRed:    user.HasChirpyRed(time.Now()),
+		Subscription:   user.Subscription,
+		Invoices:       []database.LedgerEntry{},
+		TotalPaidCents: map[string]int64{},
+	}
+	for i := len(ledger) - 1; i >= 0; i-- {
+		entry := ledger[i]
+		if !entry.IsInvoice() {
+			continue
+		}
+		response.Invoices = append(response.Invoices, entry)
+		switch {
+		case entry.AmountCents == 0:
+		case entry.Type == database.LedgerCharge:
+			response.TotalPaidCents[entry.Currency] += entry.AmountCents
+		case entry.Type == database.LedgerRefund:
+			response.TotalPaidCents[entry.Currency] -= entry.AmountCents
+		}
+	}
+	respondWithJson(w, http.StatusOK, response)
+}
+
+func (cft *apiConfig) getBillingReport(w http.ResponseWriter, req *http.Request) {
+	months := defaultReportMonths
+	if rawMonths := req.URL.Query().Get("months"); rawMonths != "" {
+		parsed, parseErr := strconv.Atoi(rawMonths)
+		if parseErr != nil || parsed < 1 || parsed > maxReportMonths {
+			respondWithError(w, http.StatusBadRequest, "months must be between 1 and "+strconv.Itoa(maxReportMonths))
+			return
+		}
+		months = parsed
+	}
+	report, err := cft.dbFor(req).GetBillingReport(time.Now(), months)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, report)
+}
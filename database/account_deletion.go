@@ -0,0 +1,173 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+)
+
+// ScheduleAccountDeletion deactivates the account and marks it for removal
+// at deleteAt. Signing in again before then cancels the deletion.
+func (db *DB) ScheduleAccountDeletion(userId int, deleteAt time.Time) (User, error) {
+	db, span := db.startOperation("ScheduleAccountDeletion")
+	defer span.End()
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if !user.DeletionScheduledAt.IsZero() {
+			return errors.New("Account deletion already scheduled")
+		}
+		user.DeletionScheduledAt = deleteAt.UTC()
+		loadedDb.Users[userId] = user
+		delete(loadedDb.RefreshTokens, userId)
+		for tokenHash, grant := range loadedDb.OauthRefreshTokens {
+			if grant.UserId == userId {
+				delete(loadedDb.OauthRefreshTokens, tokenHash)
+			}
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return User{}, updateErr
+	}
+	return user, nil
+}
+
+func (db *DB) cancelAccountDeletion(userId int) error {
+	return db.update(func(loadedDb DBStructure) error {
+		user, exists := loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		user.DeletionScheduledAt = time.Time{}
+		loadedDb.Users[userId] = user
+		return nil
+	})
+}
+
+// PurgeDeletedAccounts removes every account whose grace period ended before
+// now, along with everything that belongs to it. Moderation actions are kept
+// for the audit trail, without the chirp bodies. Messages the user sent are
+// deleted but the rest of their conversations stay with the other
+// participants. Inbound and outbound webhooks about the user are deleted
+// too, since their payloads carry the user's data. It returns the purged
+// users so the caller can remove their media.
+func (db *DB) PurgeDeletedAccounts(now time.Time) ([]User, error) {
+	db, span := db.startOperation("PurgeDeletedAccounts")
+	defer span.End()
+	purged := []User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for _, user := range loadedDb.Users {
+			if !user.DeletionScheduledAt.IsZero() && user.DeletionScheduledAt.Before(now) {
+				purgeUser(loadedDb, user.Id)
+				purged = append(purged, user)
+			}
+		}
+		if len(purged) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return []User{}, updateErr
+	}
+	slices.SortFunc(purged, func(a, b User) int {
+		return a.Id - b.Id
+	})
+	return purged, nil
+}
+
+func purgeUser(loadedDb DBStructure, userId int) {
+	deletedChirps := make(map[int]bool)
+	for chirpId, chirp := range loadedDb.Chirps {
+		if chirp.AuthorId == userId {
+			deletedChirps[chirpId] = true
+			delete(loadedDb.Chirps, chirpId)
+		}
+	}
+	for reportId, report := range loadedDb.Reports {
+		if report.ReporterId == userId || deletedChirps[report.ChirpId] {
+			delete(loadedDb.Reports, reportId)
+		}
+	}
+	for actionId, action := range loadedDb.ModerationActions {
+		if action.TargetUserId == userId {
+			action.ChirpBody = ""
+			loadedDb.ModerationActions[actionId] = action
+		}
+	}
+	delete(loadedDb.RefreshTokens, userId)
+	for tokenHash, reset := range loadedDb.PasswordResets {
+		if reset.UserId == userId {
+			delete(loadedDb.PasswordResets, tokenHash)
+		}
+	}
+	for tokenId, apiToken := range loadedDb.ApiTokens {
+		if apiToken.UserId == userId {
+			delete(loadedDb.ApiTokens, tokenId)
+		}
+	}
+	ownedClients := make(map[string]bool)
+	for clientId, client := range loadedDb.OauthClients {
+		if client.OwnerId == userId {
+			ownedClients[clientId] = true
+			delete(loadedDb.OauthClients, clientId)
+		}
+	}
+	for codeHash, code := range loadedDb.OauthCodes {
+		if code.UserId == userId || ownedClients[code.ClientId] {
+			delete(loadedDb.OauthCodes, codeHash)
+		}
+	}
+	for tokenHash, grant := range loadedDb.OauthRefreshTokens {
+		if grant.UserId == userId || ownedClients[grant.ClientId] {
+			delete(loadedDb.OauthRefreshTokens, tokenHash)
+		}
+	}
+	for relationshipId, relationship := range loadedDb.Relationships {
+		if relationship.UserId == userId || relationship.TargetId == userId {
+			delete(loadedDb.Relationships, relationshipId)
+		}
+	}
+	for subscriptionId, subscription := range loadedDb.WebhookSubscriptions {
+		if subscription.OwnerId == userId {
+			removeWebhookSubscription(loadedDb, subscriptionId)
+		}
+	}
+	for webhookId, webhook := range loadedDb.InboundWebhooks {
+		if payloadSubject(webhook.Payload) == userId {
+			delete(loadedDb.InboundWebhooks, webhookId)
+		}
+	}
+	for deliveryId, delivery := range loadedDb.OutboundDeliveries {
+		if payloadSubject(delivery.Payload) == userId {
+			delete(loadedDb.OutboundDeliveries, deliveryId)
+		}
+	}
+	removeFromConversations(loadedDb, userId)
+	delete(loadedDb.Users, userId)
+}
+
+// payloadSubject returns the user a webhook payload is about: the user_id
+// of a Polka event or user.upgraded delivery, or the author_id of a chirp
+// event.
+func payloadSubject(payload string) int {
+	parsed := struct {
+		Data struct {
+			UserId   int `json:"user_id"`
+			AuthorId int `json:"author_id"`
+		} `json:"data"`
+	}{}
+	if json.Unmarshal([]byte(payload), &parsed) != nil {
+		return 0
+	}
+	if parsed.Data.UserId != 0 {
+		return parsed.Data.UserId
+	}
+	return parsed.Data.AuthorId
+}
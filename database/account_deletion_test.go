@@ -0,0 +1,58 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPurgeRemovesWebhooksAboutUser(t *testing.T) {
+	db := newTestDB(t)
+	admin, _ := db.CreateUser("admin@example.com", "pw")
+	leaving, _ := db.CreateUser("leaving@example.com", "pw")
+	staying, _ := db.CreateUser("staying@example.com", "pw")
+	if _, roleErr := db.SetUserRole(admin.Id, RoleAdmin); roleErr != nil {
+		t.Fatal(roleErr)
+	}
+	if _, subscribeErr := db.CreateWebhookSubscription(admin.Id, "https://example.com/hooks", []string{EventChirpCreated, EventUserUpgraded}, true); subscribeErr != nil {
+		t.Fatal(subscribeErr)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, user := range []UserReturn{leaving, staying} {
+		chirp := Chirp{Id: user.Id, Body: "hello from " + user.Email, AuthorId: user.Id}
+		if _, queueErr := db.QueueOutboundEvent(EventChirpCreated, user.Id, chirp, now); queueErr != nil {
+			t.Fatal(queueErr)
+		}
+		if _, queueErr := db.QueueOutboundEvent(EventUserUpgraded, user.Id, map[string]int{"user_id": user.Id}, now); queueErr != nil {
+			t.Fatal(queueErr)
+		}
+		payload := `{"event":"user.upgraded","data":{"user_id":` + strconv.Itoa(user.Id) + `}}`
+		if _, enqueueErr := db.EnqueueWebhook("polka", payload, now); enqueueErr != nil {
+			t.Fatal(enqueueErr)
+		}
+	}
+	if _, scheduleErr := db.ScheduleAccountDeletion(leaving.Id, now); scheduleErr != nil {
+		t.Fatal(scheduleErr)
+	}
+	if _, purgeErr := db.PurgeDeletedAccounts(now.Add(time.Second)); purgeErr != nil {
+		t.Fatal(purgeErr)
+	}
+
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		t.Fatal(loadErr)
+	}
+	for _, webhook := range loadedDb.InboundWebhooks {
+		if payloadSubject(webhook.Payload) == leaving.Id {
+			t.Errorf("inbound webhook about the purged user kept: %s", webhook.Payload)
+		}
+	}
+	for _, delivery := range loadedDb.OutboundDeliveries {
+		if payloadSubject(delivery.Payload) == leaving.Id {
+			t.Errorf("delivery about the purged user kept: %s", delivery.Payload)
+		}
+	}
+	if len(loadedDb.InboundWebhooks) != 1 || len(loadedDb.OutboundDeliveries) != 2 {
+		t.Errorf("kept %d inbound webhooks and %d deliveries, want the other user's 1 and 2", len(loadedDb.InboundWebhooks), len(loadedDb.OutboundDeliveries))
+	}
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+const (
+	// Days are keyed by their UTC date.
+	AnalyticsDateFormat = "2006-01-02"
+	// Paths beyond the first maxAnalyticsPaths seen in a day are counted
+	// under "other" so a crawler can't grow the database without bound.
+	maxAnalyticsPaths  = 200
+	otherAnalyticsPath = "other"
+	// sketchPrecision gives 1024 registers per day, for a standard error of
+	// about 3% in the unique visitor estimate.
+	sketchPrecision = 10
+	sketchRegisters = 1 << sketchPrecision
+)
+
+// VisitorSketch is a HyperLogLog sketch of visitor hashes. It estimates
+// how many distinct visitors were seen without storing who they were.
+type VisitorSketch []byte
+
+func (sketch *VisitorSketch) Add(hash uint64) {
+	if len(*sketch) != sketchRegisters {
+		*sketch = make(VisitorSketch, sketchRegisters)
+	}
+	register := hash >> (64 - sketchPrecision)
+	rank := byte(bits.LeadingZeros64(hash<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	(*sketch)[register] = max((*sketch)[register], rank)
+}
+
+func (sketch *VisitorSketch) Merge(other VisitorSketch) {
+	if len(other) != sketchRegisters {
+		return
+	}
+	if len(*sketch) != sketchRegisters {
+		*sketch = make(VisitorSketch, sketchRegisters)
+	}
+	for i, rank := range other {
+		(*sketch)[i] = max((*sketch)[i], rank)
+	}
+}
+
+func (sketch VisitorSketch) Estimate() int64 {
+	if len(sketch) != sketchRegisters {
+		return 0
+	}
+	sum := 0.0
+	zeros := 0
+	for _, rank := range sketch {
+		sum += math.Pow(2, -float64(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	m := float64(sketchRegisters)
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// DayAnalytics counts visits to the site during one day.
+type DayAnalytics struct {
+	Hits     int64            `json:"hits"`
+	Paths    map[string]int64 `json:"paths"`
+	Visitors VisitorSketch    `json:"visitors"`
+}
+
+func (day *DayAnalytics) addPath(path string, hits int64) {
+	if day.Paths == nil {
+		day.Paths = make(map[string]int64)
+	}
+	if _, seen := day.Paths[path]; !seen && len(day.Paths) >= maxAnalyticsPaths {
+		path = otherAnalyticsPath
+	}
+	day.Paths[path] += hits
+}
+
+// Record counts one visit to path by the visitor with the given hash.
+func (day *DayAnalytics) Record(path string, visitor uint64) {
+	day.Hits++
+	day.addPath(path, 1)
+	day.Visitors.Add(visitor)
+}
+
+func (day *DayAnalytics) Merge(other DayAnalytics) {
+	day.Hits += other.Hits
+	for path, hits := range other.Paths {
+		day.addPath(path, hits)
+	}
+	day.Visitors.Merge(other.Visitors)
+}
+
+type DailyAnalytics struct {
+	Date           string           `json:"date"`
+	Hits           int64            `json:"hits"`
+	UniqueVisitors int64            `json:"unique_visitors"`
+	Paths          map[string]int64 `json:"paths"`
+}
+
+// AnalyticsReport covers the days up to and including today. TotalHits
+// counts every visit ever recorded; the other totals only cover the
+// reported days.
+type AnalyticsReport struct {
+	TotalHits      int64            `json:"total_hits"`
+	Hits           int64            `json:"hits"`
+	UniqueVisitors int64            `json:"unique_visitors"`
+	Paths          map[string]int64 `json:"paths"`
+	Days           []DailyAnalytics `json:"days"`
+}
+
+// RecordAnalytics adds visits counted in memory, keyed by date, to the
+// stored totals.
+func (db *DB) RecordAnalytics(days map[string]DayAnalytics) error {
+	db, span := db.startOperation("RecordAnalytics")
+	defer span.End()
+	if len(days) == 0 {
+		return nil
+	}
+	return db.update(func(loadedDb DBStructure) error {
+		for date, counted := range days {
+			day := loadedDb.Analytics[date]
+			day.Merge(counted)
+			loadedDb.Analytics[date] = day
+		}
+		return nil
+	})
+}
+
+func (db *DB) GetAnalyticsReport(now time.Time, days int) (AnalyticsReport, error) {
+	db, span := db.startOperation("GetAnalyticsReport")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return AnalyticsReport{}, loadErr
+	}
+	report := AnalyticsReport{Paths: map[string]int64{}, Days: []DailyAnalytics{}}
+	for _, day := range loadedDb.Analytics {
+		report.TotalHits += day.Hits
+	}
+	visitors := VisitorSketch{}
+	for i := days - 1; i >= 0; i-- {
+		date := now.UTC().AddDate(0, 0, -i).Format(AnalyticsDateFormat)
+		day := loadedDb.Analytics[date]
+		paths := day.Paths
+		if paths == nil {
+			paths = map[string]int64{}
+		}
+		report.Days = append(report.Days, DailyAnalytics{
+			Date:           date,
+			Hits:           day.Hits,
+			UniqueVisitors: day.Visitors.Estimate(),
+			Paths:          paths,
+		})
+		report.Hits += day.Hits
+		for path, hits := range day.Paths {
+			report.Paths[path] += hits
+		}
+		visitors.Merge(day.Visitors)
+	}
+	report.UniqueVisitors = visitors.Estimate()
+	return report, nil
+}
+
+// TopPaths returns the most visited paths in the report, most visited
+// first.
+func (report AnalyticsReport) TopPaths(limit int) []string {
+	paths := make([]string, 0, len(report.Paths))
+	for path := range report.Paths {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if report.Paths[paths[i]] != report.Paths[paths[j]] {
+			return report.Paths[paths[i]] > report.Paths[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	return paths[:min(limit, len(paths))]
+}
+
+func (db *DB) ResetAnalytics() error {
+	db, span := db.startOperation("ResetAnalytics")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		clear(loadedDb.Analytics)
+		return nil
+	})
+}
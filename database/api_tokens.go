@@ -0,0 +1,115 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ApiTokenPrefix marks personal API tokens so they can be told apart from
+// JWTs in an Authorization header.
+const ApiTokenPrefix = "chirpy_pat_"
+
+type ApiToken struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (token ApiToken) HasScope(scope string) bool {
+	return slices.Contains(token.Scopes, scope)
+}
+
+// CreateApiToken stores a new token for the user and returns it along with
+// the plaintext value, which can't be recovered later.
+func (db *DB) CreateApiToken(userId int, name string, scopes []string) (ApiToken, string, error) {
+	db, span := db.startOperation("CreateApiToken")
+	defer span.End()
+	secret, randErr := generateRandomHex(32)
+	if randErr != nil {
+		return ApiToken{}, "", randErr
+	}
+	plaintext := ApiTokenPrefix + secret
+	apiToken := ApiToken{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		if _, exists := loadedDb.Users[userId]; !exists {
+			return errors.New("User does not exist")
+		}
+		apiToken = ApiToken{
+			Id:        nextId(loadedDb, "api_tokens", loadedDb.ApiTokens),
+			UserId:    userId,
+			Name:      name,
+			Scopes:    scopes,
+			TokenHash: hashToken(plaintext),
+			CreatedAt: time.Now().UTC(),
+		}
+		loadedDb.ApiTokens[apiToken.Id] = apiToken
+		return nil
+	})
+	if updateErr != nil {
+		return ApiToken{}, "", updateErr
+	}
+	return apiToken, plaintext, nil
+}
+
+func (db *DB) GetApiTokens(userId int) ([]ApiToken, error) {
+	db, span := db.startOperation("GetApiTokens")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []ApiToken{}, loadErr
+	}
+	apiTokens := []ApiToken{}
+	for _, apiToken := range loadedDb.ApiTokens {
+		if apiToken.UserId == userId {
+			apiTokens = append(apiTokens, apiToken)
+		}
+	}
+	slices.SortFunc(apiTokens, func(a, b ApiToken) int {
+		return a.Id - b.Id
+	})
+	return apiTokens, nil
+}
+
+func (db *DB) RevokeApiToken(userId, tokenId int) error {
+	db, span := db.startOperation("RevokeApiToken")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		apiToken, exists := loadedDb.ApiTokens[tokenId]
+		if !exists || apiToken.UserId != userId {
+			return errors.New("Token does not exist")
+		}
+		delete(loadedDb.ApiTokens, tokenId)
+		return nil
+	})
+}
+
+func (db *DB) AuthenticateApiToken(plaintext string) (ApiToken, error) {
+	db, span := db.startOperation("AuthenticateApiToken")
+	defer span.End()
+	if !strings.HasPrefix(plaintext, ApiTokenPrefix) {
+		return ApiToken{}, errors.New("Invalid API token")
+	}
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return ApiToken{}, loadErr
+	}
+	tokenHash := hashToken(plaintext)
+	for _, apiToken := range loadedDb.ApiTokens {
+		if apiToken.TokenHash == tokenHash {
+			owner := loadedDb.Users[apiToken.UserId]
+			if !owner.DeletionScheduledAt.IsZero() {
+				return ApiToken{}, errors.New("Account is scheduled for deletion")
+			}
+			if statusErr := owner.CheckActive(time.Now()); statusErr != nil {
+				return ApiToken{}, statusErr
+			}
+			return apiToken, nil
+		}
+	}
+	return ApiToken{}, errors.New("Invalid API token")
+}
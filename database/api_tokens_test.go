@@ -0,0 +1,29 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestApiTokensOfInactiveUsersRejected(t *testing.T) {
+	db := newTestDB(t)
+	admin, _ := db.CreateUser("admin@example.com", "pw")
+	user, _ := db.CreateUser("user@example.com", "pw")
+	_, plaintext, createErr := db.CreateApiToken(user.Id, "reader", []string{"chirps:read"})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	if _, statusErr := db.SetUserStatus(user.Id, admin.Id, StatusBanned, "spam", time.Time{}); statusErr != nil {
+		t.Fatal(statusErr)
+	}
+	if _, authErr := db.AuthenticateApiToken(plaintext); !errors.Is(authErr, ErrAccountBanned) {
+		t.Errorf("API token of a banned user returned %v, want %v", authErr, ErrAccountBanned)
+	}
+	if _, statusErr := db.SetUserStatus(user.Id, admin.Id, StatusActive, "", time.Time{}); statusErr != nil {
+		t.Fatal(statusErr)
+	}
+	if _, authErr := db.AuthenticateApiToken(plaintext); authErr != nil {
+		t.Errorf("API token of a reinstated user returned %v", authErr)
+	}
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// Ledger entry types. Charges, refunds and failed payments come from Polka
+// and may carry an amount; cancellations and expirations only record that
+// the subscription ended, which churn reporting relies on.
+const (
+	LedgerCharge        = "charge"
+	LedgerRefund        = "refund"
+	LedgerPaymentFailed = "payment_failed"
+	LedgerCanceled      = "canceled"
+	LedgerExpired       = "expired"
+)
+
+// LedgerEntry is one line of a user's billing history. Entries are kept
+// when the user's account is purged so revenue and churn reports stay
+// accurate.
+type LedgerEntry struct {
+	Id           int       `json:"id"`
+	UserId       int       `json:"user_id"`
+	Type         string    `json:"type"`
+	PolkaEventId string    `json:"polka_event_id,omitempty"`
+	InvoiceId    string    `json:"invoice_id,omitempty"`
+	AmountCents  int64     `json:"amount_cents"`
+	Currency     string    `json:"currency,omitempty"`
+	PeriodEnd    time.Time `json:"period_end"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// IsInvoice reports whether the entry is a payment attempt or refund, as
+// opposed to a change in subscription state.
+func (entry LedgerEntry) IsInvoice() bool {
+	return entry.Type == LedgerCharge || entry.Type == LedgerRefund || entry.Type == LedgerPaymentFailed
+}
+
+// BillingPeriod summarizes subscription activity in one calendar month.
+// Subscribers counts users with an active subscription at the start of
+// the month, according to the ledger, and ChurnRate is Churned relative to
+// that count.
+type BillingPeriod struct {
+	Month          string           `json:"month"`
+	Subscribers    int              `json:"subscribers"`
+	NewSubscribers int              `json:"new_subscribers"`
+	Churned        int              `json:"churned"`
+	ChurnRate      float64          `json:"churn_rate"`
+	RevenueCents   map[string]int64 `json:"revenue_cents"`
+}
+
+type BillingReport struct {
+	GeneratedAt       time.Time       `json:"generated_at"`
+	ActiveSubscribers int             `json:"active_subscribers"`
+	PastDue           int             `json:"past_due"`
+	Periods           []BillingPeriod `json:"periods"`
+}
+
+var polkaLedgerTypes = map[string]string{
+	PolkaEventUpgraded:      LedgerCharge,
+	PolkaEventRenewed:       LedgerCharge,
+	PolkaEventPaymentFailed: LedgerPaymentFailed,
+	PolkaEventDowngraded:    LedgerCanceled,
+	PolkaEventRefunded:      LedgerRefund,
+}
+
+func addLedgerEntry(loadedDb DBStructure, entry LedgerEntry) {
+	entry.Id = nextId(loadedDb, "ledger", loadedDb.Ledger)
+	entry.PeriodEnd = entry.PeriodEnd.UTC()
+	entry.CreatedAt = entry.CreatedAt.UTC()
+	loadedDb.Ledger[entry.Id] = entry
+}
+
+func sortedLedger(loadedDb DBStructure, userId int) []LedgerEntry {
+	entries := []LedgerEntry{}
+	for _, entry := range loadedDb.Ledger {
+		if userId == 0 || entry.UserId == userId {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Id < entries[j].Id
+	})
+	return entries
+}
+
+// GetLedger returns the user's billing history, oldest first.
+func (db *DB) GetLedger(userId int) ([]LedgerEntry, error) {
+	db, span := db.startOperation("GetLedger")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []LedgerEntry{}, loadErr
+	}
+	return sortedLedger(loadedDb, userId), nil
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// GetBillingReport counts current subscribers and replays the ledger to
+// report new subscribers, churn and revenue for each of the last months
+// calendar months, oldest first. Users upgraded before the ledger existed
+// count as active subscribers but don't appear in the monthly periods.
+func (db *DB) GetBillingReport(now time.Time, months int) (BillingReport, error) {
+	db, span := db.startOperation("GetBillingReport")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return BillingReport{}, loadErr
+	}
+	report := BillingReport{GeneratedAt: now.UTC(), Periods: []BillingPeriod{}}
+	for _, user := range loadedDb.Users {
+		if user.HasChirpyRed(now) {
+			report.ActiveSubscribers++
+			if user.Subscription.Status == SubscriptionPastDue {
+				report.PastDue++
+			}
+		}
+	}
+	first := monthStart(now).AddDate(0, 1-months, 0)
+	periodIndex := func(t time.Time) int {
+		start := monthStart(t)
+		return (start.Year()-first.Year())*12 + int(start.Month()) - int(first.Month())
+	}
+	for i := 0; i < months; i++ {
+		report.Periods = append(report.Periods, BillingPeriod{
+			Month:        first.AddDate(0, i, 0).Format("2006-01"),
+			RevenueCents: map[string]int64{},
+		})
+	}
+	active := map[int]bool{}
+	current := -1
+	for _, entry := range sortedLedger(loadedDb, 0) {
+		index := periodIndex(entry.CreatedAt)
+		for current < index && current < months-1 {
+			current++
+			if current >= 0 {
+				report.Periods[current].Subscribers = len(active)
+			}
+		}
+		wasActive := active[entry.UserId]
+		switch entry.Type {
+		case LedgerCharge:
+			active[entry.UserId] = true
+		case LedgerRefund, LedgerCanceled, LedgerExpired:
+			delete(active, entry.UserId)
+		}
+		if index < 0 || index >= months {
+			continue
+		}
+		period := &report.Periods[index]
+		switch {
+		case !wasActive && active[entry.UserId]:
+			period.NewSubscribers++
+		case wasActive && !active[entry.UserId]:
+			period.Churned++
+		}
+		if entry.AmountCents == 0 {
+			continue
+		}
+		switch entry.Type {
+		case LedgerCharge:
+			period.RevenueCents[entry.Currency] += entry.AmountCents
+		case LedgerRefund:
+			period.RevenueCents[entry.Currency] -= entry.AmountCents
+		}
+	}
+	for current < months-1 {
+		current++
+		if current >= 0 {
+			report.Periods[current].Subscribers = len(active)
+		}
+	}
+	for i := range report.Periods {
+		if report.Periods[i].Subscribers > 0 {
+			report.Periods[i].ChurnRate = float64(report.Periods[i].Churned) / float64(report.Periods[i].Subscribers)
+		}
+	}
+	return report, nil
+}
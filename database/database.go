@@ -1,11 +1,13 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"sort"
 	"strconv"
@@ -13,33 +15,95 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path     string
+	mux      *sync.RWMutex
+	observer Observer
+	ctx      context.Context
+}
+
+// Observer is told how long each read or write of the database file took
+// and how many bytes it moved. operation is "load" or "write".
+type Observer func(operation string, duration time.Duration, bytes int)
+
+// SetObserver registers observer for every later database operation. It
+// must be called before the database is shared between goroutines.
+func (db *DB) SetObserver(observer Observer) {
+	db.observer = observer
+}
+
+func (db *DB) observe(operation string, start time.Time, bytes int) {
+	if db.observer != nil {
+		db.observer(operation, time.Since(start), bytes)
+	}
 }
 
 type DBStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
-	Users         map[int]User         `json:"users"`
-	RefreshTokens map[int]RefreshToken `json:"refresh_token"`
+	Chirps               map[int]Chirp                     `json:"chirps"`
+	Users                map[int]User                      `json:"users"`
+	RefreshTokens        map[int]RefreshToken              `json:"refresh_token"`
+	PasswordResets       map[string]PasswordReset          `json:"password_resets"`
+	ApiTokens            map[int]ApiToken                  `json:"api_tokens"`
+	OauthClients         map[string]OauthClient            `json:"oauth_clients"`
+	OauthCodes           map[string]OauthAuthorizationCode `json:"oauth_codes"`
+	OauthRefreshTokens   map[string]OauthRefreshToken      `json:"oauth_refresh_tokens"`
+	Reports              map[int]Report                    `json:"reports"`
+	ModerationActions    map[int]ModerationAction          `json:"moderation_actions"`
+	Relationships        map[int]Relationship              `json:"relationships"`
+	Conversations        map[int]Conversation              `json:"conversations"`
+	Messages             map[int]Message                   `json:"messages"`
+	Media                map[int]Media                     `json:"media"`
+	PolkaEvents          map[string]PolkaEvent             `json:"polka_events"`
+	WebhookDeliveries    map[string]time.Time              `json:"webhook_deliveries"`
+	InboundWebhooks      map[int]InboundWebhook            `json:"inbound_webhooks"`
+	WebhookSubscriptions map[int]WebhookSubscription       `json:"webhook_subscriptions"`
+	OutboundDeliveries   map[int]OutboundDelivery          `json:"outbound_deliveries"`
+	Ledger               map[int]LedgerEntry               `json:"ledger"`
+	Analytics            map[string]DayAnalytics           `json:"analytics"`
+	Sequences            map[string]int                    `json:"sequences"`
+	BootstrappedAdmins   map[string]bool                   `json:"bootstrapped_admins"`
+	Migrations           map[string]bool                   `json:"migrations"`
 }
 
 type UserReturn struct {
-	Id           int     `json:"id"`
-	Email        string  `json:"email"`
-	Token        *string `json:"token"`
-	RefreshToken string  `json:"refresh_token"`
-	IsChirpyRed  bool    `json:"is_chirpy_red"`
+	Id            int     `json:"id"`
+	Email         string  `json:"email"`
+	Token         *string `json:"token"`
+	RefreshToken  string  `json:"refresh_token"`
+	IsChirpyRed   bool    `json:"is_chirpy_red"`
+	EmailVerified bool    `json:"email_verified"`
 }
 
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    []byte `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id                  int          `json:"id"`
+	Email               string       `json:"email"`
+	Password            []byte       `json:"password"`
+	IsChirpyRed         bool         `json:"is_chirpy_red"`
+	EmailVerified       bool         `json:"email_verified"`
+	VerificationTokenId string       `json:"verification_token_id"`
+	TotpEnabled         bool         `json:"totp_enabled"`
+	TotpSecret          string       `json:"totp_secret"`
+	TotpPendingSecret   string       `json:"totp_pending_secret"`
+	TotpLastStep        int64        `json:"totp_last_step"`
+	LoginChallengeId    string       `json:"login_challenge_id"`
+	RecoveryCodes       []string     `json:"recovery_codes"`
+	LockedUntil         time.Time    `json:"locked_until"`
+	OidcIssuer          string       `json:"oidc_issuer"`
+	OidcSubject         string       `json:"oidc_subject"`
+	Role                string       `json:"role"`
+	Status              string       `json:"status"`
+	StatusReason        string       `json:"status_reason"`
+	StatusExpiresAt     time.Time    `json:"status_expires_at"`
+	DeletionScheduledAt time.Time    `json:"deletion_scheduled_at"`
+	Handle              string       `json:"handle"`
+	DisplayName         string       `json:"display_name"`
+	Bio                 string       `json:"bio"`
+	AvatarFile          string       `json:"avatar_file"`
+	Private             bool         `json:"private"`
+	Subscription        Subscription `json:"subscription"`
 }
 
 type RefreshToken struct {
@@ -48,9 +112,14 @@ type RefreshToken struct {
 }
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id          int        `json:"id"`
+	Body        string     `json:"body"`
+	AuthorId    int        `json:"author_id"`
+	Hidden      bool       `json:"hidden"`
+	Visibility  string     `json:"visibility"`
+	Mentions    []int      `json:"mentions"`
+	Attachments []string   `json:"attachments"`
+	EditedAt    *time.Time `json:"edited_at,omitempty"`
 }
 
 func NewDB(path string) (*DB, error) {
@@ -59,47 +128,107 @@ func NewDB(path string) (*DB, error) {
 	if err != nil {
 		return &db, err
 	}
-
+	if migrateErr := db.migrate(); migrateErr != nil {
+		return &db, migrateErr
+	}
 	return &db, nil
 }
 
-func (db *DB) CreateChirp(body, authorId string) (Chirp, error) {
-	loadedDb, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
+// CreateChirp stores a chirp with the users it @mentions and the uploaded
+// media in attachmentIds. It returns ErrBlocked if the author and a
+// mentioned user have blocked each other.
+func (db *DB) CreateChirp(body, authorId, visibility string, attachmentIds []int) (Chirp, error) {
+	db, span := db.startOperation("CreateChirp")
+	defer span.End()
 	userId, convErr := strconv.Atoi(authorId)
 	if convErr != nil {
 		return Chirp{}, convErr
 	}
-	offByOne := len(loadedDb.Chirps) + 1
-	loadedDb.Chirps[offByOne] = Chirp{Id: offByOne, Body: body, AuthorId: userId}
-	writeErr := db.writeDB(loadedDb)
-	if writeErr != nil {
-		return Chirp{}, writeErr
+	if !IsValidVisibility(visibility) {
+		return Chirp{}, errors.New("Unknown visibility")
+	}
+	chirp := Chirp{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		mentions, mentionErr := checkedMentions(loadedDb, userId, body)
+		if mentionErr != nil {
+			return mentionErr
+		}
+		chirpId := nextId(loadedDb, "chirps", loadedDb.Chirps)
+		attachments, attachErr := attachMedia(loadedDb, userId, chirpId, attachmentIds)
+		if attachErr != nil {
+			return attachErr
+		}
+		chirp = Chirp{
+			Id:          chirpId,
+			Body:        body,
+			AuthorId:    userId,
+			Visibility:  visibility,
+			Mentions:    mentions,
+			Attachments: attachments,
+		}
+		loadedDb.Chirps[chirpId] = chirp
+		return nil
+	})
+	if updateErr != nil {
+		return Chirp{}, updateErr
 	}
-	return loadedDb.Chirps[offByOne], nil
+	return chirp, nil
+}
+
+// EditChirp replaces the body of one of the author's chirps. Mentions are
+// parsed again, so an edit can't be used to reach a user who blocked the
+// author.
+func (db *DB) EditChirp(chirpId, authorId int, body string) (Chirp, error) {
+	db, span := db.startOperation("EditChirp")
+	defer span.End()
+	chirp := Chirp{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		chirp, exists = loadedDb.Chirps[chirpId]
+		if !exists || chirp.AuthorId != authorId {
+			return errors.New("Not author of chirp")
+		}
+		mentions, mentionErr := checkedMentions(loadedDb, authorId, body)
+		if mentionErr != nil {
+			return mentionErr
+		}
+		editedAt := time.Now().UTC()
+		chirp.Body = body
+		chirp.Mentions = mentions
+		chirp.EditedAt = &editedAt
+		loadedDb.Chirps[chirpId] = chirp
+		return nil
+	})
+	if updateErr != nil {
+		return Chirp{}, updateErr
+	}
+	return chirp, nil
 }
 
 func (db *DB) DeleteChirp(chirpId int, id string) error {
-	loadedDb, loadErr := db.loadDB()
-	if loadErr != nil {
-		return loadErr
-	}
+	db, span := db.startOperation("DeleteChirp")
+	defer span.End()
 	userId, convErr := strconv.Atoi(id)
 	if convErr != nil {
 		return convErr
 	}
-	chirpToDelete := loadedDb.Chirps[chirpId]
-	if chirpToDelete.AuthorId != userId {
-		return errors.New("Not author of chirp")
-	}
-	delete(loadedDb.Chirps, chirpId)
-	db.writeDB(loadedDb)
-	return nil
+	return db.update(func(loadedDb DBStructure) error {
+		chirpToDelete := loadedDb.Chirps[chirpId]
+		if chirpToDelete.AuthorId != userId {
+			return errors.New("Not author of chirp")
+		}
+		delete(loadedDb.Chirps, chirpId)
+		resolveReports(loadedDb, chirpId, 0)
+		return nil
+	})
 }
 
-func (db *DB) GetChirps(authorId, sortDirection string) ([]Chirp, error) {
+// GetChirps returns the chirps viewer is allowed to see, see canViewChirp.
+// Pass the zero User for anonymous requests. Chirps by users the viewer blocked are always left
+// out; chirps by muted users only when not listing a single author.
+func (db *DB) GetChirps(authorId, sortDirection string, viewer User) ([]Chirp, error) {
+	db, span := db.startOperation("GetChirps")
+	defer span.End()
 	loadedDb, loadErr := db.loadDB()
 	if loadErr != nil {
 		return []Chirp{}, loadErr
@@ -110,14 +239,18 @@ func (db *DB) GetChirps(authorId, sortDirection string) ([]Chirp, error) {
 		if convErr != nil {
 			return chirps, convErr
 		}
+		blocked := targetsOf(loadedDb, viewer.Id, RelationshipBlock)
 		for _, chirp := range loadedDb.Chirps {
-			if chirp.AuthorId == id {
+			if chirp.AuthorId == id && canViewChirp(loadedDb, chirp, viewer) && !blocked[chirp.AuthorId] {
 				chirps = append(chirps, chirp)
 			}
 		}
 	} else {
+		hidden := targetsOf(loadedDb, viewer.Id, RelationshipBlock, RelationshipMute)
 		for _, chirp := range loadedDb.Chirps {
-			chirps = append(chirps, chirp)
+			if canViewChirp(loadedDb, chirp, viewer) && !hidden[chirp.AuthorId] {
+				chirps = append(chirps, chirp)
+			}
 		}
 	}
 	chirps = sortChirps(sortDirection, chirps)
@@ -141,75 +274,112 @@ func sortChirps(direction string, chirps []Chirp) []Chirp {
 	return chirps
 }
 
-func (db *DB) GetChirp(id int) (Chirp, error) {
+func (db *DB) GetChirp(id int, viewer User) (Chirp, error) {
+	db, span := db.startOperation("GetChirp")
+	defer span.End()
 	loadedDb, loadErr := db.loadDB()
 	if loadErr != nil {
 		return Chirp{}, errors.New(fmt.Sprintf("Error getting chirp with id: %v", id))
 	}
-	if chirp, exists := loadedDb.Chirps[id]; exists {
-		return chirp, nil
+	if chirp, exists := loadedDb.Chirps[id]; exists && canViewChirp(loadedDb, chirp, viewer) {
+		if _, blocked := findRelationship(loadedDb, viewer.Id, chirp.AuthorId, RelationshipBlock); !blocked {
+			return chirp, nil
+		}
 	}
 	return Chirp{}, errors.New(fmt.Sprintf("Error getting chirp with id: %v", id))
 }
 
 func (db *DB) CreateUser(email string, password string) (UserReturn, error) {
-	loadedDb, loadErr := db.loadDB()
-	if loadErr != nil {
-		return UserReturn{}, loadErr
-	}
-	_, userExists, userErr := db.doesEmailExist(email)
-	if userErr != nil {
-		return UserReturn{}, userErr
-	}
-	if userExists {
-		return UserReturn{}, errors.New("User already exists")
-	}
-	offByOne := len(loadedDb.Users) + 1
-	hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	db, span := db.startOperation("CreateUser")
+	defer span.End()
+	hashedPassword, hashErr := db.hashPassword(password)
 	if hashErr != nil {
 		return UserReturn{}, hashErr
 	}
-	loadedDb.Users[offByOne] = User{
-		Id:          offByOne,
-		Email:       email,
-		Password:    hashedPassword,
-		IsChirpyRed: false,
-	}
-	writeErr := db.writeDB(loadedDb)
-	if writeErr != nil {
-		return UserReturn{}, writeErr
+	userId := 0
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		if _, userExists := findUserByEmail(loadedDb, email); userExists {
+			return errors.New("User already exists")
+		}
+		userId = nextUserId(loadedDb)
+		loadedDb.Users[userId] = User{
+			Id:          userId,
+			Email:       email,
+			Password:    hashedPassword,
+			IsChirpyRed: false,
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return UserReturn{}, updateErr
 	}
-	return UserReturn{Email: email, Id: offByOne, IsChirpyRed: false}, nil
+	return UserReturn{Email: email, Id: userId, IsChirpyRed: false, EmailVerified: false}, nil
 }
 
-func (db *DB) UpgradeUser(userId int) error {
+func (db *DB) GetUserById(id int) (User, error) {
+	db, span := db.startOperation("GetUserById")
+	defer span.End()
 	loadedDb, loadErr := db.loadDB()
 	if loadErr != nil {
-		return loadErr
+		return User{}, loadErr
 	}
-	user, exists := loadedDb.Users[userId]
+	user, exists := loadedDb.Users[id]
 	if !exists {
-		return errors.New("User does not exist")
+		return User{}, errors.New("User does not exist")
 	}
-	user.IsChirpyRed = true
-	loadedDb.Users[userId] = user
-	db.writeDB(loadedDb)
-	return nil
+	return user, nil
 }
 
 func (db *DB) VerifyUser(email, password, jwtSecret string, expiresInSeconds int) (UserReturn, error) {
+	db, span := db.startOperation("VerifyUser")
+	defer span.End()
+	user, checkErr := db.checkPassword(email, password)
+	if checkErr != nil {
+		return UserReturn{}, checkErr
+	}
+	if user.TotpEnabled {
+		return UserReturn{Id: user.Id, Email: user.Email}, ErrTotpRequired
+	}
+	return db.loginUser(user, jwtSecret, expiresInSeconds)
+}
+
+// VerifyPassword checks a user's email and password and that the account is
+// active, without logging them in: no tokens are issued and a scheduled
+// deletion is left in place.
+func (db *DB) VerifyPassword(email, password string) (User, error) {
+	db, span := db.startOperation("VerifyPassword")
+	defer span.End()
+	return db.checkPassword(email, password)
+}
+
+func (db *DB) checkPassword(email, password string) (User, error) {
 	user, userExists, err := db.doesEmailExist(email)
 	if err != nil {
-		return UserReturn{}, err
+		return User{}, err
 	}
 	if !userExists {
-		return UserReturn{}, errors.New("User does not exist")
+		return User{}, errors.New("User does not exist")
 	}
-	compareErr := bcrypt.CompareHashAndPassword(user.Password, []byte(password))
+	compareErr := db.comparePassword(user.Password, password)
 	if compareErr != nil {
-		return UserReturn{}, compareErr
+		return User{}, compareErr
 	}
-	signedToken, signingErr := getSignedToken(user.Id, expiresInSeconds, jwtSecret)
+	if statusErr := user.CheckActive(time.Now()); statusErr != nil {
+		return User{}, statusErr
+	}
+	return user, nil
+}
+
+func (db *DB) loginUser(user User, jwtSecret string, expiresInSeconds int) (UserReturn, error) {
+	if statusErr := user.CheckActive(time.Now()); statusErr != nil {
+		return UserReturn{}, statusErr
+	}
+	if !user.DeletionScheduledAt.IsZero() {
+		if cancelErr := db.cancelAccountDeletion(user.Id); cancelErr != nil {
+			return UserReturn{}, cancelErr
+		}
+	}
+	signedToken, signingErr := db.getSignedToken(user.Id, expiresInSeconds, jwtSecret)
 	if signingErr != nil {
 		return UserReturn{}, signingErr
 	}
@@ -218,15 +388,16 @@ func (db *DB) VerifyUser(email, password, jwtSecret string, expiresInSeconds int
 		return UserReturn{}, refreshTokenErr
 	}
 	return UserReturn{
-		Id:           user.Id,
-		Email:        user.Email,
-		Token:        &signedToken,
-		RefreshToken: refreshToken.Token,
-		IsChirpyRed:  user.IsChirpyRed,
+		Id:            user.Id,
+		Email:         user.Email,
+		Token:         &signedToken,
+		RefreshToken:  refreshToken.Token,
+		IsChirpyRed:   user.HasChirpyRed(time.Now()),
+		EmailVerified: user.EmailVerified,
 	}, nil
 }
 
-func getSignedToken(id, expiresInSeconds int, jwtSecret string) (string, error) {
+func (db *DB) getSignedToken(id, expiresInSeconds int, jwtSecret string) (string, error) {
 	d, _ := time.ParseDuration("1h")
 	if d.Abs().Seconds() > float64(expiresInSeconds) && expiresInSeconds != 0 {
 		d = time.Duration(time.Second * time.Duration(expiresInSeconds))
@@ -240,7 +411,7 @@ func getSignedToken(id, expiresInSeconds int, jwtSecret string) (string, error)
 			Subject:   strconv.Itoa(id),
 		},
 	)
-	signedToken, signingErr := jwtToken.SignedString([]byte(jwtSecret))
+	signedToken, signingErr := db.signToken(jwtToken, []byte(jwtSecret))
 	if signingErr != nil {
 		return "", signingErr
 	}
@@ -248,31 +419,35 @@ func getSignedToken(id, expiresInSeconds int, jwtSecret string) (string, error)
 }
 
 func (db *DB) GetNewTokenFromRefreshToken(refreshToken, jwtSecret string) (string, error) {
+	db, span := db.startOperation("GetNewTokenFromRefreshToken")
+	defer span.End()
 	loadedDb, loadErr := db.loadDB()
 	if loadErr != nil {
 		return "", loadErr
 	}
 	for id, token := range loadedDb.RefreshTokens {
 		if token.Token == refreshToken && token.Exp.Sub(time.Now()) > 0 {
-			return getSignedToken(id, 0, jwtSecret)
+			if statusErr := loadedDb.Users[id].CheckActive(time.Now()); statusErr != nil {
+				return "", statusErr
+			}
+			return db.getSignedToken(id, 0, jwtSecret)
 		}
 	}
 	return "", errors.New("Invalid refresh token")
 }
 
 func (db *DB) RemoveRefreshToken(refreshToken string) error {
-	loadedDb, loadErr := db.loadDB()
-	if loadErr != nil {
-		return loadErr
-	}
-	for id, token := range loadedDb.RefreshTokens {
-		if token.Token == refreshToken {
-			delete(loadedDb.RefreshTokens, id)
-			db.writeDB(loadedDb)
-			return nil
+	db, span := db.startOperation("RemoveRefreshToken")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		for id, token := range loadedDb.RefreshTokens {
+			if token.Token == refreshToken {
+				delete(loadedDb.RefreshTokens, id)
+				return nil
+			}
 		}
-	}
-	return nil
+		return errUnchanged
+	})
 }
 
 func (db *DB) getValidOrNewRefreshToken(userId int) (RefreshToken, error) {
@@ -299,39 +474,86 @@ func (db *DB) getValidRefreshToken(userId int) (RefreshToken, bool, error) {
 }
 
 func (db *DB) createNewRefreshToken(userId int) (RefreshToken, error) {
-	randBytes := make([]byte, 32)
-	_, readErr := rand.Read(randBytes)
-	if readErr != nil {
-		return RefreshToken{}, readErr
+	token, randErr := generateRandomHex(32)
+	if randErr != nil {
+		return RefreshToken{}, randErr
 	}
-	token := hex.EncodeToString(randBytes)
 	expiration := time.Now().Add(time.Hour * 24 * 60)
-	loadedDb, loadErr := db.loadDB()
-	if loadErr != nil {
-		return RefreshToken{}, loadErr
-	}
 	refreshToken := RefreshToken{Token: token, Exp: expiration}
-	loadedDb.RefreshTokens[userId] = refreshToken
-	db.writeDB(loadedDb)
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		loadedDb.RefreshTokens[userId] = refreshToken
+		return nil
+	})
+	if updateErr != nil {
+		return RefreshToken{}, updateErr
+	}
 	return refreshToken, nil
 }
 
-func (db *DB) UpdateUser(id, email, password string) (UserReturn, error) {
+// ErrWrongPassword is returned when the current password given to confirm
+// an email or password change does not match.
+var ErrWrongPassword = errors.New("Current password is incorrect")
+
+// ErrEmailTaken is returned when a user tries to change their email to one
+// another account already uses.
+var ErrEmailTaken = errors.New("Email already in use")
+
+// UpdateUser changes the user's email and, unless password is empty, their
+// password. Either change must be confirmed with currentPassword, so a
+// stolen access token alone can't take over the account.
+func (db *DB) UpdateUser(id, currentPassword, email, password string) (UserReturn, error) {
+	db, span := db.startOperation("UpdateUser")
+	defer span.End()
 	userId, conversionErr := strconv.Atoi(id)
 	if conversionErr != nil {
 		return UserReturn{}, conversionErr
 	}
-	loadedDb, loadErr := db.loadDB()
-	if loadErr != nil {
-		return UserReturn{}, loadErr
+	user, userErr := db.GetUserById(userId)
+	if userErr != nil {
+		return UserReturn{}, userErr
 	}
-	hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if hashErr != nil {
-		return UserReturn{}, hashErr
+	if user.Email != email || password != "" {
+		if compareErr := db.comparePassword(user.Password, currentPassword); compareErr != nil {
+			return UserReturn{}, ErrWrongPassword
+		}
+	}
+	hashedPassword := []byte{}
+	if password != "" {
+		var hashErr error
+		hashedPassword, hashErr = db.hashPassword(password)
+		if hashErr != nil {
+			return UserReturn{}, hashErr
+		}
 	}
-	loadedDb.Users[userId] = User{Id: userId, Email: email, Password: hashedPassword}
-	db.writeDB(loadedDb)
-	return UserReturn{Email: loadedDb.Users[userId].Email, Id: loadedDb.Users[userId].Id}, nil
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if password != "" {
+			user.Password = hashedPassword
+		}
+		if other, taken := findUserByEmail(loadedDb, email); taken && other.Id != userId {
+			return ErrEmailTaken
+		}
+		if user.Email != email {
+			user.EmailVerified = false
+			user.VerificationTokenId = ""
+		}
+		user.Email = email
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return UserReturn{}, updateErr
+	}
+	return UserReturn{
+		Email:         user.Email,
+		Id:            user.Id,
+		IsChirpyRed:   user.HasChirpyRed(time.Now()),
+		EmailVerified: user.EmailVerified,
+	}, nil
 }
 
 func (db *DB) doesEmailExist(email string) (User, bool, error) {
@@ -339,19 +561,68 @@ func (db *DB) doesEmailExist(email string) (User, bool, error) {
 	if loadErr != nil {
 		return User{}, false, loadErr
 	}
+	user, exists := findUserByEmail(loadedDb, email)
+	return user, exists, nil
+}
+
+func findUserByEmail(loadedDb DBStructure, email string) (User, bool) {
 	for _, user := range loadedDb.Users {
 		if user.Email == email {
-			return user, true, nil
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// nextId hands out the next id of the named collection. The last id is
+// stored in Sequences, so an id is never handed out again after a delete,
+// even of the newest row. Databases written before Sequences existed carry
+// on from the largest id in use.
+func nextId[T any](loadedDb DBStructure, name string, collection map[int]T) int {
+	id := loadedDb.Sequences[name]
+	for existing := range collection {
+		if existing > id {
+			id = existing
 		}
 	}
-	return User{}, false, nil
+	id++
+	loadedDb.Sequences[name] = id
+	return id
+}
+
+// nextUserId is nextId for users. Ledger entries and moderation actions
+// outlive a purged user, so ids they mention are never reused either.
+func nextUserId(loadedDb DBStructure) int {
+	lastId := loadedDb.Sequences["users"]
+	for _, entry := range loadedDb.Ledger {
+		lastId = max(lastId, entry.UserId)
+	}
+	for _, action := range loadedDb.ModerationActions {
+		lastId = max(lastId, action.TargetUserId, action.ModeratorId)
+	}
+	loadedDb.Sequences["users"] = lastId
+	return nextId(loadedDb, "users", loadedDb.Users)
+}
+
+func generateRandomHex(numBytes int) (string, error) {
+	randBytes := make([]byte, numBytes)
+	_, readErr := rand.Read(randBytes)
+	if readErr != nil {
+		return "", readErr
+	}
+	return hex.EncodeToString(randBytes), nil
 }
 
 func (db *DB) ensureDB() error {
 	_, err := os.ReadFile(db.path)
 	if err != nil {
-		fmt.Println("Creating db")
-		db.writeDB(DBStructure{Chirps: make(map[int]Chirp), Users: make(map[int]User), RefreshTokens: make(map[int]RefreshToken)})
+		slog.Info("Creating database", "path", db.path)
+		dbStructure := DBStructure{}
+		dbStructure.initMaps()
+		for _, migration := range migrations {
+			dbStructure.Migrations[migration.name] = true
+		}
+		db.writeDB(dbStructure)
 	}
 	return nil
 }
@@ -359,26 +630,148 @@ func (db *DB) ensureDB() error {
 func (db *DB) loadDB() (DBStructure, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
+	return db.readFile()
+}
+
+func (db *DB) writeDB(dbStructure DBStructure) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.writeFile(dbStructure)
+}
+
+// errUnchanged can be returned by the modify function passed to update to
+// skip the write when there turned out to be nothing to change.
+var errUnchanged = errors.New("Nothing to write")
+
+// update loads the database, lets modify change it and writes it back,
+// holding the lock the whole time. A separate loadDB and writeDB would lose
+// anything written by another goroutine in between. Nothing is written if
+// modify returns an error, and modify must not call other DB methods.
+func (db *DB) update(modify func(loadedDb DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	loadedDb, loadErr := db.readFile()
+	if loadErr != nil {
+		return loadErr
+	}
+	if modifyErr := modify(loadedDb); modifyErr != nil {
+		if errors.Is(modifyErr, errUnchanged) {
+			return nil
+		}
+		return modifyErr
+	}
+	return db.writeFile(loadedDb)
+}
+
+// readFile and writeFile must be called with db.mux held.
+func (db *DB) readFile() (DBStructure, error) {
+	span := db.startSpan("db.load")
+	start := time.Now()
 	file, _ := os.ReadFile(db.path)
 	dbStructure := DBStructure{}
 	err := json.Unmarshal(file, &dbStructure)
+	db.observe("load", start, len(file))
+	span.SetAttributes(attribute.Int("db.bytes", len(file)))
+	endSpan(span, err)
 	if err != nil {
 		return DBStructure{}, errors.New("Error unmarshaling db")
 	}
+	dbStructure.initMaps()
 	return dbStructure, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// initMaps allocates any collection missing from the file, which happens
+// when a database written by an older version is loaded.
+func (dbStructure *DBStructure) initMaps() {
+	if dbStructure.Chirps == nil {
+		dbStructure.Chirps = make(map[int]Chirp)
+	}
+	if dbStructure.Users == nil {
+		dbStructure.Users = make(map[int]User)
+	}
+	if dbStructure.RefreshTokens == nil {
+		dbStructure.RefreshTokens = make(map[int]RefreshToken)
+	}
+	if dbStructure.PasswordResets == nil {
+		dbStructure.PasswordResets = make(map[string]PasswordReset)
+	}
+	if dbStructure.ApiTokens == nil {
+		dbStructure.ApiTokens = make(map[int]ApiToken)
+	}
+	if dbStructure.OauthClients == nil {
+		dbStructure.OauthClients = make(map[string]OauthClient)
+	}
+	if dbStructure.OauthCodes == nil {
+		dbStructure.OauthCodes = make(map[string]OauthAuthorizationCode)
+	}
+	if dbStructure.OauthRefreshTokens == nil {
+		dbStructure.OauthRefreshTokens = make(map[string]OauthRefreshToken)
+	}
+	if dbStructure.Reports == nil {
+		dbStructure.Reports = make(map[int]Report)
+	}
+	if dbStructure.ModerationActions == nil {
+		dbStructure.ModerationActions = make(map[int]ModerationAction)
+	}
+	if dbStructure.Relationships == nil {
+		dbStructure.Relationships = make(map[int]Relationship)
+	}
+	if dbStructure.Conversations == nil {
+		dbStructure.Conversations = make(map[int]Conversation)
+	}
+	if dbStructure.Messages == nil {
+		dbStructure.Messages = make(map[int]Message)
+	}
+	if dbStructure.Media == nil {
+		dbStructure.Media = make(map[int]Media)
+	}
+	if dbStructure.PolkaEvents == nil {
+		dbStructure.PolkaEvents = make(map[string]PolkaEvent)
+	}
+	if dbStructure.WebhookDeliveries == nil {
+		dbStructure.WebhookDeliveries = make(map[string]time.Time)
+	}
+	if dbStructure.InboundWebhooks == nil {
+		dbStructure.InboundWebhooks = make(map[int]InboundWebhook)
+	}
+	if dbStructure.WebhookSubscriptions == nil {
+		dbStructure.WebhookSubscriptions = make(map[int]WebhookSubscription)
+	}
+	if dbStructure.OutboundDeliveries == nil {
+		dbStructure.OutboundDeliveries = make(map[int]OutboundDelivery)
+	}
+	if dbStructure.Ledger == nil {
+		dbStructure.Ledger = make(map[int]LedgerEntry)
+	}
+	if dbStructure.Analytics == nil {
+		dbStructure.Analytics = make(map[string]DayAnalytics)
+	}
+	if dbStructure.Sequences == nil {
+		dbStructure.Sequences = make(map[string]int)
+	}
+	if dbStructure.BootstrappedAdmins == nil {
+		dbStructure.BootstrappedAdmins = make(map[string]bool)
+	}
+	if dbStructure.Migrations == nil {
+		dbStructure.Migrations = make(map[string]bool)
+	}
+}
+
+func (db *DB) writeFile(dbStructure DBStructure) error {
+	span := db.startSpan("db.write")
+	start := time.Now()
 	data, marshalErr := json.Marshal(dbStructure)
 	if marshalErr != nil {
-		fmt.Println("Marshal err")
+		endSpan(span, marshalErr)
+		slog.Error("Error marshaling database", "error", marshalErr)
 		return marshalErr
 	}
 	writeErr := os.WriteFile(db.path, data, 0666)
+	db.observe("write", start, len(data))
+	span.SetAttributes(attribute.Int("db.bytes", len(data)))
+	endSpan(span, writeErr)
 	if writeErr != nil {
-		fmt.Println("Write err")
+		slog.Error("Error writing database", "path", db.path, "error", writeErr)
 		return writeErr
 	}
 	return nil
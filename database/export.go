@@ -0,0 +1,158 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// ExportedProfile is everything stored on the user record, minus password
+// hashes and second factor secrets.
+type ExportedProfile struct {
+	Id                  int          `json:"id"`
+	Email               string       `json:"email"`
+	Handle              string       `json:"handle"`
+	DisplayName         string       `json:"display_name"`
+	Bio                 string       `json:"bio"`
+	AvatarFile          string       `json:"avatar_file,omitempty"`
+	EmailVerified       bool         `json:"email_verified"`
+	IsChirpyRed         bool         `json:"is_chirpy_red"`
+	Role                string       `json:"role"`
+	Status              string       `json:"status"`
+	StatusReason        string       `json:"status_reason,omitempty"`
+	Subscription        Subscription `json:"subscription"`
+	TotpEnabled         bool         `json:"totp_enabled"`
+	OidcIssuer          string       `json:"oidc_issuer,omitempty"`
+	OidcSubject         string       `json:"oidc_subject,omitempty"`
+	DeletionScheduledAt *time.Time   `json:"deletion_scheduled_at,omitempty"`
+}
+
+type UserExport struct {
+	ExportedAt           time.Time             `json:"exported_at"`
+	Profile              ExportedProfile       `json:"profile"`
+	Chirps               []Chirp               `json:"chirps"`
+	ApiTokens            []ApiToken            `json:"api_tokens"`
+	OauthClients         []OauthClient         `json:"oauth_clients"`
+	Relationships        []Relationship        `json:"relationships"`
+	Reports              []Report              `json:"reports"`
+	ModerationActions    []ModerationAction    `json:"moderation_actions"`
+	Conversations        []Conversation        `json:"conversations"`
+	Messages             []Message             `json:"messages"`
+	Media                []Media               `json:"media"`
+	WebhookSubscriptions []WebhookSubscription `json:"webhook_subscriptions"`
+	Ledger               []LedgerEntry         `json:"ledger"`
+}
+
+// ExportUserData collects everything stored about the user. Token and
+// client secret hashes and webhook signing secrets are left out.
+func (db *DB) ExportUserData(userId int) (UserExport, error) {
+	db, span := db.startOperation("ExportUserData")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return UserExport{}, loadErr
+	}
+	user, exists := loadedDb.Users[userId]
+	if !exists {
+		return UserExport{}, errors.New("User does not exist")
+	}
+	now := time.Now().UTC()
+	export := UserExport{
+		ExportedAt: now,
+		Profile: ExportedProfile{
+			Id:            user.Id,
+			Email:         user.Email,
+			Handle:        user.Handle,
+			DisplayName:   user.DisplayName,
+			Bio:           user.Bio,
+			AvatarFile:    user.AvatarFile,
+			EmailVerified: user.EmailVerified,
+			IsChirpyRed:   user.HasChirpyRed(now),
+			Role:          user.EffectiveRole(),
+			Status:        user.EffectiveStatus(now),
+			StatusReason:  user.StatusReason,
+			Subscription:  user.Subscription,
+			TotpEnabled:   user.TotpEnabled,
+			OidcIssuer:    user.OidcIssuer,
+			OidcSubject:   user.OidcSubject,
+		},
+		Chirps:               []Chirp{},
+		ApiTokens:            []ApiToken{},
+		OauthClients:         []OauthClient{},
+		Relationships:        []Relationship{},
+		Reports:              []Report{},
+		ModerationActions:    []ModerationAction{},
+		Conversations:        []Conversation{},
+		Messages:             []Message{},
+		Media:                []Media{},
+		WebhookSubscriptions: []WebhookSubscription{},
+		Ledger:               sortedLedger(loadedDb, userId),
+	}
+	if !user.DeletionScheduledAt.IsZero() {
+		export.Profile.DeletionScheduledAt = &user.DeletionScheduledAt
+	}
+	for _, chirp := range loadedDb.Chirps {
+		if chirp.AuthorId == userId {
+			export.Chirps = append(export.Chirps, chirp)
+		}
+	}
+	for _, apiToken := range loadedDb.ApiTokens {
+		if apiToken.UserId == userId {
+			apiToken.TokenHash = ""
+			export.ApiTokens = append(export.ApiTokens, apiToken)
+		}
+	}
+	for _, client := range loadedDb.OauthClients {
+		if client.OwnerId == userId {
+			client.SecretHash = ""
+			export.OauthClients = append(export.OauthClients, client)
+		}
+	}
+	for _, relationship := range loadedDb.Relationships {
+		if relationship.UserId == userId {
+			export.Relationships = append(export.Relationships, relationship)
+		}
+	}
+	for _, report := range loadedDb.Reports {
+		if report.ReporterId == userId {
+			export.Reports = append(export.Reports, report)
+		}
+	}
+	for _, action := range loadedDb.ModerationActions {
+		if action.TargetUserId == userId {
+			export.ModerationActions = append(export.ModerationActions, action)
+		}
+	}
+	for _, conversation := range loadedDb.Conversations {
+		if conversation.hasParticipant(userId) {
+			export.Conversations = append(export.Conversations, conversation)
+		}
+	}
+	for _, message := range loadedDb.Messages {
+		if message.SenderId == userId {
+			export.Messages = append(export.Messages, message)
+		}
+	}
+	for _, media := range loadedDb.Media {
+		if media.OwnerId == userId {
+			export.Media = append(export.Media, media)
+		}
+	}
+	for _, subscription := range loadedDb.WebhookSubscriptions {
+		if subscription.OwnerId == userId {
+			subscription.Secret = ""
+			export.WebhookSubscriptions = append(export.WebhookSubscriptions, subscription)
+		}
+	}
+	slices.SortFunc(export.Chirps, func(a, b Chirp) int { return a.Id - b.Id })
+	slices.SortFunc(export.ApiTokens, func(a, b ApiToken) int { return a.Id - b.Id })
+	slices.SortFunc(export.OauthClients, func(a, b OauthClient) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	slices.SortFunc(export.Relationships, func(a, b Relationship) int { return a.Id - b.Id })
+	slices.SortFunc(export.Reports, func(a, b Report) int { return a.Id - b.Id })
+	slices.SortFunc(export.ModerationActions, func(a, b ModerationAction) int { return a.Id - b.Id })
+	slices.SortFunc(export.Conversations, func(a, b Conversation) int { return a.Id - b.Id })
+	slices.SortFunc(export.Messages, func(a, b Message) int { return a.Id - b.Id })
+	slices.SortFunc(export.Media, func(a, b Media) int { return a.Id - b.Id })
+	slices.SortFunc(export.WebhookSubscriptions, func(a, b WebhookSubscription) int { return a.Id - b.Id })
+	return export, nil
+}
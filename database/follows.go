@@ -0,0 +1,110 @@
+package database
+
+import (
+	"errors"
+)
+
+// Follow makes userId follow targetId. Private accounts get a follow request
+// instead, which the owner has to approve.
+func (db *DB) Follow(userId, targetId int) (Relationship, error) {
+	db, span := db.startOperation("Follow")
+	defer span.End()
+	if userId == targetId {
+		return Relationship{}, errors.New("You can't follow yourself")
+	}
+	relationship := Relationship{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		target, exists := loadedDb.Users[targetId]
+		if !exists || !target.DeletionScheduledAt.IsZero() {
+			return errors.New("User does not exist")
+		}
+		if isBlockedBetween(loadedDb, userId, targetId) {
+			return ErrBlocked
+		}
+		if existing, following := findRelationship(loadedDb, userId, targetId, RelationshipFollow); following {
+			relationship = existing
+			return errUnchanged
+		}
+		kind := RelationshipFollow
+		if target.Private {
+			kind = RelationshipFollowRequest
+		}
+		relationship = addRelationship(loadedDb, userId, targetId, kind)
+		return nil
+	})
+	if updateErr != nil {
+		return Relationship{}, updateErr
+	}
+	return relationship, nil
+}
+
+// Unfollow ends a follow or withdraws a pending follow request.
+func (db *DB) Unfollow(userId, targetId int) error {
+	db, span := db.startOperation("Unfollow")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		removedFollow := removeRelationship(loadedDb, userId, targetId, RelationshipFollow)
+		removedRequest := removeRelationship(loadedDb, userId, targetId, RelationshipFollowRequest)
+		if !removedFollow && !removedRequest {
+			return errors.New("Not following user")
+		}
+		return nil
+	})
+}
+
+// ApproveFollowRequest turns the pending request from requesterId into a
+// follow of userId.
+func (db *DB) ApproveFollowRequest(userId, requesterId int) (Relationship, error) {
+	db, span := db.startOperation("ApproveFollowRequest")
+	defer span.End()
+	relationship := Relationship{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		if !removeRelationship(loadedDb, requesterId, userId, RelationshipFollowRequest) {
+			return errors.New("Follow request does not exist")
+		}
+		relationship = addRelationship(loadedDb, requesterId, userId, RelationshipFollow)
+		return nil
+	})
+	if updateErr != nil {
+		return Relationship{}, updateErr
+	}
+	return relationship, nil
+}
+
+// RemoveFollower rejects a pending request from followerId or removes them
+// as a follower of userId.
+func (db *DB) RemoveFollower(userId, followerId int) error {
+	db, span := db.startOperation("RemoveFollower")
+	defer span.End()
+	return db.Unfollow(followerId, userId)
+}
+
+// SetPrivate switches private mode. Going public approves every pending
+// follow request, since they would no longer need approval.
+func (db *DB) SetPrivate(userId int, private bool) (User, error) {
+	db, span := db.startOperation("SetPrivate")
+	defer span.End()
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		user.Private = private
+		loadedDb.Users[userId] = user
+		if !private {
+			for _, relationship := range loadedDb.Relationships {
+				if relationship.TargetId == userId && relationship.Kind == RelationshipFollowRequest {
+					removeRelationship(loadedDb, relationship.UserId, userId, RelationshipFollowRequest)
+					addRelationship(loadedDb, relationship.UserId, userId, RelationshipFollow)
+				}
+			}
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return User{}, updateErr
+	}
+	return user, nil
+}
@@ -3,6 +3,14 @@ module github.com/GavinDevelops/chirpy/database
 go 1.22.5
 
 require (
-	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
-	golang.org/x/crypto v0.25.0 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	go.opentelemetry.io/otel v1.32.0
+	go.opentelemetry.io/otel/trace v1.32.0
+	golang.org/x/crypto v0.25.0
+)
+
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	go.opentelemetry.io/otel/metric v1.32.0 // indirect
 )
@@ -0,0 +1,35 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// LockUser blocks password logins for the user with the given email until
+// the given time.
+func (db *DB) LockUser(email string, until time.Time) error {
+	db, span := db.startOperation("LockUser")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		user, exists := findUserByEmail(loadedDb, email)
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		user.LockedUntil = until
+		loadedDb.Users[user.Id] = user
+		return nil
+	})
+}
+
+func (db *DB) GetLockedUntil(email string) (time.Time, error) {
+	db, span := db.startOperation("GetLockedUntil")
+	defer span.End()
+	user, userExists, userErr := db.doesEmailExist(email)
+	if userErr != nil {
+		return time.Time{}, userErr
+	}
+	if !userExists {
+		return time.Time{}, errors.New("User does not exist")
+	}
+	return user.LockedUntil, nil
+}
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, dbErr := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if dbErr != nil {
+		t.Fatal(dbErr)
+	}
+	return db
+}
+
+func TestLockUser(t *testing.T) {
+	db := newTestDB(t)
+	created, createErr := db.CreateUser("a@example.com", "pw")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	until := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	if lockErr := db.LockUser("a@example.com", until); lockErr != nil {
+		t.Fatal(lockErr)
+	}
+	lockedUntil, getErr := db.GetLockedUntil("a@example.com")
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if !lockedUntil.Equal(until) {
+		t.Errorf("locked until %v, want %v", lockedUntil, until)
+	}
+	if lockErr := db.LockUser("b@example.com", until); lockErr == nil {
+		t.Error("locked a user that doesn't exist")
+	}
+	user, _ := db.GetUserById(created.Id)
+	if user.Email != "a@example.com" {
+		t.Errorf("email = %q after lock", user.Email)
+	}
+}
+
+func TestLockUserKeepsConcurrentUpdates(t *testing.T) {
+	db := newTestDB(t)
+	created, createErr := db.CreateUser("a@example.com", "pw")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	if _, createErr := db.CreateUser("b@example.com", "pw"); createErr != nil {
+		t.Fatal(createErr)
+	}
+	until := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			db.LockUser("a@example.com", until)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		db.SetUserRole(created.Id, RoleModerator)
+	}()
+	wg.Wait()
+	user, getErr := db.GetUserById(created.Id)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if user.Role != RoleModerator {
+		t.Errorf("role = %q, want %q", user.Role, RoleModerator)
+	}
+	if !user.LockedUntil.Equal(until) {
+		t.Errorf("locked until %v, want %v", user.LockedUntil, until)
+	}
+}
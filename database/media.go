@@ -0,0 +1,128 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// unattachedMediaTTL is how long an upload may wait to be attached to a
+// chirp before it is pruned.
+const unattachedMediaTTL = time.Hour * 24
+
+var ErrInvalidAttachment = errors.New("Attachments must be your own unused uploads")
+
+// Media is an uploaded image. It belongs to its uploader until it is
+// attached to a chirp, after which it lives and dies with the chirp.
+type Media struct {
+	Id          int       `json:"id"`
+	OwnerId     int       `json:"owner_id"`
+	File        string    `json:"file"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	ChirpId     int       `json:"chirp_id,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (db *DB) CreateMedia(ownerId int, file, contentType string, size int) (Media, error) {
+	db, span := db.startOperation("CreateMedia")
+	defer span.End()
+	media := Media{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		media = Media{
+			Id:          nextId(loadedDb, "media", loadedDb.Media),
+			OwnerId:     ownerId,
+			File:        file,
+			ContentType: contentType,
+			Size:        size,
+			CreatedAt:   time.Now().UTC(),
+		}
+		loadedDb.Media[media.Id] = media
+		return nil
+	})
+	if updateErr != nil {
+		return Media{}, updateErr
+	}
+	return media, nil
+}
+
+// GetAttachment returns the media stored in file if viewer may see it. An
+// attachment is as visible as its chirp; an upload not yet attached is only
+// visible to its owner.
+func (db *DB) GetAttachment(file string, viewer User) (Media, error) {
+	db, span := db.startOperation("GetAttachment")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return Media{}, loadErr
+	}
+	for _, media := range loadedDb.Media {
+		if media.File != file {
+			continue
+		}
+		if media.ChirpId == 0 {
+			if viewer.Id != 0 && viewer.Id == media.OwnerId {
+				return media, nil
+			}
+			break
+		}
+		chirp, exists := loadedDb.Chirps[media.ChirpId]
+		if !exists || !canViewChirp(loadedDb, chirp, viewer) {
+			break
+		}
+		if _, blocked := findRelationship(loadedDb, viewer.Id, chirp.AuthorId, RelationshipBlock); blocked {
+			break
+		}
+		return media, nil
+	}
+	return Media{}, errors.New("Media not found")
+}
+
+// attachMedia checks that every media id belongs to ownerId and is not yet
+// attached, then attaches them to chirpId. It returns the stored files in
+// the order given.
+func attachMedia(loadedDb DBStructure, ownerId, chirpId int, mediaIds []int) ([]string, error) {
+	files := []string{}
+	for i, mediaId := range mediaIds {
+		media, exists := loadedDb.Media[mediaId]
+		if !exists || media.OwnerId != ownerId || media.ChirpId != 0 || slices.Contains(mediaIds[:i], mediaId) {
+			return []string{}, ErrInvalidAttachment
+		}
+		files = append(files, media.File)
+	}
+	for _, mediaId := range mediaIds {
+		media := loadedDb.Media[mediaId]
+		media.ChirpId = chirpId
+		loadedDb.Media[mediaId] = media
+	}
+	return files, nil
+}
+
+// PruneMedia drops media whose chirp or owner is gone and uploads that were
+// never attached. It returns the removed records so the caller can delete
+// the files.
+func (db *DB) PruneMedia(now time.Time) ([]Media, error) {
+	db, span := db.startOperation("PruneMedia")
+	defer span.End()
+	pruned := []Media{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for mediaId, media := range loadedDb.Media {
+			_, ownerExists := loadedDb.Users[media.OwnerId]
+			_, chirpExists := loadedDb.Chirps[media.ChirpId]
+			orphaned := media.ChirpId != 0 && !chirpExists
+			expired := media.ChirpId == 0 && media.CreatedAt.Add(unattachedMediaTTL).Before(now)
+			if !ownerExists || orphaned || expired {
+				delete(loadedDb.Media, mediaId)
+				pruned = append(pruned, media)
+			}
+		}
+		if len(pruned) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return []Media{}, updateErr
+	}
+	return pruned, nil
+}
@@ -0,0 +1,275 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+const MaxConversationParticipants = 8
+
+var ErrNotParticipant = errors.New("Conversation does not exist")
+
+type Conversation struct {
+	Id             int       `json:"id"`
+	ParticipantIds []int     `json:"participant_ids"`
+	CreatedById    int       `json:"created_by_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	// ReadUpTo holds, per participant, the id of the last message they
+	// have read. It doubles as the read receipts shown to the others.
+	ReadUpTo map[int]int `json:"read_up_to"`
+}
+
+type Message struct {
+	Id             int       `json:"id"`
+	ConversationId int       `json:"conversation_id"`
+	SenderId       int       `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type ConversationSummary struct {
+	Conversation
+	LastMessage *Message `json:"last_message"`
+	UnreadCount int      `json:"unread_count"`
+}
+
+func (conversation Conversation) hasParticipant(userId int) bool {
+	return slices.Contains(conversation.ParticipantIds, userId)
+}
+
+// blockedParticipant reports whether userId and any other participant have
+// blocked each other.
+func blockedParticipant(loadedDb DBStructure, conversation Conversation, userId int) bool {
+	for _, participantId := range conversation.ParticipantIds {
+		if participantId != userId && isBlockedBetween(loadedDb, userId, participantId) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateConversation starts a conversation between the creator and
+// participantIds. Starting a one-to-one conversation that already exists
+// returns the existing one.
+func (db *DB) CreateConversation(creatorId int, participantIds []int) (Conversation, error) {
+	db, span := db.startOperation("CreateConversation")
+	defer span.End()
+	participants := append([]int{creatorId}, participantIds...)
+	slices.Sort(participants)
+	participants = slices.Compact(participants)
+	if len(participants) < 2 {
+		return Conversation{}, errors.New("A conversation needs at least one other participant")
+	}
+	if len(participants) > MaxConversationParticipants {
+		return Conversation{}, errors.New("Too many participants")
+	}
+	conversation := Conversation{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for _, participantId := range participants {
+			participant, exists := loadedDb.Users[participantId]
+			if !exists || !participant.DeletionScheduledAt.IsZero() {
+				return errors.New("User does not exist")
+			}
+			if participantId != creatorId && isBlockedBetween(loadedDb, creatorId, participantId) {
+				return ErrBlocked
+			}
+		}
+		if len(participants) == 2 {
+			for _, existing := range loadedDb.Conversations {
+				if slices.Equal(existing.ParticipantIds, participants) {
+					conversation = existing
+					return errUnchanged
+				}
+			}
+		}
+		conversation = Conversation{
+			Id:             nextId(loadedDb, "conversations", loadedDb.Conversations),
+			ParticipantIds: participants,
+			CreatedById:    creatorId,
+			CreatedAt:      time.Now().UTC(),
+			ReadUpTo:       make(map[int]int),
+		}
+		loadedDb.Conversations[conversation.Id] = conversation
+		return nil
+	})
+	if updateErr != nil {
+		return Conversation{}, updateErr
+	}
+	return conversation, nil
+}
+
+// SendMessage adds a message to the conversation and marks it read for the
+// sender. It returns ErrBlocked if the sender and another participant have
+// blocked each other.
+func (db *DB) SendMessage(conversationId, senderId int, body string) (Message, error) {
+	db, span := db.startOperation("SendMessage")
+	defer span.End()
+	message := Message{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		conversation, exists := loadedDb.Conversations[conversationId]
+		if !exists || !conversation.hasParticipant(senderId) {
+			return ErrNotParticipant
+		}
+		if blockedParticipant(loadedDb, conversation, senderId) {
+			return ErrBlocked
+		}
+		message = Message{
+			Id:             nextId(loadedDb, "messages", loadedDb.Messages),
+			ConversationId: conversationId,
+			SenderId:       senderId,
+			Body:           body,
+			CreatedAt:      time.Now().UTC(),
+		}
+		loadedDb.Messages[message.Id] = message
+		if conversation.ReadUpTo == nil {
+			conversation.ReadUpTo = make(map[int]int)
+		}
+		conversation.ReadUpTo[senderId] = message.Id
+		loadedDb.Conversations[conversationId] = conversation
+		return nil
+	})
+	if updateErr != nil {
+		return Message{}, updateErr
+	}
+	return message, nil
+}
+
+// GetConversations lists the user's conversations, most recently active
+// first, each with its last message and the user's unread count.
+func (db *DB) GetConversations(userId int) ([]ConversationSummary, error) {
+	db, span := db.startOperation("GetConversations")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []ConversationSummary{}, loadErr
+	}
+	summaries := make(map[int]*ConversationSummary)
+	for _, conversation := range loadedDb.Conversations {
+		if conversation.hasParticipant(userId) {
+			summaries[conversation.Id] = &ConversationSummary{Conversation: conversation}
+		}
+	}
+	for _, message := range loadedDb.Messages {
+		summary, exists := summaries[message.ConversationId]
+		if !exists {
+			continue
+		}
+		if summary.LastMessage == nil || message.Id > summary.LastMessage.Id {
+			summary.LastMessage = &message
+		}
+		if message.SenderId != userId && message.Id > summary.ReadUpTo[userId] {
+			summary.UnreadCount++
+		}
+	}
+	result := make([]ConversationSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, *summary)
+	}
+	slices.SortFunc(result, func(a, b ConversationSummary) int {
+		return lastActivity(b).Compare(lastActivity(a))
+	})
+	return result, nil
+}
+
+func lastActivity(summary ConversationSummary) time.Time {
+	if summary.LastMessage != nil {
+		return summary.LastMessage.CreatedAt
+	}
+	return summary.CreatedAt
+}
+
+// GetMessages returns up to limit messages older than the message id
+// before, newest first. Pass before as 0 to start from the latest message.
+func (db *DB) GetMessages(conversationId, userId, before, limit int) ([]Message, error) {
+	db, span := db.startOperation("GetMessages")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []Message{}, loadErr
+	}
+	conversation, exists := loadedDb.Conversations[conversationId]
+	if !exists || !conversation.hasParticipant(userId) {
+		return []Message{}, ErrNotParticipant
+	}
+	messages := []Message{}
+	for _, message := range loadedDb.Messages {
+		if message.ConversationId == conversationId && (before == 0 || message.Id < before) {
+			messages = append(messages, message)
+		}
+	}
+	slices.SortFunc(messages, func(a, b Message) int {
+		return b.Id - a.Id
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+// MarkConversationRead records that the user has read up to messageId, or
+// up to the latest message when messageId is 0. Read markers never move
+// backwards.
+func (db *DB) MarkConversationRead(conversationId, userId, messageId int) (Conversation, error) {
+	db, span := db.startOperation("MarkConversationRead")
+	defer span.End()
+	conversation := Conversation{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		conversation, exists = loadedDb.Conversations[conversationId]
+		if !exists || !conversation.hasParticipant(userId) {
+			return ErrNotParticipant
+		}
+		latest := 0
+		for _, message := range loadedDb.Messages {
+			if message.ConversationId == conversationId && message.Id > latest {
+				latest = message.Id
+			}
+		}
+		if messageId == 0 || messageId > latest {
+			messageId = latest
+		}
+		if conversation.ReadUpTo == nil {
+			conversation.ReadUpTo = make(map[int]int)
+		}
+		if messageId > conversation.ReadUpTo[userId] {
+			conversation.ReadUpTo[userId] = messageId
+		}
+		loadedDb.Conversations[conversationId] = conversation
+		return nil
+	})
+	if updateErr != nil {
+		return Conversation{}, updateErr
+	}
+	return conversation, nil
+}
+
+// removeFromConversations deletes the messages a purged user sent and takes
+// them out of every conversation. Conversations left with fewer than two
+// participants are deleted along with their messages.
+func removeFromConversations(loadedDb DBStructure, userId int) {
+	for messageId, message := range loadedDb.Messages {
+		if message.SenderId == userId {
+			delete(loadedDb.Messages, messageId)
+		}
+	}
+	for conversationId, conversation := range loadedDb.Conversations {
+		if !conversation.hasParticipant(userId) {
+			continue
+		}
+		conversation.ParticipantIds = slices.DeleteFunc(conversation.ParticipantIds, func(id int) bool {
+			return id == userId
+		})
+		delete(conversation.ReadUpTo, userId)
+		if len(conversation.ParticipantIds) >= 2 {
+			loadedDb.Conversations[conversationId] = conversation
+			continue
+		}
+		delete(loadedDb.Conversations, conversationId)
+		for messageId, message := range loadedDb.Messages {
+			if message.ConversationId == conversationId {
+				delete(loadedDb.Messages, messageId)
+			}
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package database
+
+// migrations upgrade the data of databases written by older versions. Each
+// runs once, in order; a new database starts with all of them applied.
+var migrations = []struct {
+	name  string
+	apply func(loadedDb DBStructure)
+}{
+	{name: "verify_existing_emails", apply: verifyExistingEmails},
+}
+
+// verifyExistingEmails marks accounts created before email verification
+// existed as verified, since they were never sent a verification email and
+// would otherwise be locked out of writing. Accounts that were sent one
+// have a VerificationTokenId and still have to use it.
+func verifyExistingEmails(loadedDb DBStructure) {
+	for id, user := range loadedDb.Users {
+		if !user.EmailVerified && user.VerificationTokenId == "" {
+			user.EmailVerified = true
+			loadedDb.Users[id] = user
+		}
+	}
+}
+
+func (db *DB) migrate() error {
+	return db.update(func(loadedDb DBStructure) error {
+		applied := false
+		for _, migration := range migrations {
+			if loadedDb.Migrations[migration.name] {
+				continue
+			}
+			migration.apply(loadedDb)
+			loadedDb.Migrations[migration.name] = true
+			applied = true
+		}
+		if !applied {
+			return errUnchanged
+		}
+		return nil
+	})
+}
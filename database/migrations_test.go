@@ -0,0 +1,75 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestMigrateVerifiesExistingEmails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	old := `{"chirps":{},"users":{
+		"1":{"id":1,"email":"old@example.com","password":"","is_chirpy_red":false},
+		"2":{"id":2,"email":"pending@example.com","password":"","email_verified":false,"verification_token_id":"abc"}
+	}}`
+	if writeErr := os.WriteFile(path, []byte(old), 0666); writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	db, dbErr := NewDB(path)
+	if dbErr != nil {
+		t.Fatal(dbErr)
+	}
+	legacy, _ := db.GetUserById(1)
+	if !legacy.EmailVerified {
+		t.Error("account from before email verification is not verified")
+	}
+	pending, _ := db.GetUserById(2)
+	if pending.EmailVerified {
+		t.Error("account with an outstanding verification email was verified")
+	}
+
+	// The migration only runs once, so later unverified accounts stay
+	// unverified across restarts.
+	created, createErr := db.CreateUser("new@example.com", "pw")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	reopened, reopenErr := NewDB(path)
+	if reopenErr != nil {
+		t.Fatal(reopenErr)
+	}
+	if user, _ := reopened.GetUserById(created.Id); user.EmailVerified {
+		t.Error("account created after the migration was verified on restart")
+	}
+}
+
+func TestNewDatabaseSkipsMigrations(t *testing.T) {
+	db := newTestDB(t)
+	created, createErr := db.CreateUser("new@example.com", "pw")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	reopened, reopenErr := NewDB(db.path)
+	if reopenErr != nil {
+		t.Fatal(reopenErr)
+	}
+	if user, _ := reopened.GetUserById(created.Id); user.EmailVerified {
+		t.Error("account in a new database was verified by a migration")
+	}
+}
+
+func TestUpdateUserRejectsTakenEmail(t *testing.T) {
+	db := newTestDB(t)
+	first, _ := db.CreateUser("first@example.com", "pw")
+	if _, createErr := db.CreateUser("second@example.com", "pw"); createErr != nil {
+		t.Fatal(createErr)
+	}
+	_, updateErr := db.UpdateUser(strconv.Itoa(first.Id), "pw", "second@example.com", "")
+	if updateErr != ErrEmailTaken {
+		t.Errorf("UpdateUser to a taken email returned %v, want %v", updateErr, ErrEmailTaken)
+	}
+	if _, updateErr := db.UpdateUser(strconv.Itoa(first.Id), "pw", "first@example.com", "new-pw"); updateErr != nil {
+		t.Errorf("UpdateUser keeping the same email returned %v", updateErr)
+	}
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	ReportOpen     = "open"
+	ReportResolved = "resolved"
+
+	ModerationHide    = "hide"
+	ModerationDelete  = "delete"
+	ModerationWarn    = "warn"
+	ModerationSuspend = "suspend"
+	ModerationDismiss = "dismiss"
+
+	// Recorded when an admin changes a user's status directly.
+	ModerationBan       = "ban"
+	ModerationReinstate = "reinstate"
+)
+
+// ErrOutranked is returned when a moderator acts against a user whose role
+// is the same as or above their own.
+var ErrOutranked = errors.New("Can't moderate a user with the same or a higher role")
+
+type Report struct {
+	Id         int       `json:"id"`
+	ChirpId    int       `json:"chirp_id"`
+	ReporterId int       `json:"reporter_id"`
+	Reason     string    `json:"reason"`
+	Status     string    `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	ActionId   int       `json:"action_id,omitempty"`
+}
+
+// ModerationAction is the audit record of a moderator acting on a report.
+type ModerationAction struct {
+	Id           int        `json:"id"`
+	ModeratorId  int        `json:"moderator_id"`
+	Action       string     `json:"action"`
+	ReportId     int        `json:"report_id"`
+	ChirpId      int        `json:"chirp_id"`
+	ChirpBody    string     `json:"chirp_body"`
+	TargetUserId int        `json:"target_user_id"`
+	Reason       string     `json:"reason"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+func IsValidModerationAction(action string) bool {
+	switch action {
+	case ModerationHide, ModerationDelete, ModerationWarn, ModerationSuspend, ModerationDismiss:
+		return true
+	}
+	return false
+}
+
+func (db *DB) CreateReport(chirpId, reporterId int, reason string) (Report, error) {
+	db, span := db.startOperation("CreateReport")
+	defer span.End()
+	report := Report{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		chirp, exists := loadedDb.Chirps[chirpId]
+		if !exists || !canViewChirp(loadedDb, chirp, loadedDb.Users[reporterId]) {
+			return errors.New("Chirp does not exist")
+		}
+		for _, existing := range loadedDb.Reports {
+			if existing.ChirpId == chirpId && existing.ReporterId == reporterId && existing.Status == ReportOpen {
+				return errors.New("Chirp already reported")
+			}
+		}
+		report = Report{
+			Id:         nextId(loadedDb, "reports", loadedDb.Reports),
+			ChirpId:    chirpId,
+			ReporterId: reporterId,
+			Reason:     reason,
+			Status:     ReportOpen,
+			CreatedAt:  time.Now().UTC(),
+		}
+		loadedDb.Reports[report.Id] = report
+		return nil
+	})
+	if updateErr != nil {
+		return Report{}, updateErr
+	}
+	return report, nil
+}
+
+// GetReports returns reports oldest first, optionally filtered by status.
+func (db *DB) GetReports(status string) ([]Report, error) {
+	db, span := db.startOperation("GetReports")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []Report{}, loadErr
+	}
+	reports := []Report{}
+	for _, report := range loadedDb.Reports {
+		if status == "" || report.Status == status {
+			reports = append(reports, report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Id < reports[j].Id
+	})
+	return reports, nil
+}
+
+// ApplyModerationAction carries out action against the chirp of a report,
+// resolves every open report about that chirp and records the action in the
+// audit trail. suspendUntil is only used by the suspend action.
+func (db *DB) ApplyModerationAction(reportId, moderatorId int, action, reason string, suspendUntil time.Time) (ModerationAction, error) {
+	db, span := db.startOperation("ApplyModerationAction")
+	defer span.End()
+	if !IsValidModerationAction(action) {
+		return ModerationAction{}, errors.New("Unknown moderation action")
+	}
+	moderationAction := ModerationAction{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		report, exists := loadedDb.Reports[reportId]
+		if !exists {
+			return errors.New("Report does not exist")
+		}
+		if report.Status != ReportOpen {
+			return errors.New("Report already resolved")
+		}
+		// A report on a chirp that is already gone can still be dismissed.
+		chirp, chirpExists := loadedDb.Chirps[report.ChirpId]
+		if !chirpExists && action != ModerationDismiss {
+			return errors.New("Chirp does not exist")
+		}
+		// Dismissing a report leaves the author alone, so anyone may do it.
+		if author, authorExists := loadedDb.Users[chirp.AuthorId]; authorExists && action != ModerationDismiss {
+			moderator := loadedDb.Users[moderatorId]
+			if roleRank[author.EffectiveRole()] >= roleRank[moderator.EffectiveRole()] {
+				return ErrOutranked
+			}
+		}
+		moderationAction = ModerationAction{
+			Id:           nextId(loadedDb, "moderation_actions", loadedDb.ModerationActions),
+			ModeratorId:  moderatorId,
+			Action:       action,
+			ReportId:     reportId,
+			ChirpId:      report.ChirpId,
+			ChirpBody:    chirp.Body,
+			TargetUserId: chirp.AuthorId,
+			Reason:       reason,
+			CreatedAt:    time.Now().UTC(),
+		}
+		switch action {
+		case ModerationHide:
+			chirp.Hidden = true
+			loadedDb.Chirps[chirp.Id] = chirp
+		case ModerationDelete:
+			delete(loadedDb.Chirps, chirp.Id)
+		case ModerationSuspend:
+			author, authorExists := loadedDb.Users[chirp.AuthorId]
+			if !authorExists {
+				return errors.New("User does not exist")
+			}
+			applyUserStatus(loadedDb, author, StatusSuspended, reason, suspendUntil)
+			moderationAction.ExpiresAt = &suspendUntil
+		}
+		resolveReports(loadedDb, report.ChirpId, moderationAction.Id)
+		loadedDb.ModerationActions[moderationAction.Id] = moderationAction
+		return nil
+	})
+	if updateErr != nil {
+		return ModerationAction{}, updateErr
+	}
+	return moderationAction, nil
+}
+
+// GetModerationActions returns the audit trail newest first.
+func (db *DB) GetModerationActions() ([]ModerationAction, error) {
+	db, span := db.startOperation("GetModerationActions")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []ModerationAction{}, loadErr
+	}
+	actions := []ModerationAction{}
+	for _, action := range loadedDb.ModerationActions {
+		actions = append(actions, action)
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return actions[i].Id > actions[j].Id
+	})
+	return actions, nil
+}
+
+// resolveReports marks the open reports on a chirp resolved by actionId, or
+// by no action when the chirp went away on its own.
+func resolveReports(loadedDb DBStructure, chirpId, actionId int) {
+	for id, report := range loadedDb.Reports {
+		if report.ChirpId == chirpId && report.Status == ReportOpen {
+			report.Status = ReportResolved
+			report.ActionId = actionId
+			loadedDb.Reports[id] = report
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReportsOnDeletedChirps(t *testing.T) {
+	db := newTestDB(t)
+	author, _ := db.CreateUser("author@example.com", "pw")
+	reporter, _ := db.CreateUser("reporter@example.com", "pw")
+	moderator, _ := db.CreateUser("moderator@example.com", "pw")
+	if _, roleErr := db.SetUserRole(moderator.Id, RoleModerator); roleErr != nil {
+		t.Fatal(roleErr)
+	}
+	authorId := strconv.Itoa(author.Id)
+
+	deleted, _ := db.CreateChirp("reported then deleted", authorId, VisibilityPublic, nil)
+	report, reportErr := db.CreateReport(deleted.Id, reporter.Id, "spam")
+	if reportErr != nil {
+		t.Fatal(reportErr)
+	}
+	if deleteErr := db.DeleteChirp(deleted.Id, authorId); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	open, _ := db.GetReports(ReportOpen)
+	if len(open) != 0 {
+		t.Errorf("deleting a chirp left %d open reports", len(open))
+	}
+	if _, actionErr := db.ApplyModerationAction(report.Id, moderator.Id, ModerationDismiss, "", time.Now()); actionErr == nil {
+		t.Error("report closed by deleting its chirp was resolved again")
+	}
+
+	// Reports left open from before chirp deletions closed them can still
+	// be dismissed, but not acted on.
+	stale, _ := db.CreateChirp("deleted before the fix", authorId, VisibilityPublic, nil)
+	staleReport, _ := db.CreateReport(stale.Id, reporter.Id, "spam")
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		delete(loadedDb.Chirps, stale.Id)
+		return nil
+	})
+	if updateErr != nil {
+		t.Fatal(updateErr)
+	}
+	if _, actionErr := db.ApplyModerationAction(staleReport.Id, moderator.Id, ModerationHide, "", time.Now()); actionErr == nil {
+		t.Error("hid a chirp that does not exist")
+	}
+	action, actionErr := db.ApplyModerationAction(staleReport.Id, moderator.Id, ModerationDismiss, "", time.Now())
+	if actionErr != nil {
+		t.Fatalf("dismissing a report on a deleted chirp returned %v", actionErr)
+	}
+	if action.ChirpId != stale.Id {
+		t.Errorf("dismissal recorded chirp %d, want %d", action.ChirpId, stale.Id)
+	}
+	if open, _ := db.GetReports(ReportOpen); len(open) != 0 {
+		t.Errorf("%d reports still open after dismissal", len(open))
+	}
+}
@@ -0,0 +1,332 @@
+package database
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oauthCodeTTL         = time.Minute * 10
+	oauthAccessTokenTTL  = time.Hour
+	oauthRefreshTokenTTL = time.Hour * 24 * 60
+)
+
+var ErrInvalidGrant = errors.New("Invalid or expired grant")
+
+// AccessTokenClaims are the claims carried by every access token. ClientId
+// and Scope are only set on tokens issued to third-party OAuth clients.
+type AccessTokenClaims struct {
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (claims AccessTokenClaims) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(claims.Scope), scope)
+}
+
+type OauthClient struct {
+	ClientId     string    `json:"client_id"`
+	SecretHash   string    `json:"secret_hash"`
+	Name         string    `json:"name"`
+	RedirectUris []string  `json:"redirect_uris"`
+	OwnerId      int       `json:"owner_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// IsConfidential reports whether the client was issued a secret. Public
+// clients such as mobile apps rely on PKCE alone.
+func (client OauthClient) IsConfidential() bool {
+	return client.SecretHash != ""
+}
+
+type OauthAuthorizationCode struct {
+	ClientId      string    `json:"client_id"`
+	UserId        int       `json:"user_id"`
+	RedirectUri   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"`
+	Exp           time.Time `json:"expiration"`
+}
+
+type OauthRefreshToken struct {
+	ClientId string    `json:"client_id"`
+	UserId   int       `json:"user_id"`
+	Scopes   []string  `json:"scopes"`
+	Exp      time.Time `json:"expiration"`
+}
+
+type OauthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// TokenIntrospection follows the response format of RFC 7662.
+type TokenIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+}
+
+func (db *DB) CreateOauthClient(ownerId int, name string, redirectUris []string, confidential bool) (OauthClient, string, error) {
+	db, span := db.startOperation("CreateOauthClient")
+	defer span.End()
+	clientId, idErr := generateRandomHex(16)
+	if idErr != nil {
+		return OauthClient{}, "", idErr
+	}
+	client := OauthClient{
+		ClientId:     clientId,
+		Name:         name,
+		RedirectUris: redirectUris,
+		OwnerId:      ownerId,
+		CreatedAt:    time.Now().UTC(),
+	}
+	secret := ""
+	if confidential {
+		var secretErr error
+		secret, secretErr = generateRandomHex(32)
+		if secretErr != nil {
+			return OauthClient{}, "", secretErr
+		}
+		client.SecretHash = hashToken(secret)
+	}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		loadedDb.OauthClients[clientId] = client
+		return nil
+	})
+	if updateErr != nil {
+		return OauthClient{}, "", updateErr
+	}
+	return client, secret, nil
+}
+
+func (db *DB) GetOauthClient(clientId string) (OauthClient, error) {
+	db, span := db.startOperation("GetOauthClient")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return OauthClient{}, loadErr
+	}
+	client, exists := loadedDb.OauthClients[clientId]
+	if !exists {
+		return OauthClient{}, errors.New("Unknown client")
+	}
+	return client, nil
+}
+
+// AuthenticateOauthClient checks the secret of confidential clients. Public
+// clients authenticate with their id alone.
+func (db *DB) AuthenticateOauthClient(clientId, secret string) (OauthClient, error) {
+	db, span := db.startOperation("AuthenticateOauthClient")
+	defer span.End()
+	client, clientErr := db.GetOauthClient(clientId)
+	if clientErr != nil {
+		return OauthClient{}, clientErr
+	}
+	if client.IsConfidential() && subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1 {
+		return OauthClient{}, errors.New("Invalid client credentials")
+	}
+	return client, nil
+}
+
+func (db *DB) CreateOauthCode(clientId string, userId int, redirectUri string, scopes []string, codeChallenge string) (string, error) {
+	db, span := db.startOperation("CreateOauthCode")
+	defer span.End()
+	code, randErr := generateRandomHex(32)
+	if randErr != nil {
+		return "", randErr
+	}
+	now := time.Now()
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for codeHash, pending := range loadedDb.OauthCodes {
+			if pending.Exp.Before(now) {
+				delete(loadedDb.OauthCodes, codeHash)
+			}
+		}
+		loadedDb.OauthCodes[hashToken(code)] = OauthAuthorizationCode{
+			ClientId:      clientId,
+			UserId:        userId,
+			RedirectUri:   redirectUri,
+			Scopes:        scopes,
+			CodeChallenge: codeChallenge,
+			Exp:           now.Add(oauthCodeTTL),
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return "", updateErr
+	}
+	return code, nil
+}
+
+func pkceChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ExchangeOauthCode redeems an authorization code. Codes are single use and
+// only valid for the client, redirect URI and PKCE verifier they were
+// issued against.
+func (db *DB) ExchangeOauthCode(clientId, code, redirectUri, codeVerifier, jwtSecret string) (OauthTokens, error) {
+	db, span := db.startOperation("ExchangeOauthCode")
+	defer span.End()
+	codeHash := hashToken(code)
+	pending := OauthAuthorizationCode{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		pending, exists = loadedDb.OauthCodes[codeHash]
+		if !exists {
+			return ErrInvalidGrant
+		}
+		delete(loadedDb.OauthCodes, codeHash)
+		return nil
+	})
+	if updateErr != nil {
+		return OauthTokens{}, updateErr
+	}
+	if pending.Exp.Before(time.Now()) ||
+		pending.ClientId != clientId ||
+		pending.RedirectUri != redirectUri ||
+		subtle.ConstantTimeCompare([]byte(pending.CodeChallenge), []byte(pkceChallenge(codeVerifier))) != 1 {
+		return OauthTokens{}, ErrInvalidGrant
+	}
+	return db.issueOauthTokens(clientId, pending.UserId, pending.Scopes, jwtSecret)
+}
+
+// RefreshOauthToken rotates the refresh token, so each one can only be used
+// once.
+func (db *DB) RefreshOauthToken(clientId, refreshToken, jwtSecret string) (OauthTokens, error) {
+	db, span := db.startOperation("RefreshOauthToken")
+	defer span.End()
+	tokenHash := hashToken(refreshToken)
+	grant := OauthRefreshToken{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		grant, exists = loadedDb.OauthRefreshTokens[tokenHash]
+		if !exists || grant.ClientId != clientId {
+			return ErrInvalidGrant
+		}
+		delete(loadedDb.OauthRefreshTokens, tokenHash)
+		return nil
+	})
+	if updateErr != nil {
+		return OauthTokens{}, updateErr
+	}
+	if grant.Exp.Before(time.Now()) {
+		return OauthTokens{}, ErrInvalidGrant
+	}
+	return db.issueOauthTokens(clientId, grant.UserId, grant.Scopes, jwtSecret)
+}
+
+func (db *DB) issueOauthTokens(clientId string, userId int, scopes []string, jwtSecret string) (OauthTokens, error) {
+	user, userErr := db.GetUserById(userId)
+	if userErr != nil {
+		return OauthTokens{}, ErrInvalidGrant
+	}
+	if statusErr := user.CheckActive(time.Now()); statusErr != nil || !user.DeletionScheduledAt.IsZero() {
+		return OauthTokens{}, ErrInvalidGrant
+	}
+	scope := strings.Join(scopes, " ")
+	jwtToken := jwt.NewWithClaims(
+		jwt.SigningMethodHS256,
+		AccessTokenClaims{
+			ClientId: clientId,
+			Scope:    scope,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "chirpy",
+				IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(oauthAccessTokenTTL)),
+				Subject:   strconv.Itoa(userId),
+			},
+		},
+	)
+	accessToken, signingErr := db.signToken(jwtToken, []byte(jwtSecret))
+	if signingErr != nil {
+		return OauthTokens{}, signingErr
+	}
+	refreshToken, randErr := generateRandomHex(32)
+	if randErr != nil {
+		return OauthTokens{}, randErr
+	}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		loadedDb.OauthRefreshTokens[hashToken(refreshToken)] = OauthRefreshToken{
+			ClientId: clientId,
+			UserId:   userId,
+			Scopes:   scopes,
+			Exp:      time.Now().Add(oauthRefreshTokenTTL),
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return OauthTokens{}, updateErr
+	}
+	return OauthTokens{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthAccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}, nil
+}
+
+// IntrospectOauthToken describes an access or refresh token issued to
+// clientId. Tokens belonging to other clients are reported as inactive.
+func (db *DB) IntrospectOauthToken(clientId, token, jwtSecret string) (TokenIntrospection, error) {
+	db, span := db.startOperation("IntrospectOauthToken")
+	defer span.End()
+	claims := AccessTokenClaims{}
+	_, parseErr := jwt.ParseWithClaims(
+		token,
+		&claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return []byte(jwtSecret), nil
+		},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if parseErr == nil {
+		if claims.ClientId != clientId {
+			return TokenIntrospection{Active: false}, nil
+		}
+		return TokenIntrospection{
+			Active:    true,
+			Scope:     claims.Scope,
+			ClientId:  claims.ClientId,
+			Subject:   claims.Subject,
+			TokenType: "access_token",
+			Exp:       claims.ExpiresAt.Unix(),
+			Iat:       claims.IssuedAt.Unix(),
+		}, nil
+	}
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return TokenIntrospection{}, loadErr
+	}
+	grant, exists := loadedDb.OauthRefreshTokens[hashToken(token)]
+	if !exists || grant.ClientId != clientId || grant.Exp.Before(time.Now()) {
+		return TokenIntrospection{Active: false}, nil
+	}
+	return TokenIntrospection{
+		Active:    true,
+		Scope:     strings.Join(grant.Scopes, " "),
+		ClientId:  grant.ClientId,
+		Subject:   strconv.Itoa(grant.UserId),
+		TokenType: "refresh_token",
+		Exp:       grant.Exp.Unix(),
+	}, nil
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrOidcAccountUnverified is returned when an external identity matches the
+// email of an account that never proved it owns that email. Linking it would
+// let whoever registered the address take over the identity.
+var ErrOidcAccountUnverified = errors.New("An account with this email exists but its email is not verified")
+
+// LoginOidcUser signs in the user linked to the external identity, linking
+// it to the account with the same email or creating a new account the first
+// time it is seen. Callers must only pass emails the provider has verified.
+func (db *DB) LoginOidcUser(issuer, subject, email, jwtSecret string) (UserReturn, error) {
+	db, span := db.startOperation("LoginOidcUser")
+	defer span.End()
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for _, existing := range loadedDb.Users {
+			if existing.OidcIssuer == issuer && existing.OidcSubject == subject {
+				user = existing
+				return errUnchanged
+			}
+		}
+		var userExists bool
+		user, userExists = findUserByEmail(loadedDb, email)
+		if userExists {
+			if !user.EmailVerified {
+				return ErrOidcAccountUnverified
+			}
+		} else {
+			// The account has no password until one is set with a password
+			// reset; bcrypt rejects every password against an empty hash.
+			user = User{
+				Id:            nextUserId(loadedDb),
+				Email:         email,
+				EmailVerified: true,
+			}
+		}
+		user.OidcIssuer = issuer
+		user.OidcSubject = subject
+		loadedDb.Users[user.Id] = user
+		return nil
+	})
+	if updateErr != nil {
+		return UserReturn{}, updateErr
+	}
+	return db.loginLinkedUser(user, jwtSecret)
+}
+
+func (db *DB) loginLinkedUser(user User, jwtSecret string) (UserReturn, error) {
+	if statusErr := user.CheckActive(time.Now()); statusErr != nil {
+		return UserReturn{}, statusErr
+	}
+	if user.TotpEnabled {
+		return UserReturn{Id: user.Id, Email: user.Email}, ErrTotpRequired
+	}
+	return db.loginUser(user, jwtSecret, 0)
+}
@@ -0,0 +1,361 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Events delivered to outbound webhook subscriptions.
+const (
+	EventChirpCreated = "chirp.created"
+	EventChirpDeleted = "chirp.deleted"
+	EventUserUpgraded = "user.upgraded"
+	// EventPing is only sent on request, to test a subscription.
+	EventPing = "webhook.ping"
+)
+
+const (
+	MaxWebhookSubscriptions = 10
+
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+var outboundEvents = []string{EventChirpCreated, EventChirpDeleted, EventUserUpgraded}
+
+// WebhookSubscription sends events about its owner to Url. Global
+// subscriptions, which only admins can create, receive events about every
+// user. Secret signs each delivery, so unlike other credentials it is kept
+// in plaintext.
+type WebhookSubscription struct {
+	Id        int       `json:"id"`
+	OwnerId   int       `json:"owner_id"`
+	Url       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Global    bool      `json:"global"`
+	Secret    string    `json:"secret"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OutboundEvent is the body of every delivery.
+type OutboundEvent struct {
+	Id        string          `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+type DeliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+type OutboundDelivery struct {
+	Id             int               `json:"id"`
+	SubscriptionId int               `json:"subscription_id"`
+	EventId        string            `json:"event_id"`
+	Event          string            `json:"event"`
+	Payload        string            `json:"payload"`
+	Status         string            `json:"status"`
+	Attempts       []DeliveryAttempt `json:"attempts"`
+	CreatedAt      time.Time         `json:"created_at"`
+	NextAttemptAt  time.Time         `json:"next_attempt_at"`
+}
+
+func IsValidOutboundEvent(event string) bool {
+	return slices.Contains(outboundEvents, event)
+}
+
+func (subscription WebhookSubscription) receives(event string, subjectUserId int) bool {
+	return slices.Contains(subscription.Events, event) && (subscription.Global || subscription.OwnerId == subjectUserId)
+}
+
+func (db *DB) CreateWebhookSubscription(ownerId int, url string, events []string, global bool) (WebhookSubscription, error) {
+	db, span := db.startOperation("CreateWebhookSubscription")
+	defer span.End()
+	secret, randErr := generateRandomHex(32)
+	if randErr != nil {
+		return WebhookSubscription{}, randErr
+	}
+	subscription := WebhookSubscription{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		owned := 0
+		for _, existing := range loadedDb.WebhookSubscriptions {
+			if existing.OwnerId == ownerId {
+				owned++
+			}
+		}
+		if owned >= MaxWebhookSubscriptions {
+			return errors.New("Too many webhook subscriptions")
+		}
+		subscription = WebhookSubscription{
+			Id:        nextId(loadedDb, "webhook_subscriptions", loadedDb.WebhookSubscriptions),
+			OwnerId:   ownerId,
+			Url:       url,
+			Events:    events,
+			Global:    global,
+			Secret:    secret,
+			CreatedAt: time.Now().UTC(),
+		}
+		loadedDb.WebhookSubscriptions[subscription.Id] = subscription
+		return nil
+	})
+	if updateErr != nil {
+		return WebhookSubscription{}, updateErr
+	}
+	return subscription, nil
+}
+
+func (db *DB) GetWebhookSubscriptions(ownerId int) ([]WebhookSubscription, error) {
+	db, span := db.startOperation("GetWebhookSubscriptions")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []WebhookSubscription{}, loadErr
+	}
+	subscriptions := []WebhookSubscription{}
+	for _, subscription := range loadedDb.WebhookSubscriptions {
+		if subscription.OwnerId == ownerId {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Id < subscriptions[j].Id
+	})
+	return subscriptions, nil
+}
+
+// GetWebhookSubscription looks up a subscription for delivery. Pass an
+// ownerId of 0 to skip the ownership check.
+func (db *DB) GetWebhookSubscription(id, ownerId int) (WebhookSubscription, error) {
+	db, span := db.startOperation("GetWebhookSubscription")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return WebhookSubscription{}, loadErr
+	}
+	subscription, exists := loadedDb.WebhookSubscriptions[id]
+	if !exists || (ownerId != 0 && subscription.OwnerId != ownerId) {
+		return WebhookSubscription{}, errors.New("Webhook subscription does not exist")
+	}
+	return subscription, nil
+}
+
+// DeleteWebhookSubscription removes the subscription along with its
+// delivery log.
+func (db *DB) DeleteWebhookSubscription(id, ownerId int) error {
+	db, span := db.startOperation("DeleteWebhookSubscription")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		subscription, exists := loadedDb.WebhookSubscriptions[id]
+		if !exists || subscription.OwnerId != ownerId {
+			return errors.New("Webhook subscription does not exist")
+		}
+		removeWebhookSubscription(loadedDb, id)
+		return nil
+	})
+}
+
+func removeWebhookSubscription(loadedDb DBStructure, id int) {
+	delete(loadedDb.WebhookSubscriptions, id)
+	for deliveryId, delivery := range loadedDb.OutboundDeliveries {
+		if delivery.SubscriptionId == id {
+			delete(loadedDb.OutboundDeliveries, deliveryId)
+		}
+	}
+}
+
+func newOutboundEvent(event string, data any, now time.Time) (OutboundEvent, string, error) {
+	eventId, randErr := generateRandomHex(16)
+	if randErr != nil {
+		return OutboundEvent{}, "", randErr
+	}
+	encodedData, dataErr := json.Marshal(data)
+	if dataErr != nil {
+		return OutboundEvent{}, "", dataErr
+	}
+	outboundEvent := OutboundEvent{Id: eventId, Event: event, CreatedAt: now.UTC(), Data: encodedData}
+	payload, payloadErr := json.Marshal(outboundEvent)
+	if payloadErr != nil {
+		return OutboundEvent{}, "", payloadErr
+	}
+	return outboundEvent, string(payload), nil
+}
+
+func addOutboundDelivery(loadedDb DBStructure, subscriptionId int, outboundEvent OutboundEvent, payload string) OutboundDelivery {
+	delivery := OutboundDelivery{
+		Id:             nextId(loadedDb, "outbound_deliveries", loadedDb.OutboundDeliveries),
+		SubscriptionId: subscriptionId,
+		EventId:        outboundEvent.Id,
+		Event:          outboundEvent.Event,
+		Payload:        payload,
+		Status:         DeliveryPending,
+		Attempts:       []DeliveryAttempt{},
+		CreatedAt:      outboundEvent.CreatedAt,
+		NextAttemptAt:  outboundEvent.CreatedAt,
+	}
+	loadedDb.OutboundDeliveries[delivery.Id] = delivery
+	return delivery
+}
+
+// QueueOutboundEvent queues a delivery of the event to every subscription
+// that receives events about subjectUserId, and returns how many were
+// queued. Global subscriptions stop receiving events if their owner is no
+// longer an admin.
+func (db *DB) QueueOutboundEvent(event string, subjectUserId int, data any, now time.Time) (int, error) {
+	db, span := db.startOperation("QueueOutboundEvent")
+	defer span.End()
+	outboundEvent, payload, eventErr := newOutboundEvent(event, data, now)
+	if eventErr != nil {
+		return 0, eventErr
+	}
+	queued := 0
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for _, subscription := range loadedDb.WebhookSubscriptions {
+			if !subscription.receives(event, subjectUserId) {
+				continue
+			}
+			if subscription.Global && !loadedDb.Users[subscription.OwnerId].HasRole(RoleAdmin) {
+				continue
+			}
+			addOutboundDelivery(loadedDb, subscription.Id, outboundEvent, payload)
+			queued++
+		}
+		if queued == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return 0, updateErr
+	}
+	return queued, nil
+}
+
+// QueuePing queues a test delivery to a single subscription.
+func (db *DB) QueuePing(subscriptionId, ownerId int, now time.Time) (OutboundDelivery, error) {
+	db, span := db.startOperation("QueuePing")
+	defer span.End()
+	outboundEvent, payload, eventErr := newOutboundEvent(EventPing, map[string]int{"subscription_id": subscriptionId}, now)
+	if eventErr != nil {
+		return OutboundDelivery{}, eventErr
+	}
+	delivery := OutboundDelivery{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		subscription, exists := loadedDb.WebhookSubscriptions[subscriptionId]
+		if !exists || subscription.OwnerId != ownerId {
+			return errors.New("Webhook subscription does not exist")
+		}
+		delivery = addOutboundDelivery(loadedDb, subscriptionId, outboundEvent, payload)
+		return nil
+	})
+	if updateErr != nil {
+		return OutboundDelivery{}, updateErr
+	}
+	return delivery, nil
+}
+
+// GetDueOutboundDeliveries returns pending deliveries whose next attempt is
+// due, oldest first.
+func (db *DB) GetDueOutboundDeliveries(now time.Time) ([]OutboundDelivery, error) {
+	db, span := db.startOperation("GetDueOutboundDeliveries")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []OutboundDelivery{}, loadErr
+	}
+	due := []OutboundDelivery{}
+	for _, delivery := range loadedDb.OutboundDeliveries {
+		if delivery.Status == DeliveryPending && !delivery.NextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Id < due[j].Id
+	})
+	return due, nil
+}
+
+// RecordDeliveryAttempt appends attempt to the delivery log. Failed
+// deliveries are retried with the same backoff as inbound webhooks and
+// marked failed once they run out of attempts.
+func (db *DB) RecordDeliveryAttempt(id int, attempt DeliveryAttempt, delivered bool) (OutboundDelivery, error) {
+	db, span := db.startOperation("RecordDeliveryAttempt")
+	defer span.End()
+	delivery := OutboundDelivery{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		delivery, exists = loadedDb.OutboundDeliveries[id]
+		if !exists {
+			return errors.New("Delivery does not exist")
+		}
+		attempt.At = attempt.At.UTC()
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		switch {
+		case delivered:
+			delivery.Status = DeliveryDelivered
+		case len(delivery.Attempts) >= WebhookMaxAttempts:
+			delivery.Status = DeliveryFailed
+		default:
+			delivery.NextAttemptAt = attempt.At.Add(webhookRetryDelay(len(delivery.Attempts)))
+		}
+		loadedDb.OutboundDeliveries[id] = delivery
+		return nil
+	})
+	if updateErr != nil {
+		return OutboundDelivery{}, updateErr
+	}
+	return delivery, nil
+}
+
+// GetOutboundDeliveries returns the delivery log of a subscription, newest
+// first.
+func (db *DB) GetOutboundDeliveries(subscriptionId, ownerId int) ([]OutboundDelivery, error) {
+	db, span := db.startOperation("GetOutboundDeliveries")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []OutboundDelivery{}, loadErr
+	}
+	subscription, exists := loadedDb.WebhookSubscriptions[subscriptionId]
+	if !exists || subscription.OwnerId != ownerId {
+		return []OutboundDelivery{}, errors.New("Webhook subscription does not exist")
+	}
+	deliveries := []OutboundDelivery{}
+	for _, delivery := range loadedDb.OutboundDeliveries {
+		if delivery.SubscriptionId == subscriptionId {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].Id > deliveries[j].Id
+	})
+	return deliveries, nil
+}
+
+// PruneOutboundDeliveries removes finished deliveries created before
+// before.
+func (db *DB) PruneOutboundDeliveries(before time.Time) (int, error) {
+	db, span := db.startOperation("PruneOutboundDeliveries")
+	defer span.End()
+	pruned := 0
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for id, delivery := range loadedDb.OutboundDeliveries {
+			if delivery.Status != DeliveryPending && delivery.CreatedAt.Before(before) {
+				delete(loadedDb.OutboundDeliveries, id)
+				pruned++
+			}
+		}
+		if pruned == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	return pruned, updateErr
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordDeliveryAttemptBacksOff(t *testing.T) {
+	db := newTestDB(t)
+	owner, createErr := db.CreateUser("a@example.com", "pw")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	subscription, subscribeErr := db.CreateWebhookSubscription(owner.Id, "https://example.com/hooks", []string{EventChirpCreated}, false)
+	if subscribeErr != nil {
+		t.Fatal(subscribeErr)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	delivery, queueErr := db.QueuePing(subscription.Id, owner.Id, now)
+	if queueErr != nil {
+		t.Fatal(queueErr)
+	}
+	wantDelays := []time.Duration{
+		time.Second * 30,
+		time.Minute,
+		time.Minute * 2,
+		time.Minute * 4,
+		time.Minute * 8,
+		time.Minute * 16,
+		time.Minute * 32,
+	}
+	for i, want := range wantDelays {
+		updated, recordErr := db.RecordDeliveryAttempt(delivery.Id, DeliveryAttempt{At: now, StatusCode: 500}, false)
+		if recordErr != nil {
+			t.Fatal(recordErr)
+		}
+		if updated.Status != DeliveryPending {
+			t.Fatalf("status after %d attempts = %s, want pending", i+1, updated.Status)
+		}
+		if got := updated.NextAttemptAt.Sub(now); got != want {
+			t.Errorf("delay after %d attempts = %v, want %v", i+1, got, want)
+		}
+		now = updated.NextAttemptAt
+	}
+	failed, recordErr := db.RecordDeliveryAttempt(delivery.Id, DeliveryAttempt{At: now, Error: "connection refused"}, false)
+	if recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	if failed.Status != DeliveryFailed || len(failed.Attempts) != WebhookMaxAttempts {
+		t.Errorf("after %d attempts delivery is %s with %d attempts, want failed", WebhookMaxAttempts, failed.Status, len(failed.Attempts))
+	}
+	due, dueErr := db.GetDueOutboundDeliveries(now.Add(webhookRetryMax))
+	if dueErr != nil {
+		t.Fatal(dueErr)
+	}
+	if len(due) != 0 {
+		t.Errorf("failed delivery still due: %+v", due)
+	}
+}
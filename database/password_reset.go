@@ -0,0 +1,120 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+// PasswordReset is stored under the SHA-256 hash of the token that was
+// emailed to the user, so a leaked database can't be used to reset accounts.
+type PasswordReset struct {
+	UserId int       `json:"user_id"`
+	Exp    time.Time `json:"expiration"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePasswordResetToken returns a new reset token for the user with the
+// given email, replacing any token previously issued to them.
+func (db *DB) CreatePasswordResetToken(email string) (string, User, error) {
+	db, span := db.startOperation("CreatePasswordResetToken")
+	defer span.End()
+	token, randErr := generateRandomHex(32)
+	if randErr != nil {
+		return "", User{}, randErr
+	}
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var userExists bool
+		user, userExists = findUserByEmail(loadedDb, email)
+		if !userExists {
+			return errors.New("User does not exist")
+		}
+		removePasswordResets(loadedDb, user.Id)
+		loadedDb.PasswordResets[hashToken(token)] = PasswordReset{
+			UserId: user.Id,
+			Exp:    time.Now().Add(passwordResetTTL),
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return "", User{}, updateErr
+	}
+	return token, user, nil
+}
+
+// ResetPassword consumes a reset token, sets the new password and revokes
+// the user's refresh token, OAuth grants and API tokens, so nothing issued
+// before the reset keeps working. Any login lockout is lifted since the user
+// has proven they own the email.
+func (db *DB) ResetPassword(token, password string) error {
+	db, span := db.startOperation("ResetPassword")
+	defer span.End()
+	tokenHash := hashToken(token)
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return loadErr
+	}
+	// Only pay for bcrypt once the token looks usable; it is checked again
+	// under the lock below.
+	var hashedPassword []byte
+	if reset, exists := loadedDb.PasswordResets[tokenHash]; exists && reset.Exp.After(time.Now()) {
+		hashed, hashErr := db.hashPassword(password)
+		if hashErr != nil {
+			return hashErr
+		}
+		hashedPassword = hashed
+	}
+	valid := false
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		reset, exists := loadedDb.PasswordResets[tokenHash]
+		if !exists {
+			return errors.New("Invalid reset token")
+		}
+		delete(loadedDb.PasswordResets, tokenHash)
+		user, userExists := loadedDb.Users[reset.UserId]
+		if reset.Exp.Sub(time.Now()) <= 0 || !userExists || hashedPassword == nil {
+			// Still write, so the spent token is gone.
+			return nil
+		}
+		user.Password = hashedPassword
+		user.LockedUntil = time.Time{}
+		loadedDb.Users[user.Id] = user
+		removePasswordResets(loadedDb, user.Id)
+		delete(loadedDb.RefreshTokens, user.Id)
+		for tokenHash, grant := range loadedDb.OauthRefreshTokens {
+			if grant.UserId == user.Id {
+				delete(loadedDb.OauthRefreshTokens, tokenHash)
+			}
+		}
+		for tokenId, apiToken := range loadedDb.ApiTokens {
+			if apiToken.UserId == user.Id {
+				delete(loadedDb.ApiTokens, tokenId)
+			}
+		}
+		valid = true
+		return nil
+	})
+	if updateErr != nil {
+		return updateErr
+	}
+	if !valid {
+		return errors.New("Invalid reset token")
+	}
+	return nil
+}
+
+func removePasswordResets(loadedDb DBStructure, userId int) {
+	for tokenHash, reset := range loadedDb.PasswordResets {
+		if reset.UserId == userId || reset.Exp.Sub(time.Now()) <= 0 {
+			delete(loadedDb.PasswordResets, tokenHash)
+		}
+	}
+}
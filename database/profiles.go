@@ -0,0 +1,148 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MaxDisplayNameLen = 50
+	MaxBioLen         = 160
+)
+
+var (
+	handlePattern   = regexp.MustCompile(`^[A-Za-z0-9_]{3,30}$`)
+	reservedHandles = []string{"me", "admin", "chirpy", "moderator", "support"}
+
+	ErrHandleTaken = errors.New("Handle is already taken")
+)
+
+// ValidateHandle checks the format of a handle. Uniqueness is checked when
+// the profile is saved.
+func ValidateHandle(handle string) error {
+	if !handlePattern.MatchString(handle) {
+		return errors.New("Handle must be 3 to 30 letters, digits or underscores")
+	}
+	for _, reserved := range reservedHandles {
+		if strings.EqualFold(handle, reserved) {
+			return errors.New("Handle is reserved")
+		}
+	}
+	return nil
+}
+
+// Profile is the part of a user that anyone may see.
+type Profile struct {
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+}
+
+func (profile Profile) Validate() error {
+	if profile.Handle != "" {
+		if handleErr := ValidateHandle(profile.Handle); handleErr != nil {
+			return handleErr
+		}
+	}
+	if utf8.RuneCountInString(profile.DisplayName) > MaxDisplayNameLen {
+		return fmt.Errorf("Display name must be at most %d characters", MaxDisplayNameLen)
+	}
+	if utf8.RuneCountInString(profile.Bio) > MaxBioLen {
+		return fmt.Errorf("Bio must be at most %d characters", MaxBioLen)
+	}
+	return nil
+}
+
+func findUserByHandle(loadedDb DBStructure, handle string) (User, bool) {
+	for _, user := range loadedDb.Users {
+		if user.Handle != "" && strings.EqualFold(user.Handle, handle) {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// UpdateProfile replaces the public profile of the user. Handles are unique
+// regardless of case.
+func (db *DB) UpdateProfile(userId int, profile Profile) (User, error) {
+	db, span := db.startOperation("UpdateProfile")
+	defer span.End()
+	if validateErr := profile.Validate(); validateErr != nil {
+		return User{}, validateErr
+	}
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if owner, taken := findUserByHandle(loadedDb, profile.Handle); taken && owner.Id != userId {
+			return ErrHandleTaken
+		}
+		user.Handle = profile.Handle
+		user.DisplayName = profile.DisplayName
+		user.Bio = profile.Bio
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return User{}, updateErr
+	}
+	return user, nil
+}
+
+// SetAvatar records the stored avatar file of the user and returns the one
+// it replaced so the caller can remove it.
+func (db *DB) SetAvatar(userId int, avatarFile string) (string, error) {
+	db, span := db.startOperation("SetAvatar")
+	defer span.End()
+	previous := ""
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		user, exists := loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		previous = user.AvatarFile
+		user.AvatarFile = avatarFile
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return "", updateErr
+	}
+	return previous, nil
+}
+
+// GetPublicUser looks up a user whose profile may be shown. Accounts that
+// are scheduled for deletion are treated as gone.
+func (db *DB) GetPublicUser(userId int) (User, error) {
+	db, span := db.startOperation("GetPublicUser")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return User{}, loadErr
+	}
+	user, exists := loadedDb.Users[userId]
+	if !exists || !user.DeletionScheduledAt.IsZero() {
+		return User{}, errors.New("User does not exist")
+	}
+	return user, nil
+}
+
+func (db *DB) GetPublicUserByHandle(handle string) (User, error) {
+	db, span := db.startOperation("GetPublicUserByHandle")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return User{}, loadErr
+	}
+	user, exists := findUserByHandle(loadedDb, handle)
+	if !exists || !user.DeletionScheduledAt.IsZero() {
+		return User{}, errors.New("User does not exist")
+	}
+	return user, nil
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+const (
+	RelationshipBlock         = "block"
+	RelationshipMute          = "mute"
+	RelationshipFollow        = "follow"
+	RelationshipFollowRequest = "follow_request"
+)
+
+var ErrBlocked = errors.New("You can't interact with this user")
+
+// Relationship is a one-way link from UserId to TargetId.
+type Relationship struct {
+	Id        int       `json:"id"`
+	UserId    int       `json:"user_id"`
+	TargetId  int       `json:"target_id"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func findRelationship(loadedDb DBStructure, userId, targetId int, kind string) (Relationship, bool) {
+	for _, relationship := range loadedDb.Relationships {
+		if relationship.UserId == userId && relationship.TargetId == targetId && relationship.Kind == kind {
+			return relationship, true
+		}
+	}
+	return Relationship{}, false
+}
+
+// isBlockedBetween reports whether either user has blocked the other.
+func isBlockedBetween(loadedDb DBStructure, userId, otherId int) bool {
+	_, blocked := findRelationship(loadedDb, userId, otherId, RelationshipBlock)
+	if blocked {
+		return true
+	}
+	_, blockedBy := findRelationship(loadedDb, otherId, userId, RelationshipBlock)
+	return blockedBy
+}
+
+func isFollowing(loadedDb DBStructure, followerId, userId int) bool {
+	if followerId == 0 {
+		return false
+	}
+	_, following := findRelationship(loadedDb, followerId, userId, RelationshipFollow)
+	return following
+}
+
+func removeRelationship(loadedDb DBStructure, userId, targetId int, kind string) bool {
+	relationship, exists := findRelationship(loadedDb, userId, targetId, kind)
+	if exists {
+		delete(loadedDb.Relationships, relationship.Id)
+	}
+	return exists
+}
+
+func addRelationship(loadedDb DBStructure, userId, targetId int, kind string) Relationship {
+	if existing, exists := findRelationship(loadedDb, userId, targetId, kind); exists {
+		return existing
+	}
+	relationship := Relationship{
+		Id:        nextId(loadedDb, "relationships", loadedDb.Relationships),
+		UserId:    userId,
+		TargetId:  targetId,
+		Kind:      kind,
+		CreatedAt: time.Now().UTC(),
+	}
+	loadedDb.Relationships[relationship.Id] = relationship
+	return relationship
+}
+
+// targetsOf returns the users viewerId has a relationship of one of kinds
+// with. It is used to filter those users' chirps out of the viewer's views.
+func targetsOf(loadedDb DBStructure, viewerId int, kinds ...string) map[int]bool {
+	targets := make(map[int]bool)
+	if viewerId == 0 {
+		return targets
+	}
+	for _, relationship := range loadedDb.Relationships {
+		if relationship.UserId == viewerId && slices.Contains(kinds, relationship.Kind) {
+			targets[relationship.TargetId] = true
+		}
+	}
+	return targets
+}
+
+// CheckInteraction returns ErrBlocked when either user has blocked the
+// other. Anything that lets actorId reach targetId directly must call it.
+func (db *DB) CheckInteraction(actorId, targetId int) error {
+	db, span := db.startOperation("CheckInteraction")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return loadErr
+	}
+	if isBlockedBetween(loadedDb, actorId, targetId) {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// AddRelationship blocks or mutes targetId on behalf of userId. Adding a
+// relationship that already exists returns the existing one. Blocking also
+// ends any follow or pending follow request between the two users.
+func (db *DB) AddRelationship(userId, targetId int, kind string) (Relationship, error) {
+	db, span := db.startOperation("AddRelationship")
+	defer span.End()
+	if userId == targetId {
+		return Relationship{}, errors.New("You can't " + kind + " yourself")
+	}
+	relationship := Relationship{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		if _, exists := loadedDb.Users[targetId]; !exists {
+			return errors.New("User does not exist")
+		}
+		relationship = addRelationship(loadedDb, userId, targetId, kind)
+		if kind == RelationshipBlock {
+			for _, followKind := range []string{RelationshipFollow, RelationshipFollowRequest} {
+				removeRelationship(loadedDb, userId, targetId, followKind)
+				removeRelationship(loadedDb, targetId, userId, followKind)
+			}
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return Relationship{}, updateErr
+	}
+	return relationship, nil
+}
+
+func (db *DB) RemoveRelationship(userId, targetId int, kind string) error {
+	db, span := db.startOperation("RemoveRelationship")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		if !removeRelationship(loadedDb, userId, targetId, kind) {
+			return errors.New("Relationship does not exist")
+		}
+		return nil
+	})
+}
+
+func (db *DB) GetRelationships(userId int, kind string) ([]Relationship, error) {
+	db, span := db.startOperation("GetRelationships")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []Relationship{}, loadErr
+	}
+	relationships := []Relationship{}
+	for _, relationship := range loadedDb.Relationships {
+		if relationship.UserId == userId && relationship.Kind == kind {
+			relationships = append(relationships, relationship)
+		}
+	}
+	slices.SortFunc(relationships, func(a, b Relationship) int {
+		return a.Id - b.Id
+	})
+	return relationships, nil
+}
+
+// GetIncomingRelationships lists the relationships of kind other users hold
+// towards targetId, such as followers or pending follow requests.
+func (db *DB) GetIncomingRelationships(targetId int, kind string) ([]Relationship, error) {
+	db, span := db.startOperation("GetIncomingRelationships")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []Relationship{}, loadErr
+	}
+	relationships := []Relationship{}
+	for _, relationship := range loadedDb.Relationships {
+		if relationship.TargetId == targetId && relationship.Kind == kind {
+			relationships = append(relationships, relationship)
+		}
+	}
+	slices.SortFunc(relationships, func(a, b Relationship) int {
+		return a.Id - b.Id
+	})
+	return relationships, nil
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"errors"
+	"slices"
+)
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// roleRank orders roles so that each one includes the permissions of the
+// roles below it.
+var roleRank = map[string]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+func IsValidRole(role string) bool {
+	_, exists := roleRank[role]
+	return exists
+}
+
+// EffectiveRole treats users stored before roles existed as regular users.
+func (user User) EffectiveRole() string {
+	if user.Role == "" {
+		return RoleUser
+	}
+	return user.Role
+}
+
+func (user User) HasRole(role string) bool {
+	return roleRank[user.EffectiveRole()] >= roleRank[role]
+}
+
+// SetUserRole changes a user's role. The last admin can't be demoted so the
+// admin API always stays reachable.
+func (db *DB) SetUserRole(userId int, role string) (User, error) {
+	db, span := db.startOperation("SetUserRole")
+	defer span.End()
+	if !IsValidRole(role) {
+		return User{}, errors.New("Unknown role")
+	}
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if user.EffectiveRole() == RoleAdmin && role != RoleAdmin {
+			admins := 0
+			for _, other := range loadedDb.Users {
+				if other.EffectiveRole() == RoleAdmin {
+					admins++
+				}
+			}
+			if admins <= 1 {
+				return errors.New("Can't remove the last admin")
+			}
+		}
+		user.Role = role
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return User{}, updateErr
+	}
+	return user, nil
+}
+
+// BootstrapAdmins promotes the accounts with the given emails to admin once
+// their email has been verified. Each email is only ever bootstrapped once,
+// so an admin who is later demoted stays demoted across restarts.
+func (db *DB) BootstrapAdmins(emails []string) error {
+	db, span := db.startOperation("BootstrapAdmins")
+	defer span.End()
+	if len(emails) == 0 {
+		return nil
+	}
+	return db.update(func(loadedDb DBStructure) error {
+		changed := false
+		for id, user := range loadedDb.Users {
+			if !user.EmailVerified || loadedDb.BootstrappedAdmins[user.Email] || !slices.Contains(emails, user.Email) {
+				continue
+			}
+			loadedDb.BootstrappedAdmins[user.Email] = true
+			if user.EffectiveRole() != RoleAdmin {
+				user.Role = RoleAdmin
+				loadedDb.Users[id] = user
+			}
+			changed = true
+		}
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
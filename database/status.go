@@ -0,0 +1,126 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusBanned    = "banned"
+)
+
+var (
+	ErrAccountSuspended = errors.New("Account suspended")
+	ErrAccountBanned    = errors.New("Account banned")
+)
+
+func IsValidStatus(status string) bool {
+	return status == StatusActive || status == StatusSuspended || status == StatusBanned
+}
+
+// IsAccountInactive reports whether err came from a suspended or banned
+// account rather than from bad credentials.
+func IsAccountInactive(err error) bool {
+	return errors.Is(err, ErrAccountSuspended) || errors.Is(err, ErrAccountBanned)
+}
+
+// EffectiveStatus treats an expired suspension or ban, and users stored
+// before statuses existed, as active.
+func (user User) EffectiveStatus(now time.Time) string {
+	if user.Status == "" || user.Status == StatusActive {
+		return StatusActive
+	}
+	if !user.StatusExpiresAt.IsZero() && !user.StatusExpiresAt.After(now) {
+		return StatusActive
+	}
+	return user.Status
+}
+
+// CheckActive returns ErrAccountSuspended or ErrAccountBanned, with the
+// reason and expiry attached, when the user may not use their account.
+func (user User) CheckActive(now time.Time) error {
+	status := user.EffectiveStatus(now)
+	if status == StatusActive {
+		return nil
+	}
+	statusErr := ErrAccountSuspended
+	if status == StatusBanned {
+		statusErr = ErrAccountBanned
+	}
+	detail := ""
+	if !user.StatusExpiresAt.IsZero() {
+		detail += " until " + user.StatusExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if user.StatusReason != "" {
+		detail += ": " + user.StatusReason
+	}
+	return fmt.Errorf("%w%s", statusErr, detail)
+}
+
+// applyUserStatus changes the status on the loaded user and, unless the user
+// is being reinstated, revokes every refresh token they hold so no new
+// access tokens can be minted.
+func applyUserStatus(loadedDb DBStructure, user User, status, reason string, expiresAt time.Time) User {
+	user.Status = status
+	user.StatusReason = reason
+	user.StatusExpiresAt = expiresAt
+	if status == StatusActive {
+		user.StatusReason = ""
+		user.StatusExpiresAt = time.Time{}
+	}
+	loadedDb.Users[user.Id] = user
+	if status != StatusActive {
+		delete(loadedDb.RefreshTokens, user.Id)
+		for tokenHash, grant := range loadedDb.OauthRefreshTokens {
+			if grant.UserId == user.Id {
+				delete(loadedDb.OauthRefreshTokens, tokenHash)
+			}
+		}
+	}
+	return user
+}
+
+// SetUserStatus suspends, bans or reinstates a user and records it in the
+// moderation audit trail. A zero expiresAt means the status never expires.
+func (db *DB) SetUserStatus(userId, adminId int, status, reason string, expiresAt time.Time) (User, error) {
+	db, span := db.startOperation("SetUserStatus")
+	defer span.End()
+	if !IsValidStatus(status) {
+		return User{}, errors.New("Unknown status")
+	}
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		user = applyUserStatus(loadedDb, user, status, reason, expiresAt)
+		action := ModerationAction{
+			Id:           nextId(loadedDb, "moderation_actions", loadedDb.ModerationActions),
+			ModeratorId:  adminId,
+			Action:       statusModerationActions[status],
+			TargetUserId: userId,
+			Reason:       reason,
+			CreatedAt:    time.Now().UTC(),
+		}
+		if !expiresAt.IsZero() && status != StatusActive {
+			action.ExpiresAt = &expiresAt
+		}
+		loadedDb.ModerationActions[action.Id] = action
+		return nil
+	})
+	if updateErr != nil {
+		return User{}, updateErr
+	}
+	return user, nil
+}
+
+var statusModerationActions = map[string]string{
+	StatusActive:    ModerationReinstate,
+	StatusSuspended: ModerationSuspend,
+	StatusBanned:    ModerationBan,
+}
@@ -0,0 +1,176 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultBillingPeriod = time.Hour * 24 * 30
+
+const (
+	SubscriptionActive   = "active"
+	SubscriptionPastDue  = "past_due"
+	SubscriptionCanceled = "canceled"
+	SubscriptionRefunded = "refunded"
+	SubscriptionExpired  = "expired"
+)
+
+// Events sent by Polka, the payment provider.
+const (
+	PolkaEventUpgraded      = "user.upgraded"
+	PolkaEventRenewed       = "user.renewed"
+	PolkaEventPaymentFailed = "user.payment_failed"
+	PolkaEventDowngraded    = "user.downgraded"
+	PolkaEventRefunded      = "user.refunded"
+)
+
+var ErrUnknownPolkaEvent = errors.New("Unknown Polka event")
+
+// Subscription is the Chirpy Red subscription of a user as last reported
+// by Polka. Users upgraded before subscriptions were tracked have a zero
+// PeriodEnd and keep Chirpy Red until Polka says otherwise.
+type Subscription struct {
+	Status    string    `json:"status"`
+	PeriodEnd time.Time `json:"period_end"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PolkaEvent records a processed webhook so redeliveries are ignored.
+type PolkaEvent struct {
+	Id          string    `json:"id"`
+	Event       string    `json:"event"`
+	UserId      int       `json:"user_id"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// PolkaEventData is the data Polka sends with an event. Only UserId is
+// required; the invoice fields are recorded in the ledger when present.
+type PolkaEventData struct {
+	UserId      int       `json:"user_id"`
+	PeriodEnd   time.Time `json:"period_end"`
+	InvoiceId   string    `json:"invoice_id"`
+	AmountCents int64     `json:"amount_cents"`
+	Currency    string    `json:"currency"`
+}
+
+// HasChirpyRed reports whether the user is entitled to Chirpy Red at now.
+// A lapsed period counts as expired even before ExpireSubscriptions runs.
+func (user User) HasChirpyRed(now time.Time) bool {
+	if !user.IsChirpyRed {
+		return false
+	}
+	return user.Subscription.PeriodEnd.IsZero() || user.Subscription.PeriodEnd.After(now)
+}
+
+// ApplyPolkaEvent updates the user's subscription for a Polka event and
+// records it in the ledger. Events are processed at most once per eventId;
+// a repeat returns the user with duplicate set. data.PeriodEnd is optional
+// and defaults to one billing period.
+func (db *DB) ApplyPolkaEvent(eventId, event string, data PolkaEventData, now time.Time) (User, bool, error) {
+	db, span := db.startOperation("ApplyPolkaEvent")
+	defer span.End()
+	userId, periodEnd := data.UserId, data.PeriodEnd
+	if eventId == "" {
+		return User{}, false, errors.New("Polka event id is required")
+	}
+	user, duplicate := User{}, false
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		if _, seen := loadedDb.PolkaEvents[eventId]; seen {
+			user, duplicate = loadedDb.Users[userId], true
+			return nil
+		}
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		subscription := user.Subscription
+		switch event {
+		case PolkaEventUpgraded:
+			if periodEnd.IsZero() {
+				periodEnd = now.Add(defaultBillingPeriod)
+			}
+			user.IsChirpyRed = true
+			subscription.Status = SubscriptionActive
+			subscription.PeriodEnd = periodEnd
+		case PolkaEventRenewed:
+			if periodEnd.IsZero() {
+				periodEnd = now
+				if subscription.PeriodEnd.After(now) {
+					periodEnd = subscription.PeriodEnd
+				}
+				periodEnd = periodEnd.Add(defaultBillingPeriod)
+			}
+			user.IsChirpyRed = true
+			subscription.Status = SubscriptionActive
+			subscription.PeriodEnd = periodEnd
+		case PolkaEventPaymentFailed:
+			// Access continues until the paid period ends, unless a renewal
+			// arrives first.
+			subscription.Status = SubscriptionPastDue
+		case PolkaEventDowngraded:
+			user.IsChirpyRed = false
+			subscription.Status = SubscriptionCanceled
+			subscription.PeriodEnd = now
+		case PolkaEventRefunded:
+			user.IsChirpyRed = false
+			subscription.Status = SubscriptionRefunded
+			subscription.PeriodEnd = now
+		default:
+			return ErrUnknownPolkaEvent
+		}
+		subscription.PeriodEnd = subscription.PeriodEnd.UTC()
+		subscription.UpdatedAt = now.UTC()
+		user.Subscription = subscription
+		loadedDb.Users[userId] = user
+		addLedgerEntry(loadedDb, LedgerEntry{
+			UserId:       userId,
+			Type:         polkaLedgerTypes[event],
+			PolkaEventId: eventId,
+			InvoiceId:    data.InvoiceId,
+			AmountCents:  data.AmountCents,
+			Currency:     data.Currency,
+			PeriodEnd:    subscription.PeriodEnd,
+			CreatedAt:    now,
+		})
+		loadedDb.PolkaEvents[eventId] = PolkaEvent{Id: eventId, Event: event, UserId: userId, ProcessedAt: now.UTC()}
+		return nil
+	})
+	if updateErr != nil {
+		return User{}, false, updateErr
+	}
+	return user, duplicate, nil
+}
+
+// ExpireSubscriptions downgrades every user whose paid period ended before
+// now. It returns the ids of the users it downgraded.
+func (db *DB) ExpireSubscriptions(now time.Time) ([]int, error) {
+	db, span := db.startOperation("ExpireSubscriptions")
+	defer span.End()
+	expired := []int{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for _, user := range loadedDb.Users {
+			if user.IsChirpyRed && !user.HasChirpyRed(now) {
+				user.IsChirpyRed = false
+				user.Subscription.Status = SubscriptionExpired
+				user.Subscription.UpdatedAt = now.UTC()
+				loadedDb.Users[user.Id] = user
+				addLedgerEntry(loadedDb, LedgerEntry{
+					UserId:    user.Id,
+					Type:      LedgerExpired,
+					PeriodEnd: user.Subscription.PeriodEnd,
+					CreatedAt: now,
+				})
+				expired = append(expired, user.Id)
+			}
+		}
+		if len(expired) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if updateErr != nil {
+		return []int{}, updateErr
+	}
+	return expired, nil
+}
@@ -0,0 +1,333 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	totpIssuer         = "Chirpy"
+	totpPeriod         = 30
+	totpDigits         = 6
+	totpSkewSteps      = 1
+	recoveryCodeCount  = 10
+	loginChallengeTTL  = time.Minute * 5
+	loginChallengeAud  = "chirpy-login-challenge"
+	recoveryCodeLength = 10
+)
+
+// ErrTotpRequired is returned by VerifyUser when the password is correct but
+// the user still has to complete the second step with CompleteTotpLogin.
+var ErrTotpRequired = errors.New("Two-factor code required")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the RFC 6238 code for the given time step using the
+// default HMAC-SHA1 algorithm.
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// validateTotp returns the time step the code matched so it can't be used a
+// second time. Steps at or before lastStep are rejected.
+func validateTotp(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, decodeErr := totpEncoding.DecodeString(secret)
+	if decodeErr != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkewSteps; step <= current+totpSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpProvisioningUri(secret, email string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + email)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ToLower(code)
+}
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, randErr := generateRandomHex(recoveryCodeLength / 2)
+		if randErr != nil {
+			return nil, nil, randErr
+		}
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code, updating the user so neither can be replayed.
+func checkSecondFactor(user *User, code string) bool {
+	step, valid := validateTotp(user.TotpSecret, code, time.Now(), user.TotpLastStep)
+	if valid {
+		user.TotpLastStep = step
+		return true
+	}
+	codeHash := hashToken(normalizeRecoveryCode(code))
+	for i, recoveryHash := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(recoveryHash), []byte(codeHash)) == 1 {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i], user.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// BeginTotpEnrollment generates a new secret for the user. It only takes
+// effect once confirmed with a valid code.
+func (db *DB) BeginTotpEnrollment(userId int) (string, string, error) {
+	db, span := db.startOperation("BeginTotpEnrollment")
+	defer span.End()
+	key := make([]byte, 20)
+	_, readErr := rand.Read(key)
+	if readErr != nil {
+		return "", "", readErr
+	}
+	secret := totpEncoding.EncodeToString(key)
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if user.TotpEnabled {
+			return errors.New("Two-factor authentication already enabled")
+		}
+		user.TotpPendingSecret = secret
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return "", "", updateErr
+	}
+	return secret, totpProvisioningUri(secret, user.Email), nil
+}
+
+// ConfirmTotpEnrollment enables two-factor authentication and returns the
+// plaintext recovery codes. Only their hashes are stored.
+func (db *DB) ConfirmTotpEnrollment(userId int, code string) ([]string, error) {
+	db, span := db.startOperation("ConfirmTotpEnrollment")
+	defer span.End()
+	codes, hashes, codesErr := generateRecoveryCodes()
+	if codesErr != nil {
+		return nil, codesErr
+	}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		user, exists := loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if user.TotpPendingSecret == "" {
+			return errors.New("No two-factor enrollment in progress")
+		}
+		step, valid := validateTotp(user.TotpPendingSecret, code, time.Now(), 0)
+		if !valid {
+			return errors.New("Invalid two-factor code")
+		}
+		user.TotpEnabled = true
+		user.TotpSecret = user.TotpPendingSecret
+		user.TotpPendingSecret = ""
+		user.TotpLastStep = step
+		user.RecoveryCodes = hashes
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return nil, updateErr
+	}
+	return codes, nil
+}
+
+func (db *DB) DisableTotp(userId int, code string) error {
+	db, span := db.startOperation("DisableTotp")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		user, exists := loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if !user.TotpEnabled {
+			return errors.New("Two-factor authentication not enabled")
+		}
+		if !checkSecondFactor(&user, code) {
+			return errors.New("Invalid two-factor code")
+		}
+		user.TotpEnabled = false
+		user.TotpSecret = ""
+		user.TotpLastStep = 0
+		user.RecoveryCodes = nil
+		loadedDb.Users[userId] = user
+		return nil
+	})
+}
+
+// VerifySecondFactor checks a code for a user who has already entered their
+// password outside of the regular login flow.
+func (db *DB) VerifySecondFactor(userId int, code string) error {
+	db, span := db.startOperation("VerifySecondFactor")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		user, exists := loadedDb.Users[userId]
+		if !exists || !user.TotpEnabled {
+			return errors.New("Two-factor authentication not enabled")
+		}
+		if !checkSecondFactor(&user, code) {
+			return errors.New("Invalid two-factor code")
+		}
+		loadedDb.Users[userId] = user
+		return nil
+	})
+}
+
+func loginChallengeKey(jwtSecret string) []byte {
+	return []byte(loginChallengeAud + ":" + jwtSecret)
+}
+
+// CreateLoginChallenge issues the short-lived token a client exchanges,
+// together with a two-factor code, for a session in CompleteTotpLogin. Only
+// the user's latest challenge is valid, and only until it is used.
+func (db *DB) CreateLoginChallenge(userId int, jwtSecret string) (string, error) {
+	db, span := db.startOperation("CreateLoginChallenge")
+	defer span.End()
+	challengeId, randErr := generateRandomHex(16)
+	if randErr != nil {
+		return "", randErr
+	}
+	jwtToken := jwt.NewWithClaims(
+		jwt.SigningMethodHS256,
+		jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			Audience:  jwt.ClaimStrings{loginChallengeAud},
+			ID:        challengeId,
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(loginChallengeTTL)),
+			Subject:   strconv.Itoa(userId),
+		},
+	)
+	signedToken, signingErr := db.signToken(jwtToken, loginChallengeKey(jwtSecret))
+	if signingErr != nil {
+		return "", signingErr
+	}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		user, exists := loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		user.LoginChallengeId = challengeId
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return "", updateErr
+	}
+	return signedToken, nil
+}
+
+// CompleteTotpLogin signs the user in and consumes the challenge when code
+// is a valid two-factor or recovery code.
+func (db *DB) CompleteTotpLogin(challenge, code, jwtSecret string, expiresInSeconds int) (UserReturn, error) {
+	db, span := db.startOperation("CompleteTotpLogin")
+	defer span.End()
+	userId, challengeId, parseErr := parseLoginChallenge(challenge, jwtSecret)
+	if parseErr != nil {
+		return UserReturn{}, parseErr
+	}
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists || !user.TotpEnabled || user.LoginChallengeId == "" || user.LoginChallengeId != challengeId {
+			return errors.New("Invalid login challenge")
+		}
+		if !checkSecondFactor(&user, code) {
+			return errors.New("Invalid two-factor code")
+		}
+		user.LoginChallengeId = ""
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return UserReturn{}, updateErr
+	}
+	return db.loginUser(user, jwtSecret, expiresInSeconds)
+}
+
+// GetLoginChallengeEmail returns the email of the account an unused login
+// challenge was issued for, so failed codes can be throttled per account.
+func (db *DB) GetLoginChallengeEmail(challenge, jwtSecret string) (string, error) {
+	db, span := db.startOperation("GetLoginChallengeEmail")
+	defer span.End()
+	userId, challengeId, parseErr := parseLoginChallenge(challenge, jwtSecret)
+	if parseErr != nil {
+		return "", parseErr
+	}
+	user, userErr := db.GetUserById(userId)
+	if userErr != nil || user.LoginChallengeId == "" || user.LoginChallengeId != challengeId {
+		return "", errors.New("Invalid login challenge")
+	}
+	return user.Email, nil
+}
+
+func parseLoginChallenge(challenge, jwtSecret string) (int, string, error) {
+	claims := jwt.RegisteredClaims{}
+	_, parseErr := jwt.ParseWithClaims(
+		challenge,
+		&claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return loginChallengeKey(jwtSecret), nil
+		},
+		jwt.WithAudience(loginChallengeAud),
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if parseErr != nil {
+		return 0, "", errors.New("Invalid login challenge")
+	}
+	userId, convErr := strconv.Atoi(claims.Subject)
+	if convErr != nil {
+		return 0, "", errors.New("Invalid login challenge")
+	}
+	return userId, claims.ID, nil
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"context"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var tracer = otel.Tracer("github.com/GavinDevelops/chirpy/database")
+
+// WithContext returns a handle on the same database whose operations are
+// traced as children of the span in ctx. Without one, as in background
+// jobs, operations aren't traced.
+func (db *DB) WithContext(ctx context.Context) *DB {
+	traced := *db
+	traced.ctx = ctx
+	return &traced
+}
+
+// startOperation starts the span of the exported operation name and
+// returns a handle on the database that traces its steps as children of
+// that span.
+func (db *DB) startOperation(name string) (*DB, trace.Span) {
+	if db.ctx == nil || !trace.SpanContextFromContext(db.ctx).IsValid() {
+		return db, noop.Span{}
+	}
+	ctx, span := tracer.Start(db.ctx, "db."+name, trace.WithAttributes(attribute.String("db.operation", name)))
+	return db.WithContext(ctx), span
+}
+
+// startSpan starts a span for one step of an operation, such as db.load.
+func (db *DB) startSpan(name string, attrs ...attribute.KeyValue) trace.Span {
+	if db.ctx == nil || !trace.SpanContextFromContext(db.ctx).IsValid() {
+		return noop.Span{}
+	}
+	_, span := tracer.Start(db.ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (db *DB) hashPassword(password string) ([]byte, error) {
+	span := db.startSpan("bcrypt.hash")
+	hashedPassword, hashErr := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	endSpan(span, hashErr)
+	return hashedPassword, hashErr
+}
+
+func (db *DB) comparePassword(hashedPassword []byte, password string) error {
+	span := db.startSpan("bcrypt.compare")
+	compareErr := bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+	// A wrong password is an expected outcome, not a failed span.
+	span.SetAttributes(attribute.Bool("password.match", compareErr == nil))
+	span.End()
+	return compareErr
+}
+
+func (db *DB) signToken(jwtToken *jwt.Token, key any) (string, error) {
+	span := db.startSpan("jwt.sign")
+	signedToken, signingErr := jwtToken.SignedString(key)
+	endSpan(span, signingErr)
+	return signedToken, signingErr
+}
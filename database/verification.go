@@ -0,0 +1,118 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const emailVerificationAudience = "chirpy-email-verification"
+
+type emailVerificationClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// Verification tokens are signed with a key derived from the JWT secret so
+// they can never be accepted as access tokens.
+func emailVerificationKey(jwtSecret string) []byte {
+	return []byte(emailVerificationAudience + ":" + jwtSecret)
+}
+
+// CreateEmailVerificationToken issues a signed token for the user's current
+// email address. Only the most recently issued token is accepted.
+func (db *DB) CreateEmailVerificationToken(userId int, jwtSecret string) (string, error) {
+	db, span := db.startOperation("CreateEmailVerificationToken")
+	defer span.End()
+	user, getErr := db.GetUserById(userId)
+	if getErr != nil {
+		return "", getErr
+	}
+	if user.EmailVerified {
+		return "", errors.New("Email already verified")
+	}
+	tokenId, randErr := generateRandomHex(16)
+	if randErr != nil {
+		return "", randErr
+	}
+	jwtToken := jwt.NewWithClaims(
+		jwt.SigningMethodHS256,
+		emailVerificationClaims{
+			Email: user.Email,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "chirpy",
+				Audience:  jwt.ClaimStrings{emailVerificationAudience},
+				ID:        tokenId,
+				IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
+				Subject:   strconv.Itoa(userId),
+			},
+		},
+	)
+	signedToken, signingErr := db.signToken(jwtToken, emailVerificationKey(jwtSecret))
+	if signingErr != nil {
+		return "", signingErr
+	}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		user, exists := loadedDb.Users[userId]
+		if !exists {
+			return errors.New("User does not exist")
+		}
+		if user.EmailVerified {
+			return errors.New("Email already verified")
+		}
+		user.VerificationTokenId = tokenId
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return "", updateErr
+	}
+	return signedToken, nil
+}
+
+// VerifyEmail marks the token's user as verified and consumes the token.
+func (db *DB) VerifyEmail(token, jwtSecret string) (UserReturn, error) {
+	db, span := db.startOperation("VerifyEmail")
+	defer span.End()
+	claims := emailVerificationClaims{}
+	_, parseErr := jwt.ParseWithClaims(
+		token,
+		&claims,
+		func(token *jwt.Token) (interface{}, error) {
+			return emailVerificationKey(jwtSecret), nil
+		},
+		jwt.WithAudience(emailVerificationAudience),
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if parseErr != nil {
+		return UserReturn{}, errors.New("Invalid verification token")
+	}
+	userId, convErr := strconv.Atoi(claims.Subject)
+	if convErr != nil {
+		return UserReturn{}, errors.New("Invalid verification token")
+	}
+	user := User{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		user, exists = loadedDb.Users[userId]
+		if !exists || user.VerificationTokenId == "" || user.VerificationTokenId != claims.ID || user.Email != claims.Email {
+			return errors.New("Invalid verification token")
+		}
+		user.EmailVerified = true
+		user.VerificationTokenId = ""
+		loadedDb.Users[userId] = user
+		return nil
+	})
+	if updateErr != nil {
+		return UserReturn{}, updateErr
+	}
+	return UserReturn{
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.HasChirpyRed(time.Now()),
+		EmailVerified: user.EmailVerified,
+	}, nil
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"regexp"
+	"slices"
+)
+
+const (
+	VisibilityPublic    = "public"
+	VisibilityFollowers = "followers"
+	VisibilityMentioned = "mentioned"
+)
+
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_])@([A-Za-z0-9_]{3,30})`)
+
+func IsValidVisibility(visibility string) bool {
+	return visibility == VisibilityPublic || visibility == VisibilityFollowers || visibility == VisibilityMentioned
+}
+
+// EffectiveVisibility treats chirps stored before visibility existed as
+// public.
+func (chirp Chirp) EffectiveVisibility() string {
+	if chirp.Visibility == "" {
+		return VisibilityPublic
+	}
+	return chirp.Visibility
+}
+
+// parseMentions resolves the @handles in body to user ids. Handles that
+// don't belong to anyone are ignored.
+func parseMentions(loadedDb DBStructure, body string) []int {
+	mentions := []int{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		user, exists := findUserByHandle(loadedDb, match[1])
+		if exists && !slices.Contains(mentions, user.Id) {
+			mentions = append(mentions, user.Id)
+		}
+	}
+	return mentions
+}
+
+// checkedMentions parses the mentions in body, returning ErrBlocked if the
+// author and any mentioned user have blocked each other.
+func checkedMentions(loadedDb DBStructure, authorId int, body string) ([]int, error) {
+	mentions := parseMentions(loadedDb, body)
+	for _, mentionedId := range mentions {
+		if isBlockedBetween(loadedDb, authorId, mentionedId) {
+			return []int{}, ErrBlocked
+		}
+	}
+	return mentions, nil
+}
+
+// canViewChirp is the single place chirp visibility is decided. Every
+// endpoint that returns chirps must filter through it. Moderators can see
+// everything so they can act on reports.
+func canViewChirp(loadedDb DBStructure, chirp Chirp, viewer User) bool {
+	author, exists := loadedDb.Users[chirp.AuthorId]
+	if !exists || !author.DeletionScheduledAt.IsZero() {
+		return false
+	}
+	if viewer.HasRole(RoleModerator) {
+		return true
+	}
+	if chirp.Hidden {
+		return false
+	}
+	if viewer.Id != 0 && viewer.Id == chirp.AuthorId {
+		return true
+	}
+	switch chirp.EffectiveVisibility() {
+	case VisibilityMentioned:
+		return slices.Contains(chirp.Mentions, viewer.Id)
+	case VisibilityFollowers:
+		return isFollowing(loadedDb, viewer.Id, chirp.AuthorId)
+	}
+	if author.Private {
+		return isFollowing(loadedDb, viewer.Id, chirp.AuthorId)
+	}
+	return true
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	WebhookPending   = "pending"
+	WebhookProcessed = "processed"
+	WebhookDead      = "dead"
+
+	// A failed webhook is retried after webhookRetryBase, doubling on each
+	// attempt up to webhookRetryMax, and dead-lettered after
+	// WebhookMaxAttempts.
+	WebhookMaxAttempts = 8
+	webhookRetryBase   = time.Second * 30
+	webhookRetryMax    = time.Hour
+)
+
+// InboundWebhook is a webhook delivery stored before it is processed, so a
+// failure while applying it doesn't lose the event.
+type InboundWebhook struct {
+	Id            int        `json:"id"`
+	Source        string     `json:"source"`
+	Payload       string     `json:"payload"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	ReceivedAt    time.Time  `json:"received_at"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	ProcessedAt   *time.Time `json:"processed_at,omitempty"`
+}
+
+func IsValidWebhookStatus(status string) bool {
+	switch status {
+	case WebhookPending, WebhookProcessed, WebhookDead:
+		return true
+	}
+	return false
+}
+
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookRetryMax)
+}
+
+// EnqueueWebhook stores a webhook for the worker to process. Once it
+// returns without error the webhook is on disk, so it is safe to
+// acknowledge the delivery.
+func (db *DB) EnqueueWebhook(source, payload string, now time.Time) (InboundWebhook, error) {
+	db, span := db.startOperation("EnqueueWebhook")
+	defer span.End()
+	webhook := InboundWebhook{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		webhook = InboundWebhook{
+			Id:            nextId(loadedDb, "inbound_webhooks", loadedDb.InboundWebhooks),
+			Source:        source,
+			Payload:       payload,
+			Status:        WebhookPending,
+			ReceivedAt:    now.UTC(),
+			NextAttemptAt: now.UTC(),
+		}
+		loadedDb.InboundWebhooks[webhook.Id] = webhook
+		return nil
+	})
+	if updateErr != nil {
+		return InboundWebhook{}, updateErr
+	}
+	return webhook, nil
+}
+
+// GetDueWebhooks returns pending webhooks whose next attempt is due, oldest
+// first so events are applied in the order they arrived.
+func (db *DB) GetDueWebhooks(now time.Time) ([]InboundWebhook, error) {
+	db, span := db.startOperation("GetDueWebhooks")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []InboundWebhook{}, loadErr
+	}
+	due := []InboundWebhook{}
+	for _, webhook := range loadedDb.InboundWebhooks {
+		if webhook.Status == WebhookPending && !webhook.NextAttemptAt.After(now) {
+			due = append(due, webhook)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Id < due[j].Id
+	})
+	return due, nil
+}
+
+// RecordWebhookAttempt stores the outcome of processing a webhook. A nil
+// processErr marks it processed; otherwise it is scheduled for a retry with
+// exponential backoff, or dead-lettered once it is out of attempts.
+func (db *DB) RecordWebhookAttempt(id int, processErr error, now time.Time) (InboundWebhook, error) {
+	db, span := db.startOperation("RecordWebhookAttempt")
+	defer span.End()
+	webhook := InboundWebhook{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		webhook, exists = loadedDb.InboundWebhooks[id]
+		if !exists {
+			return errors.New("Webhook does not exist")
+		}
+		webhook.Attempts++
+		if processErr == nil {
+			processedAt := now.UTC()
+			webhook.Status = WebhookProcessed
+			webhook.LastError = ""
+			webhook.ProcessedAt = &processedAt
+		} else {
+			webhook.LastError = processErr.Error()
+			if webhook.Attempts >= WebhookMaxAttempts {
+				webhook.Status = WebhookDead
+			} else {
+				webhook.NextAttemptAt = now.Add(webhookRetryDelay(webhook.Attempts)).UTC()
+			}
+		}
+		loadedDb.InboundWebhooks[id] = webhook
+		return nil
+	})
+	if updateErr != nil {
+		return InboundWebhook{}, updateErr
+	}
+	return webhook, nil
+}
+
+// GetWebhooks returns webhooks newest first, optionally filtered by status.
+func (db *DB) GetWebhooks(status string) ([]InboundWebhook, error) {
+	db, span := db.startOperation("GetWebhooks")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return []InboundWebhook{}, loadErr
+	}
+	webhooks := []InboundWebhook{}
+	for _, webhook := range loadedDb.InboundWebhooks {
+		if status == "" || webhook.Status == status {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool {
+		return webhooks[i].Id > webhooks[j].Id
+	})
+	return webhooks, nil
+}
+
+func (db *DB) GetWebhook(id int) (InboundWebhook, error) {
+	db, span := db.startOperation("GetWebhook")
+	defer span.End()
+	loadedDb, loadErr := db.loadDB()
+	if loadErr != nil {
+		return InboundWebhook{}, loadErr
+	}
+	webhook, exists := loadedDb.InboundWebhooks[id]
+	if !exists {
+		return InboundWebhook{}, errors.New("Webhook does not exist")
+	}
+	return webhook, nil
+}
+
+// ReplayWebhook queues a dead-lettered webhook again with a fresh set of
+// attempts.
+func (db *DB) ReplayWebhook(id int, now time.Time) (InboundWebhook, error) {
+	db, span := db.startOperation("ReplayWebhook")
+	defer span.End()
+	webhook := InboundWebhook{}
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		var exists bool
+		webhook, exists = loadedDb.InboundWebhooks[id]
+		if !exists {
+			return errors.New("Webhook does not exist")
+		}
+		if webhook.Status != WebhookDead {
+			return errors.New("Only dead-lettered webhooks can be replayed")
+		}
+		webhook.Status = WebhookPending
+		webhook.Attempts = 0
+		webhook.NextAttemptAt = now.UTC()
+		loadedDb.InboundWebhooks[id] = webhook
+		return nil
+	})
+	if updateErr != nil {
+		return InboundWebhook{}, updateErr
+	}
+	return webhook, nil
+}
+
+// PruneWebhooks removes processed webhooks older than before. Dead-lettered
+// ones are kept until an admin replays them.
+func (db *DB) PruneWebhooks(before time.Time) (int, error) {
+	db, span := db.startOperation("PruneWebhooks")
+	defer span.End()
+	pruned := 0
+	updateErr := db.update(func(loadedDb DBStructure) error {
+		for id, webhook := range loadedDb.InboundWebhooks {
+			if webhook.Status == WebhookProcessed && webhook.ProcessedAt.Before(before) {
+				delete(loadedDb.InboundWebhooks, id)
+				pruned++
+			}
+		}
+		if pruned == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	return pruned, updateErr
+}
@@ -0,0 +1,30 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrWebhookReplay = errors.New("Webhook delivery already seen")
+
+// RecordWebhookDelivery stores the signature of a verified webhook delivery
+// and returns ErrWebhookReplay if it was seen before. Signatures older than
+// forgetBefore are dropped, since their timestamps are rejected anyway. The
+// check and the insert happen under one lock, so two concurrent copies of a
+// delivery can't both get through.
+func (db *DB) RecordWebhookDelivery(signature string, signedAt, forgetBefore time.Time) error {
+	db, span := db.startOperation("RecordWebhookDelivery")
+	defer span.End()
+	return db.update(func(loadedDb DBStructure) error {
+		for seen, seenAt := range loadedDb.WebhookDeliveries {
+			if seenAt.Before(forgetBefore) {
+				delete(loadedDb.WebhookDeliveries, seen)
+			}
+		}
+		if _, seen := loadedDb.WebhookDeliveries[signature]; seen {
+			return ErrWebhookReplay
+		}
+		loadedDb.WebhookDeliveries[signature] = signedAt.UTC()
+		return nil
+	})
+}
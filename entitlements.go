@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+// entitlements are the limits and features of a subscription tier. Handlers
+// must check these rather than the subscription directly, so the tiers are only
+// defined here.
+type entitlements struct {
+	Tier            string
+	MaxChirpLen     int
+	CanEditChirps   bool
+	ChirpsPerHour   int
+	MessagesPerHour int
+	MaxAttachments  int
+}
+
+var (
+	freeEntitlements = entitlements{
+		Tier:            "free",
+		MaxChirpLen:     140,
+		CanEditChirps:   false,
+		ChirpsPerHour:   30,
+		MessagesPerHour: 120,
+		MaxAttachments:  1,
+	}
+	redEntitlements = entitlements{
+		Tier:            "chirpy_red",
+		MaxChirpLen:     1000,
+		CanEditChirps:   true,
+		ChirpsPerHour:   300,
+		MessagesPerHour: 1200,
+		MaxAttachments:  4,
+	}
+)
+
+const entitlementRateWindow = time.Hour
+
+func entitlementsFor(user database.User) entitlements {
+	if user.HasChirpyRed(time.Now()) {
+		return redEntitlements
+	}
+	return freeEntitlements
+}
+
+func (cft *apiConfig) getEntitlements(req *http.Request, id string) (entitlements, error) {
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		return entitlements{}, convErr
+	}
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		return entitlements{}, userErr
+	}
+	return entitlementsFor(user), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+func (cft *apiConfig) followUser(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		UserId int `json:"user_id"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	relationship, followErr := cft.dbFor(req).Follow(userId, params.UserId)
+	if errors.Is(followErr, database.ErrBlocked) {
+		respondWithError(w, http.StatusForbidden, followErr.Error())
+		return
+	}
+	if followErr != nil {
+		respondWithError(w, http.StatusBadRequest, followErr.Error())
+		return
+	}
+	if relationship.Kind == database.RelationshipFollowRequest {
+		respondWithJson(w, http.StatusAccepted, relationship)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, relationship)
+}
+
+func (cft *apiConfig) unfollowUser(w http.ResponseWriter, req *http.Request) {
+	cft.endFollow(w, req, func(userId, otherId int) error {
+		return cft.dbFor(req).Unfollow(userId, otherId)
+	})
+}
+
+// removeFollower rejects a follow request or removes an existing follower.
+func (cft *apiConfig) removeFollower(w http.ResponseWriter, req *http.Request) {
+	cft.endFollow(w, req, func(userId, otherId int) error {
+		return cft.dbFor(req).RemoveFollower(userId, otherId)
+	})
+}
+
+func (cft *apiConfig) endFollow(w http.ResponseWriter, req *http.Request, end func(userId, otherId int) error) {
+	otherId, parseErr := strconv.Atoi(req.PathValue("userid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	if endErr := end(userId, otherId); endErr != nil {
+		respondWithError(w, http.StatusNotFound, endErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cft *apiConfig) approveFollowRequest(w http.ResponseWriter, req *http.Request) {
+	requesterId, parseErr := strconv.Atoi(req.PathValue("userid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	relationship, approveErr := cft.dbFor(req).ApproveFollowRequest(userId, requesterId)
+	if approveErr != nil {
+		respondWithError(w, http.StatusNotFound, approveErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, relationship)
+}
+
+// getIncomingRelationships lists the followers or pending follow requests of
+// the caller, depending on kind.
+func (cft *apiConfig) getIncomingRelationships(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+		if authErr != nil {
+			respondWithError(w, http.StatusUnauthorized, authErr.Error())
+			return
+		}
+		userId, convErr := strconv.Atoi(id)
+		if convErr != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+			return
+		}
+		relationships, getErr := cft.dbFor(req).GetIncomingRelationships(userId, kind)
+		if getErr != nil {
+			respondWithError(w, http.StatusInternalServerError, getErr.Error())
+			return
+		}
+		respondWithJson(w, http.StatusOK, relationships)
+	}
+}
+
+func (cft *apiConfig) setPrivacy(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Private bool `json:"private"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	user, privateErr := cft.dbFor(req).SetPrivate(userId, params.Private)
+	if privateErr != nil {
+		respondWithError(w, http.StatusInternalServerError, privateErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, cft.publicProfile(user))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const requestIdHeader = "X-Request-ID"
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type requestInfoKeyType struct{}
+
+var requestInfoKey = requestInfoKeyType{}
+
+// requestInfo is shared between the request middleware and the handlers.
+// Handlers fill in userId once they have authenticated the caller, and the
+// tracing middleware fills in traceId.
+type requestInfo struct {
+	id      string
+	userId  string
+	traceId string
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+func requestIdFrom(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// newLoggerFromEnv builds the logger from LOG_LEVEL (debug, info, warn or
+// error; default info) and LOG_FORMAT (text or json; default text).
+func newLoggerFromEnv(w io.Writer) *slog.Logger {
+	level := slog.LevelInfo
+	if rawLevel := os.Getenv("LOG_LEVEL"); rawLevel != "" {
+		if levelErr := level.UnmarshalText([]byte(rawLevel)); levelErr != nil {
+			level = slog.LevelInfo
+		}
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(w, options)
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), "json") {
+		handler = slog.NewJSONHandler(w, options)
+	}
+	return slog.New(requestIdHandler{handler})
+}
+
+// requestIdHandler adds the request and trace ids to every record logged
+// with a request's context.
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (handler requestIdHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestId := requestIdFrom(ctx); requestId != "" {
+		record.AddAttrs(slog.String("request_id", requestId))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return handler.Handler.Handle(ctx, record)
+}
+
+func (handler requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{handler.Handler.WithAttrs(attrs)}
+}
+
+func (handler requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{handler.Handler.WithGroup(name)}
+}
+
+func newRequestId() string {
+	randBytes := make([]byte, 16)
+	rand.Read(randBytes)
+	return hex.EncodeToString(randBytes)
+}
+
+// middlewareRequestLogging gives every request an id, taken from the
+// X-Request-ID header when the caller sent a usable one, echoes it in the
+// response and writes an access log line once the request is served.
+func middlewareRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestId := req.Header.Get(requestIdHeader)
+		if !validRequestId.MatchString(requestId) {
+			requestId = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+		info := &requestInfo{id: requestId}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey, info))
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		next.ServeHTTP(recorder, req)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("user_id", info.userId),
+			slog.String("remote_ip", clientIp(req)),
+		}
+		if info.traceId != "" {
+			attrs = append(attrs, slog.String("trace_id", info.traceId))
+		}
+		slog.LogAttrs(req.Context(), level, "Request served", attrs...)
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type emailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type mailer interface {
+	Send(msg emailMessage) error
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(msg emailMessage) error {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "From: %s\r\n", m.from)
+	fmt.Fprintf(&builder, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&builder, "Subject: %s\r\n", msg.Subject)
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	builder.WriteString(msg.Body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(builder.String()))
+}
+
+// logMailer stands in for a real mail server during development. Messages
+// are appended to path, or written to the log when path is empty.
+type logMailer struct {
+	path string
+	mux  *sync.Mutex
+}
+
+func (m *logMailer) Send(msg emailMessage) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	entry := fmt.Sprintf("Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().UTC().Format(time.RFC1123Z), msg.To, msg.Subject, msg.Body)
+	if m.path == "" {
+		slog.Info("Mail not sent, no SMTP_HOST configured", "mail", entry)
+		return nil
+	}
+	file, openErr := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if openErr != nil {
+		return openErr
+	}
+	defer file.Close()
+	_, writeErr := file.WriteString(entry)
+	return writeErr
+}
+
+func newMailerFromEnv() mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return &logMailer{path: os.Getenv("MAIL_LOG_PATH"), mux: &sync.Mutex{}}
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@chirpy.local"
+	}
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return &smtpMailer{addr: host + ":" + port, from: from, auth: auth}
+}
@@ -1,49 +1,153 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/GavinDevelops/chirpy/database"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type apiConfig struct {
-	fileserverHits int
+	analytics      *analyticsRecorder
 	jwtSecret      string
 	polkaApikey    string
+	baseUrl        string
 	db             *database.DB
+	mailer         mailer
+	loginLimiter   *loginLimiter
+	chirpLimiter   *actionLimiter
+	messageLimiter *actionLimiter
+	resetLimiter   *actionLimiter
+	oidc           *oidcClient
+	adminEmails    []string
+	mediaDir       string
+	polkaVerifier  *webhookVerifier
+	webhookWake    chan struct{}
+	deliveryWake   chan struct{}
+	webhookClient  *http.Client
+	metrics        *chirpyMetrics
+	metricsToken   string
+	tracerProvider *sdktrace.TracerProvider
+	traceExporter  *memoryExporter
 }
 
-func (cft *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cft.fileserverHits++
-		next.ServeHTTP(w, r)
-	})
+// getUserIdFromRequest authenticates the bearer credential and notes the
+// user in the access log.
+func (cft *apiConfig) getUserIdFromRequest(req *http.Request, scope string) (string, error) {
+	id, authErr := cft.authenticateRequest(req, scope)
+	if info := requestInfoFrom(req.Context()); info != nil && authErr == nil {
+		info.userId = id
+	}
+	return id, authErr
 }
 
-func healthz(resp http.ResponseWriter, req *http.Request) {
-	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	resp.WriteHeader(http.StatusOK)
-	resp.Write([]byte(http.StatusText(http.StatusOK)))
+// authenticateRequest checks the bearer credential. Session JWTs may do
+// anything; personal API tokens and tokens issued to OAuth clients must
+// carry scope, and are refused outright when scope is scopeSessionOnly.
+func (cft *apiConfig) authenticateRequest(req *http.Request, scope string) (string, error) {
+	token := req.Header.Get("Authorization")
+	token = strings.TrimPrefix(token, "Bearer ")
+	if strings.HasPrefix(token, database.ApiTokenPrefix) {
+		return cft.getUserIdFromApiToken(req, token, scope)
+	}
+	claims := database.AccessTokenClaims{}
+	jwtToken, err := jwt.ParseWithClaims(
+		token,
+		&claims,
+		func(token *jwt.Token) (
+			interface{},
+			error,
+		) {
+			return []byte(cft.jwtSecret), nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+	if claims.ClientId != "" {
+		if scope == scopeSessionOnly {
+			return "", errors.New("OAuth access tokens can't be used for this endpoint")
+		}
+		if !claims.HasScope(scope) {
+			return "", errors.New("Access token is missing scope " + scope)
+		}
+	}
+	return jwtToken.Claims.GetSubject()
 }
 
-func (cft *apiConfig) getMetrics(resp http.ResponseWriter, req *http.Request) {
-	resp.Header().Set("Content-Type", "text/html")
-	resp.WriteHeader(http.StatusOK)
-	resp.Write([]byte(fmt.Sprintf("<html><body><h1>Welcome, Chirpy Admin</h1><p>Chirpy has been visited %d times!</p></body></html>", cft.fileserverHits)))
+// getViewer identifies who is reading. Anonymous requests get the zero
+// User, but a credential that is present and invalid is an error.
+func (cft *apiConfig) getViewer(req *http.Request) (database.User, error) {
+	if req.Header.Get("Authorization") == "" {
+		return database.User{}, nil
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeChirpsRead)
+	if authErr != nil {
+		return database.User{}, authErr
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		return database.User{}, convErr
+	}
+	return cft.dbFor(req).GetUserById(userId)
+}
+
+// requireActiveAccount checks that the user is not suspended, banned or
+// scheduled for deletion. Access tokens outlive all of these, so every write
+// endpoint calls this.
+func (cft *apiConfig) requireActiveAccount(req *http.Request, id string) error {
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		return convErr
+	}
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		return userErr
+	}
+	return checkCanWrite(user)
+}
+
+// checkCanWrite refuses writes from an account that is suspended, banned or
+// waiting to be deleted. Signing in again cancels a deletion.
+func checkCanWrite(user database.User) error {
+	if !user.DeletionScheduledAt.IsZero() {
+		return errors.New("Account is scheduled for deletion, sign in again to cancel it")
+	}
+	return user.CheckActive(time.Now())
+}
+
+// requireWritableAccount checks that the user may create content: their
+// email must be verified and requireActiveAccount must pass.
+func (cft *apiConfig) requireWritableAccount(req *http.Request, id string) error {
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		return convErr
+	}
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		return userErr
+	}
+	if !user.EmailVerified {
+		return errors.New("Email address not verified")
+	}
+	return checkCanWrite(user)
 }
 
-func (cft *apiConfig) resetMetrics(resp http.ResponseWriter, req *http.Request) {
-	cft.fileserverHits = 0
+func healthz(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	resp.WriteHeader(http.StatusOK)
-	resp.Write([]byte("Hits reset to 0"))
+	resp.Write([]byte(http.StatusText(http.StatusOK)))
 }
 
 func (cft *apiConfig) createUser(w http.ResponseWriter, req *http.Request) {
@@ -58,11 +162,16 @@ func (cft *apiConfig) createUser(w http.ResponseWriter, req *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
-	user, createErr := cft.db.CreateUser(params.Email, params.Password)
+	if emailErr := validateEmail(params.Email); emailErr != nil {
+		respondWithError(w, http.StatusBadRequest, emailErr.Error())
+		return
+	}
+	user, createErr := cft.dbFor(req).CreateUser(params.Email, params.Password)
 	if createErr != nil {
 		respondWithError(w, http.StatusInternalServerError, "Error creating user")
 		return
 	}
+	cft.sendVerificationEmail(user.Id, user.Email)
 	respondWithJson(w, http.StatusCreated, user)
 }
 
@@ -79,7 +188,20 @@ func (cft *apiConfig) getUser(w http.ResponseWriter, req *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
-	user, verifyErr := cft.db.VerifyUser(params.Email, params.Password, cft.jwtSecret, params.ExpiresInSeconds)
+	if wait, msg := cft.checkLoginThrottle(req, params.Email); wait > 0 {
+		respondWithRetryAfter(w, wait, msg)
+		return
+	}
+	user, verifyErr := cft.dbFor(req).VerifyUser(params.Email, params.Password, cft.jwtSecret, params.ExpiresInSeconds)
+	cft.recordLoginResult(req, params.Email, verifyErr)
+	if errors.Is(verifyErr, database.ErrTotpRequired) {
+		cft.respondWithLoginChallenge(w, req, user.Id)
+		return
+	}
+	if database.IsAccountInactive(verifyErr) {
+		respondWithError(w, http.StatusForbidden, verifyErr.Error())
+		return
+	}
 	if verifyErr != nil {
 		respondWithError(w, http.StatusUnauthorized, "Invalid password")
 		return
@@ -87,30 +209,22 @@ func (cft *apiConfig) getUser(w http.ResponseWriter, req *http.Request) {
 	respondWithJson(w, http.StatusOK, user)
 }
 
+// updateUser changes the caller's email or password. Only a session may do
+// this, and the current password must be given, as either change is enough
+// to take over the account.
 func (cft *apiConfig) updateUser(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email           string `json:"email"`
+		Password        string `json:"password"`
+		CurrentPassword string `json:"current_password"`
 	}
-	token := req.Header.Get("Authorization")
-	token = strings.TrimPrefix(token, "Bearer ")
-	jwtToken, err := jwt.ParseWithClaims(
-		token,
-		&jwt.RegisteredClaims{},
-		func(token *jwt.Token) (
-			interface{},
-			error,
-		) {
-			return []byte(cft.jwtSecret), nil
-		},
-	)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
 		return
 	}
-	id, idErr := jwtToken.Claims.GetSubject()
-	if idErr != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting id from subjet")
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
 		return
 	}
 	decoder := json.NewDecoder(req.Body)
@@ -120,11 +234,26 @@ func (cft *apiConfig) updateUser(w http.ResponseWriter, req *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
-	user, updateUserErr := cft.db.UpdateUser(id, params.Email, params.Password)
+	if emailErr := validateEmail(params.Email); emailErr != nil {
+		respondWithError(w, http.StatusBadRequest, emailErr.Error())
+		return
+	}
+	user, updateUserErr := cft.dbFor(req).UpdateUser(id, params.CurrentPassword, params.Email, params.Password)
+	if errors.Is(updateUserErr, database.ErrWrongPassword) {
+		respondWithError(w, http.StatusForbidden, updateUserErr.Error())
+		return
+	}
+	if errors.Is(updateUserErr, database.ErrEmailTaken) {
+		respondWithError(w, http.StatusConflict, updateUserErr.Error())
+		return
+	}
 	if updateUserErr != nil {
 		respondWithError(w, http.StatusInternalServerError, updateUserErr.Error())
 		return
 	}
+	if !user.EmailVerified {
+		cft.sendVerificationEmail(user.Id, user.Email)
+	}
 	respondWithJson(w, http.StatusOK, user)
 }
 
@@ -134,7 +263,12 @@ func (cft *apiConfig) getChirp(w http.ResponseWriter, req *http.Request) {
 		respondWithError(w, http.StatusBadRequest, "Error parsing path param")
 		return
 	}
-	chirp, err := cft.db.GetChirp(id)
+	viewer, viewerErr := cft.getViewer(req)
+	if viewerErr != nil {
+		respondWithError(w, http.StatusUnauthorized, viewerErr.Error())
+		return
+	}
+	chirp, err := cft.dbFor(req).GetChirp(id, viewer)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, err.Error())
 		return
@@ -146,7 +280,12 @@ func (cft *apiConfig) getChirp(w http.ResponseWriter, req *http.Request) {
 func (cft *apiConfig) getChirps(w http.ResponseWriter, req *http.Request) {
 	authorId := req.URL.Query().Get("author_id")
 	sort := req.URL.Query().Get("sort")
-	chirps, err := cft.db.GetChirps(authorId, sort)
+	viewer, viewerErr := cft.getViewer(req)
+	if viewerErr != nil {
+		respondWithError(w, http.StatusUnauthorized, viewerErr.Error())
+		return
+	}
+	chirps, err := cft.dbFor(req).GetChirps(authorId, sort, viewer)
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "Couldn't get chirps")
 		return
@@ -156,10 +295,9 @@ func (cft *apiConfig) getChirps(w http.ResponseWriter, req *http.Request) {
 
 func (cft *apiConfig) validateChirp(w http.ResponseWriter, req *http.Request) {
 	type parameters struct {
-		Body string `json:"body"`
-	}
-	type reqValid struct {
-		CleanedBody string `json:"cleaned_body"`
+		Body          string `json:"body"`
+		Visibility    string `json:"visibility"`
+		AttachmentIds []int  `json:"attachment_ids"`
 	}
 
 	decoder := json.NewDecoder(req.Body)
@@ -169,78 +307,146 @@ func (cft *apiConfig) validateChirp(w http.ResponseWriter, req *http.Request) {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
-	token := req.Header.Get("Authorization")
-	token = strings.TrimPrefix(token, "Bearer ")
-	jwtToken, err := jwt.ParseWithClaims(
-		token,
-		&jwt.RegisteredClaims{},
-		func(token *jwt.Token) (
-			interface{},
-			error,
-		) {
-			return []byte(cft.jwtSecret), nil
-		},
-	)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	id, authErr := cft.getUserIdFromRequest(req, scopeChirpsWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
 		return
 	}
-	id, idErr := jwtToken.Claims.GetSubject()
-	if idErr != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting id from subjet")
+	if writableErr := cft.requireWritableAccount(req, id); writableErr != nil {
+		respondWithError(w, http.StatusForbidden, writableErr.Error())
 		return
 	}
-	const maxChirpLen = 140
-	if len(params.Body) >= maxChirpLen {
+	limits, limitsErr := cft.getEntitlements(req, id)
+	if limitsErr != nil {
+		respondWithError(w, http.StatusInternalServerError, limitsErr.Error())
+		return
+	}
+	if len(params.Body) >= limits.MaxChirpLen {
 		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
 		return
 	}
-	chirp, createErr := cft.db.CreateChirp(params.Body, id)
+	if len(params.AttachmentIds) > limits.MaxAttachments {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Too many attachments, the limit is %d", limits.MaxAttachments))
+		return
+	}
+	if wait, allowed := cft.chirpLimiter.allow(id, limits.ChirpsPerHour, entitlementRateWindow); !allowed {
+		respondWithRetryAfter(w, wait, "Too many chirps")
+		return
+	}
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPublic
+	}
+	if !database.IsValidVisibility(params.Visibility) {
+		respondWithError(w, http.StatusBadRequest, "Visibility must be public, followers or mentioned")
+		return
+	}
+	chirp, createErr := cft.dbFor(req).CreateChirp(params.Body, id, params.Visibility, params.AttachmentIds)
+	if errors.Is(createErr, database.ErrBlocked) {
+		respondWithError(w, http.StatusForbidden, "Chirp mentions a user you can't interact with")
+		return
+	}
+	if errors.Is(createErr, database.ErrInvalidAttachment) {
+		respondWithError(w, http.StatusBadRequest, createErr.Error())
+		return
+	}
 	if createErr != nil {
 		respondWithError(w, http.StatusBadRequest, "Couldn't create chirp")
 		return
 	}
+	cft.metrics.chirpsCreated.inc()
+	cft.publishEvent(database.EventChirpCreated, chirp.AuthorId, chirp)
 	respondWithJson(w, http.StatusCreated, chirp)
 }
 
-func (cft *apiConfig) deleteChirp(w http.ResponseWriter, req *http.Request) {
-	token := req.Header.Get("Authorization")
-	token = strings.TrimPrefix(token, "Bearer ")
+// editChirp replaces the body of a chirp. Editing is a Chirpy Red feature.
+func (cft *apiConfig) editChirp(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
 	chirpId, parseErr := strconv.Atoi(req.PathValue("chirpid"))
 	if parseErr != nil {
 		respondWithError(w, http.StatusBadRequest, "Error parsing chirpId")
+		return
 	}
-	jwtToken, err := jwt.ParseWithClaims(
-		token,
-		&jwt.RegisteredClaims{},
-		func(token *jwt.Token) (
-			interface{},
-			error,
-		) {
-			return []byte(cft.jwtSecret), nil
-		},
-	)
+	id, authErr := cft.getUserIdFromRequest(req, scopeChirpsWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if writableErr := cft.requireWritableAccount(req, id); writableErr != nil {
+		respondWithError(w, http.StatusForbidden, writableErr.Error())
+		return
+	}
+	limits, limitsErr := cft.getEntitlements(req, id)
+	if limitsErr != nil {
+		respondWithError(w, http.StatusInternalServerError, limitsErr.Error())
+		return
+	}
+	if !limits.CanEditChirps {
+		respondWithError(w, http.StatusForbidden, "Editing chirps requires Chirpy Red")
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
 		return
 	}
-	userId, idErr := jwtToken.Claims.GetSubject()
-	if idErr != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting id from subjet")
+	if len(params.Body) >= limits.MaxChirpLen {
+		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
 		return
 	}
-	deleteErr := cft.db.DeleteChirp(chirpId, userId)
+	chirp, editErr := cft.dbFor(req).EditChirp(chirpId, userId, params.Body)
+	if errors.Is(editErr, database.ErrBlocked) {
+		respondWithError(w, http.StatusForbidden, "Chirp mentions a user you can't interact with")
+		return
+	}
+	if editErr != nil {
+		respondWithError(w, http.StatusForbidden, editErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, chirp)
+}
+
+func (cft *apiConfig) deleteChirp(w http.ResponseWriter, req *http.Request) {
+	chirpId, parseErr := strconv.Atoi(req.PathValue("chirpid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing chirpId")
+		return
+	}
+	userId, authErr := cft.getUserIdFromRequest(req, scopeChirpsWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, userId); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	deleteErr := cft.dbFor(req).DeleteChirp(chirpId, userId)
 	if deleteErr != nil {
 		respondWithError(w, http.StatusForbidden, deleteErr.Error())
 		return
 	}
+	authorId, _ := strconv.Atoi(userId)
+	cft.publishChirpDeleted(chirpId, authorId)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (cft *apiConfig) refreshToken(w http.ResponseWriter, req *http.Request) {
 	refreshToken := req.Header.Get("Authorization")
 	refreshToken = strings.TrimPrefix(refreshToken, "Bearer ")
-	token, newTokenErr := cft.db.GetNewTokenFromRefreshToken(refreshToken, cft.jwtSecret)
+	token, newTokenErr := cft.dbFor(req).GetNewTokenFromRefreshToken(refreshToken, cft.jwtSecret)
+	if database.IsAccountInactive(newTokenErr) {
+		respondWithError(w, http.StatusForbidden, newTokenErr.Error())
+		return
+	}
 	if newTokenErr != nil {
 		respondWithError(w, http.StatusUnauthorized, newTokenErr.Error())
 		return
@@ -254,7 +460,7 @@ func (cft *apiConfig) refreshToken(w http.ResponseWriter, req *http.Request) {
 func (cft *apiConfig) revokeToken(w http.ResponseWriter, req *http.Request) {
 	refreshToken := req.Header.Get("Authorization")
 	refreshToken = strings.TrimPrefix(refreshToken, "Bearer ")
-	removeErr := cft.db.RemoveRefreshToken(refreshToken)
+	removeErr := cft.dbFor(req).RemoveRefreshToken(refreshToken)
 	if removeErr != nil {
 		respondWithError(w, http.StatusInternalServerError, removeErr.Error())
 		return
@@ -262,38 +468,6 @@ func (cft *apiConfig) revokeToken(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (cft *apiConfig) polkaWebhook(w http.ResponseWriter, req *http.Request) {
-	type parameters struct {
-		Event string `json:"event"`
-		Data  struct {
-			UserID int `json:"user_id"`
-		} `json:"data"`
-	}
-	apiKey := req.Header.Get("Authorization")
-	apiKey = strings.TrimPrefix(apiKey, "ApiKey ")
-	if apiKey != cft.polkaApikey {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-	decoder := json.NewDecoder(req.Body)
-	params := parameters{}
-	err := decoder.Decode(&params)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
-		return
-	}
-	if params.Event != "user.upgraded" {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	upgradeErr := cft.db.UpgradeUser(params.Data.UserID)
-	if upgradeErr != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	w.WriteHeader(http.StatusNoContent)
-}
-
 func cleanMessage(msg string) string {
 	badWords := map[string]bool{"kerfuffle": true, "sharbert": true, "fornax": true}
 	replacement := "****"
@@ -312,7 +486,7 @@ func cleanMessage(msg string) string {
 
 func respondWithError(w http.ResponseWriter, code int, msg string) {
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s\n", msg)
+		slog.Error("Responding with 5XX error", "error", msg, "request_id", w.Header().Get(requestIdHeader))
 	}
 	type errorResponse struct {
 		Error string `json:"error"`
@@ -324,7 +498,7 @@ func respondWithJson(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("Error marshalling JSON", "error", err, "request_id", w.Header().Get(requestIdHeader))
 		w.WriteHeader(500)
 		return
 	}
@@ -334,39 +508,166 @@ func respondWithJson(w http.ResponseWriter, code int, payload interface{}) {
 
 func main() {
 	godotenv.Load()
+	slog.SetDefault(newLoggerFromEnv(os.Stderr))
 	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaApiKey := os.Getenv("POLKA_API_KEY")
 	const filepathRoot = "."
 	const port = "8080"
+	baseUrl := os.Getenv("BASE_URL")
+	if baseUrl == "" {
+		baseUrl = "http://localhost:" + port
+	}
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = "./media"
+	}
 
 	db, err := database.NewDB("./database.json")
 	if err != nil {
-		log.Fatalf("Error starting database: %s", err)
-	}
-	config := apiConfig{fileserverHits: 0, jwtSecret: jwtSecret, db: db, polkaApikey: polkaApiKey}
-
-	mux := http.NewServeMux()
-	fsHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
-	mux.Handle("/app/*", config.middlewareMetricsInc(fsHandler))
-	mux.HandleFunc("GET /admin/metrics", config.getMetrics)
-	mux.HandleFunc("GET /api/reset", config.resetMetrics)
-	mux.HandleFunc("GET /api/healthz", healthz)
-	mux.HandleFunc("POST /api/chirps", config.validateChirp)
-	mux.HandleFunc("GET /api/chirps", config.getChirps)
-	mux.HandleFunc("GET /api/chirps/{chirpid}", config.getChirp)
-	mux.HandleFunc("POST /api/users", config.createUser)
-	mux.HandleFunc("POST /api/login", config.getUser)
-	mux.HandleFunc("PUT /api/users", config.updateUser)
-	mux.HandleFunc("POST /api/refresh", config.refreshToken)
-	mux.HandleFunc("POST /api/revoke", config.revokeToken)
-	mux.HandleFunc("DELETE /api/chirps/{chirpid}", config.deleteChirp)
-	mux.HandleFunc("POST /api/polka/webhooks", config.polkaWebhook)
+		slog.Error("Error starting database", "error", err)
+		os.Exit(1)
+	}
+	tracerProvider, traceExporter, tracingErr := newTracerProviderFromEnv(context.Background())
+	if tracingErr != nil {
+		slog.Error("Error starting tracing", "error", tracingErr)
+		os.Exit(1)
+	}
+	oidcClient, oidcErr := newOidcClientFromEnv(context.Background(), baseUrl)
+	if oidcErr != nil {
+		slog.Info("OIDC login disabled", "reason", oidcErr)
+	}
+	config := apiConfig{
+		analytics:      newAnalyticsRecorder(time.Now),
+		jwtSecret:      jwtSecret,
+		db:             db,
+		polkaApikey:    polkaApiKey,
+		baseUrl:        baseUrl,
+		mailer:         newMailerFromEnv(),
+		loginLimiter:   newLoginLimiter(time.Now),
+		chirpLimiter:   newActionLimiter(time.Now),
+		messageLimiter: newActionLimiter(time.Now),
+		resetLimiter:   newActionLimiter(time.Now),
+		oidc:           oidcClient,
+		adminEmails:    adminEmailsFromEnv(),
+		mediaDir:       mediaDir,
+		polkaVerifier:  newPolkaVerifierFromEnv(),
+		webhookWake:    make(chan struct{}, 1),
+		deliveryWake:   make(chan struct{}, 1),
+		webhookClient:  newWebhookClient(webhookDeliveryTimeout),
+		metrics:        newChirpyMetrics(),
+		metricsToken:   os.Getenv("METRICS_TOKEN"),
+		tracerProvider: tracerProvider,
+		traceExporter:  traceExporter,
+	}
+	db.SetObserver(config.metrics.observeDB)
+	config.bootstrapAdmins()
+	go config.runMaintenance(maintenanceInterval)
+	go config.runWebhookWorker(webhookPollInterval)
+	go config.runDeliveryWorker(webhookPollInterval)
+	go config.runAnalyticsFlusher(analyticsFlushInterval)
+	go config.flushOnShutdown()
 
 	server := &http.Server{
-		Handler: mux,
+		Handler: config.routes(),
 		Addr:    ":" + port,
 	}
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
+	slog.Info("Serving", "root", filepathRoot, "port", port)
 	server.ListenAndServe()
 }
+
+// routes registers every endpoint and wraps them in the logging, tracing
+// and metrics middleware.
+func (cft *apiConfig) routes() http.Handler {
+	mux := http.NewServeMux()
+	fsHandler := http.StripPrefix("/app", http.FileServer(http.Dir(".")))
+	mux.Handle("/app/", cft.middlewareMetricsInc(fsHandler))
+	mux.HandleFunc("GET /metrics", cft.serveMetrics)
+	mux.HandleFunc("GET /admin/metrics", cft.middlewareRequireRole(database.RoleAdmin, cft.getMetrics))
+	mux.HandleFunc("GET /api/reset", cft.middlewareRequireRole(database.RoleAdmin, cft.resetMetrics))
+	mux.HandleFunc("PUT /api/admin/users/{userid}/role", cft.middlewareRequireRole(database.RoleAdmin, cft.setUserRole))
+	mux.HandleFunc("DELETE /api/admin/users/{userid}/role", cft.middlewareRequireRole(database.RoleAdmin, cft.revokeUserRole))
+	mux.HandleFunc("GET /api/admin/users/{userid}/status", cft.middlewareRequireRole(database.RoleAdmin, cft.getUserStatus))
+	mux.HandleFunc("PUT /api/admin/users/{userid}/status", cft.middlewareRequireRole(database.RoleAdmin, cft.setUserStatus))
+	mux.HandleFunc("GET /api/admin/analytics", cft.middlewareRequireRole(database.RoleAdmin, cft.getAnalytics))
+	mux.HandleFunc("GET /api/admin/traces", cft.middlewareRequireRole(database.RoleAdmin, cft.getTraces))
+	mux.HandleFunc("GET /api/admin/billing", cft.middlewareRequireRole(database.RoleAdmin, cft.getBillingReport))
+	mux.HandleFunc("GET /api/admin/webhooks", cft.middlewareRequireRole(database.RoleAdmin, cft.getWebhooks))
+	mux.HandleFunc("GET /api/admin/webhooks/{webhookid}", cft.middlewareRequireRole(database.RoleAdmin, cft.getWebhook))
+	mux.HandleFunc("POST /api/admin/webhooks/{webhookid}/replay", cft.middlewareRequireRole(database.RoleAdmin, cft.replayWebhook))
+	mux.HandleFunc("GET /api/healthz", healthz)
+	mux.HandleFunc("POST /api/chirps", cft.validateChirp)
+	mux.HandleFunc("GET /api/chirps", cft.getChirps)
+	mux.HandleFunc("GET /api/chirps/{chirpid}", cft.getChirp)
+	mux.HandleFunc("POST /api/users", cft.createUser)
+	mux.HandleFunc("POST /api/login", cft.getUser)
+	mux.HandleFunc("POST /api/login/totp", cft.completeTotpLogin)
+	if cft.oidc != nil {
+		mux.HandleFunc("GET /api/oidc/login", cft.oidcLogin)
+		mux.HandleFunc("GET /api/oidc/callback", cft.oidcCallback)
+	}
+	mux.HandleFunc("PUT /api/users", cft.updateUser)
+	mux.HandleFunc("DELETE /api/users", cft.deleteAccount)
+	mux.HandleFunc("GET /api/users/me/export", cft.exportAccount)
+	mux.HandleFunc("GET /api/users/me/subscription", cft.getSubscription)
+	mux.HandleFunc("GET /api/users/me/billing", cft.getBilling)
+	mux.HandleFunc("PUT /api/users/me/profile", cft.updateProfile)
+	mux.HandleFunc("PUT /api/users/me/avatar", cft.uploadAvatar)
+	mux.HandleFunc("PUT /api/users/me/privacy", cft.setPrivacy)
+	mux.HandleFunc("GET /api/users/{userid}", cft.getUserProfile)
+	mux.HandleFunc("GET /api/users/by-handle/{handle}", cft.getUserProfileByHandle)
+	mux.HandleFunc("GET /media/avatars/{file}", cft.serveAvatar)
+	mux.HandleFunc("POST /api/users/totp", cft.enrollTotp)
+	mux.HandleFunc("POST /api/users/totp/confirm", cft.confirmTotp)
+	mux.HandleFunc("DELETE /api/users/totp", cft.disableTotp)
+	mux.HandleFunc("GET /api/users/verify", cft.verifyEmail)
+	mux.HandleFunc("POST /api/users/verify", cft.verifyEmail)
+	mux.HandleFunc("POST /api/users/verify/resend", cft.resendVerificationEmail)
+	mux.HandleFunc("POST /api/password/forgot", cft.forgotPassword)
+	mux.HandleFunc("POST /api/password/reset", cft.resetPassword)
+	mux.HandleFunc("POST /api/refresh", cft.refreshToken)
+	mux.HandleFunc("POST /api/revoke", cft.revokeToken)
+	mux.HandleFunc("PUT /api/chirps/{chirpid}", cft.editChirp)
+	mux.HandleFunc("DELETE /api/chirps/{chirpid}", cft.deleteChirp)
+	mux.HandleFunc("POST /api/media", cft.uploadMedia)
+	mux.HandleFunc("GET /media/attachments/{file}", cft.serveAttachment)
+	mux.HandleFunc("POST /api/chirps/{chirpid}/report", cft.reportChirp)
+	mux.HandleFunc("GET /api/moderation/reports", cft.middlewareRequireRole(database.RoleModerator, cft.getModerationQueue))
+	mux.HandleFunc("POST /api/moderation/reports/{reportid}/actions", cft.middlewareRequireRole(database.RoleModerator, cft.moderateReport))
+	mux.HandleFunc("GET /api/moderation/actions", cft.middlewareRequireRole(database.RoleModerator, cft.getModerationActions))
+	mux.HandleFunc("POST /api/tokens", cft.createApiToken)
+	mux.HandleFunc("GET /api/tokens", cft.getApiTokens)
+	mux.HandleFunc("DELETE /api/tokens/{tokenid}", cft.revokeApiToken)
+	mux.HandleFunc("POST /api/blocks", cft.addRelationship(database.RelationshipBlock))
+	mux.HandleFunc("GET /api/blocks", cft.getRelationships(database.RelationshipBlock))
+	mux.HandleFunc("DELETE /api/blocks/{userid}", cft.removeRelationship(database.RelationshipBlock))
+	mux.HandleFunc("POST /api/mutes", cft.addRelationship(database.RelationshipMute))
+	mux.HandleFunc("GET /api/mutes", cft.getRelationships(database.RelationshipMute))
+	mux.HandleFunc("DELETE /api/mutes/{userid}", cft.removeRelationship(database.RelationshipMute))
+	mux.HandleFunc("POST /api/follows", cft.followUser)
+	mux.HandleFunc("GET /api/follows", cft.getRelationships(database.RelationshipFollow))
+	mux.HandleFunc("DELETE /api/follows/{userid}", cft.unfollowUser)
+	mux.HandleFunc("GET /api/followers", cft.getIncomingRelationships(database.RelationshipFollow))
+	mux.HandleFunc("DELETE /api/followers/{userid}", cft.removeFollower)
+	mux.HandleFunc("GET /api/follow-requests", cft.getIncomingRelationships(database.RelationshipFollowRequest))
+	mux.HandleFunc("POST /api/follow-requests/{userid}/approve", cft.approveFollowRequest)
+	mux.HandleFunc("DELETE /api/follow-requests/{userid}", cft.removeFollower)
+	mux.HandleFunc("POST /api/conversations", cft.createConversation)
+	mux.HandleFunc("GET /api/conversations", cft.getConversations)
+	mux.HandleFunc("GET /api/conversations/{conversationid}/messages", cft.getMessages)
+	mux.HandleFunc("POST /api/conversations/{conversationid}/messages", cft.sendMessage)
+	mux.HandleFunc("POST /api/conversations/{conversationid}/read", cft.markConversationRead)
+	mux.HandleFunc("POST /api/polka/webhooks", cft.polkaWebhook)
+	mux.HandleFunc("POST /api/webhooks", cft.createWebhookSubscription)
+	mux.HandleFunc("GET /api/webhooks", cft.getWebhookSubscriptions)
+	mux.HandleFunc("DELETE /api/webhooks/{subscriptionid}", cft.deleteWebhookSubscription)
+	mux.HandleFunc("GET /api/webhooks/{subscriptionid}/deliveries", cft.getWebhookDeliveries)
+	mux.HandleFunc("POST /api/webhooks/{subscriptionid}/ping", cft.pingWebhookSubscription)
+	mux.HandleFunc("POST /api/oauth/clients", cft.createOauthClient)
+	mux.HandleFunc("GET /oauth/authorize", cft.oauthAuthorize)
+	mux.HandleFunc("POST /oauth/authorize", cft.oauthConsent)
+	mux.HandleFunc("POST /oauth/token", cft.oauthToken)
+	mux.HandleFunc("POST /oauth/introspect", cft.oauthIntrospect)
+
+	return middlewareRequestLogging(cft.middlewareTracing(mux, cft.middlewareHttpMetrics(mux)))
+}
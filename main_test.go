@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const testJwtSecret = "test-secret"
+
+// testMailer keeps the messages sent during a test.
+type testMailer struct {
+	mux  sync.Mutex
+	sent []emailMessage
+}
+
+func (m *testMailer) Send(msg emailMessage) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// newTestConfig returns a server config backed by a fresh database in a
+// temporary directory. No background workers are started.
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+	db, dbErr := database.NewDB(filepath.Join(dir, "database.json"))
+	if dbErr != nil {
+		t.Fatal(dbErr)
+	}
+	return &apiConfig{
+		analytics:      newAnalyticsRecorder(time.Now),
+		jwtSecret:      testJwtSecret,
+		db:             db,
+		baseUrl:        "http://chirpy.test",
+		mailer:         &testMailer{},
+		loginLimiter:   newLoginLimiter(time.Now),
+		chirpLimiter:   newActionLimiter(time.Now),
+		messageLimiter: newActionLimiter(time.Now),
+		resetLimiter:   newActionLimiter(time.Now),
+		mediaDir:       dir,
+		webhookWake:    make(chan struct{}, 1),
+		deliveryWake:   make(chan struct{}, 1),
+		webhookClient:  newWebhookClient(webhookDeliveryTimeout),
+		metrics:        newChirpyMetrics(),
+	}
+}
+
+// createTestUser signs up a verified user with the password "pw" and
+// returns the user and a session token.
+func createTestUser(t *testing.T, cft *apiConfig, email string) (database.UserReturn, string) {
+	t.Helper()
+	created, createErr := cft.db.CreateUser(email, "pw")
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	verificationToken, tokenErr := cft.db.CreateEmailVerificationToken(created.Id, cft.jwtSecret)
+	if tokenErr != nil {
+		t.Fatal(tokenErr)
+	}
+	if _, verifyErr := cft.db.VerifyEmail(verificationToken, cft.jwtSecret); verifyErr != nil {
+		t.Fatal(verifyErr)
+	}
+	user, loginErr := cft.db.VerifyUser(email, "pw", cft.jwtSecret, 0)
+	if loginErr != nil {
+		t.Fatal(loginErr)
+	}
+	return user, *user.Token
+}
+
+// doJson serves req with handler and decodes the response into out when it
+// is not nil.
+func doJson(t *testing.T, handler http.Handler, req *http.Request, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if out != nil {
+		if decodeErr := json.NewDecoder(recorder.Body).Decode(out); decodeErr != nil {
+			t.Fatalf("decoding %s response: %v", req.URL.Path, decodeErr)
+		}
+	}
+	return recorder
+}
+
+func newJsonRequest(t *testing.T, method, path, token string, body any) *http.Request {
+	t.Helper()
+	data, marshalErr := json.Marshal(body)
+	if marshalErr != nil {
+		t.Fatal(marshalErr)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	avatarDir     = "avatars"
+	attachmentDir = "attachments"
+	maxMediaBytes = 5 << 20
+)
+
+// imageExtensions lists the image types accepted for upload, keyed by the
+// sniffed content type.
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var (
+	errUploadTooLarge  = errors.New("Upload is too large")
+	errUnsupportedType = errors.New("Upload must be a PNG, JPEG, GIF or WebP image")
+)
+
+func (cft *apiConfig) mediaPath(dir, file string) string {
+	return filepath.Join(cft.mediaDir, dir, file)
+}
+
+func (cft *apiConfig) removeMediaFile(dir, file string) {
+	if file == "" {
+		return
+	}
+	if removeErr := os.Remove(cft.mediaPath(dir, file)); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+		slog.Error("Error removing media file", "dir", dir, "file", file, "error", removeErr)
+	}
+}
+
+// storeImageUpload saves the raw image in the request body under dir and
+// returns the stored file name and the content type. The type is sniffed
+// from the content rather than trusted from the Content-Type header.
+func (cft *apiConfig) storeImageUpload(w http.ResponseWriter, req *http.Request, dir string, ownerId int, maxBytes int64) (string, string, error) {
+	image, readErr := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBytes))
+	if readErr != nil {
+		return "", "", errUploadTooLarge
+	}
+	contentType := http.DetectContentType(image)
+	extension, allowed := imageExtensions[contentType]
+	if !allowed {
+		return "", "", errUnsupportedType
+	}
+	name, randErr := randomUrlToken()
+	if randErr != nil {
+		return "", "", randErr
+	}
+	file := strconv.Itoa(ownerId) + "-" + name + extension
+	if mkdirErr := os.MkdirAll(filepath.Join(cft.mediaDir, dir), 0755); mkdirErr != nil {
+		return "", "", mkdirErr
+	}
+	if writeErr := os.WriteFile(cft.mediaPath(dir, file), image, 0644); writeErr != nil {
+		return "", "", writeErr
+	}
+	return file, contentType, nil
+}
+
+func respondWithUploadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUploadTooLarge) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	if errors.Is(err, errUnsupportedType) {
+		respondWithError(w, http.StatusUnsupportedMediaType, err.Error())
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, err.Error())
+}
+
+func (cft *apiConfig) serveMediaFile(w http.ResponseWriter, req *http.Request, dir string) {
+	file := req.PathValue("file")
+	if file != filepath.Base(file) || file == "." || file == ".." {
+		respondWithError(w, http.StatusNotFound, "Media not found")
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, req, cft.mediaPath(dir, file))
+}
+
+// uploadMedia stores an image that can then be attached to a chirp by
+// passing its id in attachment_ids. Unattached uploads are pruned after a
+// day.
+func (cft *apiConfig) uploadMedia(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeChirpsWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if writableErr := cft.requireWritableAccount(req, id); writableErr != nil {
+		respondWithError(w, http.StatusForbidden, writableErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	file, contentType, storeErr := cft.storeImageUpload(w, req, attachmentDir, userId, maxMediaBytes)
+	if storeErr != nil {
+		respondWithUploadError(w, storeErr)
+		return
+	}
+	info, statErr := os.Stat(cft.mediaPath(attachmentDir, file))
+	if statErr != nil {
+		respondWithError(w, http.StatusInternalServerError, statErr.Error())
+		return
+	}
+	media, createErr := cft.dbFor(req).CreateMedia(userId, file, contentType, int(info.Size()))
+	if createErr != nil {
+		cft.removeMediaFile(attachmentDir, file)
+		respondWithError(w, http.StatusInternalServerError, createErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusCreated, media)
+}
+
+// serveAttachment serves a chirp attachment to anyone who can see the
+// chirp it is attached to.
+func (cft *apiConfig) serveAttachment(w http.ResponseWriter, req *http.Request) {
+	viewer, viewerErr := cft.getViewer(req)
+	if viewerErr != nil {
+		respondWithError(w, http.StatusUnauthorized, viewerErr.Error())
+		return
+	}
+	if _, mediaErr := cft.dbFor(req).GetAttachment(req.PathValue("file"), viewer); mediaErr != nil {
+		respondWithError(w, http.StatusNotFound, "Media not found")
+		return
+	}
+	cft.serveMediaFile(w, req, attachmentDir)
+}
+
+func (cft *apiConfig) pruneMedia() {
+	pruned, pruneErr := cft.db.PruneMedia(time.Now())
+	if pruneErr != nil {
+		slog.Error("Error pruning media", "error", pruneErr)
+		return
+	}
+	for _, media := range pruned {
+		cft.removeMediaFile(attachmentDir, media.File)
+	}
+	if len(pruned) > 0 {
+		slog.Info("Pruned media files", "count", len(pruned))
+	}
+}
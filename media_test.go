@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+var (
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+	jpegHeader = []byte("\xff\xd8\xff")
+	gifHeader  = []byte("GIF89a")
+	webpHeader = []byte("RIFF\x00\x00\x00\x00WEBPVP")
+)
+
+// testImage returns size bytes starting with header, padded with zeros.
+func testImage(header []byte, size int) []byte {
+	image := make([]byte, size)
+	copy(image, header)
+	return image
+}
+
+func uploadRequest(method, path, token string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestUploadLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		method string
+		body   []byte
+		status int
+	}{
+		{name: "png", path: "/api/media", method: http.MethodPost, body: testImage(pngHeader, 1024), status: http.StatusCreated},
+		{name: "jpeg", path: "/api/media", method: http.MethodPost, body: testImage(jpegHeader, 1024), status: http.StatusCreated},
+		{name: "gif", path: "/api/media", method: http.MethodPost, body: testImage(gifHeader, 1024), status: http.StatusCreated},
+		{name: "webp", path: "/api/media", method: http.MethodPost, body: testImage(webpHeader, 1024), status: http.StatusCreated},
+		{name: "largest attachment", path: "/api/media", method: http.MethodPost, body: testImage(pngHeader, maxMediaBytes), status: http.StatusCreated},
+		{name: "attachment too large", path: "/api/media", method: http.MethodPost, body: testImage(pngHeader, maxMediaBytes+1), status: http.StatusRequestEntityTooLarge},
+		{name: "text", path: "/api/media", method: http.MethodPost, body: []byte("just some text"), status: http.StatusUnsupportedMediaType},
+		{name: "svg", path: "/api/media", method: http.MethodPost, body: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`), status: http.StatusUnsupportedMediaType},
+		{name: "html", path: "/api/media", method: http.MethodPost, body: []byte("<html><script>alert(1)</script></html>"), status: http.StatusUnsupportedMediaType},
+		{name: "empty", path: "/api/media", method: http.MethodPost, body: []byte{}, status: http.StatusUnsupportedMediaType},
+		{name: "largest avatar", path: "/api/users/me/avatar", method: http.MethodPut, body: testImage(pngHeader, maxAvatarBytes), status: http.StatusOK},
+		{name: "avatar too large", path: "/api/users/me/avatar", method: http.MethodPut, body: testImage(pngHeader, maxAvatarBytes+1), status: http.StatusRequestEntityTooLarge},
+		{name: "avatar not an image", path: "/api/users/me/avatar", method: http.MethodPut, body: []byte("just some text"), status: http.StatusUnsupportedMediaType},
+	}
+	cft := newTestConfig(t)
+	_, token := createTestUser(t, cft, "a@example.com")
+	handler := cft.routes()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, uploadRequest(test.method, test.path, token, test.body))
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestMaxAttachmentsPerTier(t *testing.T) {
+	tests := []struct {
+		tier        string
+		attachments int
+		status      int
+	}{
+		{tier: "free", attachments: 0, status: http.StatusCreated},
+		{tier: "free", attachments: freeEntitlements.MaxAttachments, status: http.StatusCreated},
+		{tier: "free", attachments: freeEntitlements.MaxAttachments + 1, status: http.StatusBadRequest},
+		{tier: "chirpy_red", attachments: redEntitlements.MaxAttachments, status: http.StatusCreated},
+		{tier: "chirpy_red", attachments: redEntitlements.MaxAttachments + 1, status: http.StatusBadRequest},
+	}
+	cft := newTestConfig(t)
+	handler := cft.routes()
+	free, freeToken := createTestUser(t, cft, "free@example.com")
+	red, redToken := createTestUser(t, cft, "red@example.com")
+	if _, _, upgradeErr := cft.db.ApplyPolkaEvent("evt-red", database.PolkaEventUpgraded, database.PolkaEventData{UserId: red.Id}, time.Now()); upgradeErr != nil {
+		t.Fatal(upgradeErr)
+	}
+	tokens := map[string]string{"free": freeToken, "chirpy_red": redToken}
+	ownerIds := map[string]int{"free": free.Id, "chirpy_red": red.Id}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s with %d", test.tier, test.attachments), func(t *testing.T) {
+			attachmentIds := []int{}
+			for i := 0; i < test.attachments; i++ {
+				media, createErr := cft.db.CreateMedia(ownerIds[test.tier], fmt.Sprintf("%d-%d.png", ownerIds[test.tier], i), "image/png", 1024)
+				if createErr != nil {
+					t.Fatal(createErr)
+				}
+				attachmentIds = append(attachmentIds, media.Id)
+			}
+			req := newJsonRequest(t, http.MethodPost, "/api/chirps", tokens[test.tier], map[string]any{
+				"body":           "look at these",
+				"attachment_ids": attachmentIds,
+			})
+			recorder := doJson(t, handler, req, nil)
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+		})
+	}
+}
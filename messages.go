@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const (
+	maxMessageLen       = 1000
+	defaultMessagesPage = 50
+	maxMessagesPage     = 100
+)
+
+// respondWithConversationError maps the errors shared by the conversation
+// endpoints. Conversations the caller isn't part of are reported as missing.
+func respondWithConversationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrNotParticipant) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrBlocked) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	respondWithError(w, http.StatusBadRequest, err.Error())
+}
+
+func (cft *apiConfig) createConversation(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		ParticipantIds []int `json:"participant_ids"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if writableErr := cft.requireWritableAccount(req, id); writableErr != nil {
+		respondWithError(w, http.StatusForbidden, writableErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	conversation, createErr := cft.dbFor(req).CreateConversation(userId, params.ParticipantIds)
+	if createErr != nil {
+		respondWithConversationError(w, createErr)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, conversation)
+}
+
+func (cft *apiConfig) getConversations(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	conversations, getErr := cft.dbFor(req).GetConversations(userId)
+	if getErr != nil {
+		respondWithError(w, http.StatusInternalServerError, getErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, conversations)
+}
+
+func (cft *apiConfig) sendMessage(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Body string `json:"body"`
+	}
+	conversationId, parseErr := strconv.Atoi(req.PathValue("conversationid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing conversationId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if writableErr := cft.requireWritableAccount(req, id); writableErr != nil {
+		respondWithError(w, http.StatusForbidden, writableErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if params.Body == "" || utf8.RuneCountInString(params.Body) > maxMessageLen {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Message must be between 1 and %d characters", maxMessageLen))
+		return
+	}
+	limits, limitsErr := cft.getEntitlements(req, id)
+	if limitsErr != nil {
+		respondWithError(w, http.StatusInternalServerError, limitsErr.Error())
+		return
+	}
+	if wait, allowed := cft.messageLimiter.allow(id, limits.MessagesPerHour, entitlementRateWindow); !allowed {
+		respondWithRetryAfter(w, wait, "Too many messages")
+		return
+	}
+	message, sendErr := cft.dbFor(req).SendMessage(conversationId, userId, params.Body)
+	if sendErr != nil {
+		respondWithConversationError(w, sendErr)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, message)
+}
+
+// getMessages pages backwards through a conversation. The response carries
+// the cursor for the next page in next_before until the start is reached.
+func (cft *apiConfig) getMessages(w http.ResponseWriter, req *http.Request) {
+	type responseStruct struct {
+		Messages   []database.Message `json:"messages"`
+		NextBefore int                `json:"next_before,omitempty"`
+	}
+	conversationId, parseErr := strconv.Atoi(req.PathValue("conversationid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing conversationId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	before := 0
+	if beforeParam := req.URL.Query().Get("before"); beforeParam != "" {
+		var beforeErr error
+		before, beforeErr = strconv.Atoi(beforeParam)
+		if beforeErr != nil || before < 1 {
+			respondWithError(w, http.StatusBadRequest, "Error parsing before")
+			return
+		}
+	}
+	limit := defaultMessagesPage
+	if limitParam := req.URL.Query().Get("limit"); limitParam != "" {
+		var limitErr error
+		limit, limitErr = strconv.Atoi(limitParam)
+		if limitErr != nil || limit < 1 || limit > maxMessagesPage {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxMessagesPage))
+			return
+		}
+	}
+	messages, getErr := cft.dbFor(req).GetMessages(conversationId, userId, before, limit+1)
+	if getErr != nil {
+		respondWithConversationError(w, getErr)
+		return
+	}
+	response := responseStruct{Messages: messages}
+	if len(messages) > limit {
+		response.Messages = messages[:limit]
+		response.NextBefore = messages[limit-1].Id
+	}
+	respondWithJson(w, http.StatusOK, response)
+}
+
+// markConversationRead moves the caller's read receipt forward, to the
+// latest message when no message_id is given.
+func (cft *apiConfig) markConversationRead(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		MessageId int `json:"message_id"`
+	}
+	conversationId, parseErr := strconv.Atoi(req.PathValue("conversationid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing conversationId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	params := parameters{}
+	if req.ContentLength != 0 {
+		decoder := json.NewDecoder(req.Body)
+		err := decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+			return
+		}
+	}
+	conversation, readErr := cft.dbFor(req).MarkConversationRead(conversationId, userId, params.MessageId)
+	if readErr != nil {
+		respondWithConversationError(w, readErr)
+		return
+	}
+	respondWithJson(w, http.StatusOK, conversation)
+}
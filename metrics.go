@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{1 << 10, 1 << 14, 1 << 17, 1 << 20, 1 << 23, 1 << 26}
+)
+
+// metricsRegistry holds metrics and renders them in the Prometheus text
+// exposition format. It implements just the counters, gauges and
+// histograms Chirpy needs.
+type metricsRegistry struct {
+	mux      sync.Mutex
+	families []*metricFamily
+}
+
+type metricFamily struct {
+	registry   *metricsRegistry
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	series     map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues  []string
+	value        float64
+	bucketCounts []uint64
+	count        uint64
+}
+
+func (registry *metricsRegistry) register(kind, name, help string, buckets []float64, labelNames []string) *metricFamily {
+	family := &metricFamily{
+		registry:   registry,
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*metricSeries),
+	}
+	registry.families = append(registry.families, family)
+	return family
+}
+
+func (registry *metricsRegistry) counter(name, help string, labelNames ...string) *metricFamily {
+	return registry.register("counter", name, help, nil, labelNames)
+}
+
+func (registry *metricsRegistry) gauge(name, help string, labelNames ...string) *metricFamily {
+	return registry.register("gauge", name, help, nil, labelNames)
+}
+
+func (registry *metricsRegistry) histogram(name, help string, buckets []float64, labelNames ...string) *metricFamily {
+	return registry.register("histogram", name, help, buckets, labelNames)
+}
+
+// seriesFor must be called with the registry locked.
+func (family *metricFamily) seriesFor(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	series, exists := family.series[key]
+	if !exists {
+		series = &metricSeries{labelValues: labelValues, bucketCounts: make([]uint64, len(family.buckets))}
+		family.series[key] = series
+	}
+	return series
+}
+
+func (family *metricFamily) add(delta float64, labelValues ...string) {
+	family.registry.mux.Lock()
+	defer family.registry.mux.Unlock()
+	family.seriesFor(labelValues).value += delta
+}
+
+func (family *metricFamily) inc(labelValues ...string) {
+	family.add(1, labelValues...)
+}
+
+func (family *metricFamily) set(value float64, labelValues ...string) {
+	family.registry.mux.Lock()
+	defer family.registry.mux.Unlock()
+	family.seriesFor(labelValues).value = value
+}
+
+func (family *metricFamily) observe(value float64, labelValues ...string) {
+	family.registry.mux.Lock()
+	defer family.registry.mux.Unlock()
+	series := family.seriesFor(labelValues)
+	for i, bound := range family.buckets {
+		if value <= bound {
+			series.bucketCounts[i]++
+		}
+	}
+	series.count++
+	series.value += value
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (registry *metricsRegistry) writeTo(w io.Writer) {
+	registry.mux.Lock()
+	defer registry.mux.Unlock()
+	for _, family := range registry.families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		keys := make([]string, 0, len(family.series))
+		for key := range family.series {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			series := family.series[key]
+			if family.kind != "histogram" {
+				fmt.Fprintf(w, "%s%s %s\n", family.name, formatLabels(family.labelNames, series.labelValues, "", ""), formatFloat(series.value))
+				continue
+			}
+			for i, bound := range family.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labelNames, series.labelValues, "le", formatFloat(bound)), series.bucketCounts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labelNames, series.labelValues, "le", "+Inf"), series.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", family.name, formatLabels(family.labelNames, series.labelValues, "", ""), formatFloat(series.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", family.name, formatLabels(family.labelNames, series.labelValues, "", ""), series.count)
+		}
+	}
+}
+
+// chirpyMetrics are the metrics exported on /metrics.
+type chirpyMetrics struct {
+	registry         *metricsRegistry
+	requests         *metricFamily
+	requestDuration  *metricFamily
+	requestsInFlight *metricFamily
+	dbDuration       *metricFamily
+	dbSize           *metricFamily
+	chirpsCreated    *metricFamily
+	logins           *metricFamily
+	webhookEvents    *metricFamily
+	deliveries       *metricFamily
+}
+
+func newChirpyMetrics() *chirpyMetrics {
+	registry := &metricsRegistry{}
+	return &chirpyMetrics{
+		registry:         registry,
+		requests:         registry.counter("chirpy_http_requests_total", "HTTP requests by route and status code.", "route", "code"),
+		requestDuration:  registry.histogram("chirpy_http_request_duration_seconds", "HTTP request latency by route.", latencyBuckets, "route"),
+		requestsInFlight: registry.gauge("chirpy_http_requests_in_flight", "HTTP requests currently being served."),
+		dbDuration:       registry.histogram("chirpy_db_operation_duration_seconds", "Latency of reading and writing the database file.", latencyBuckets, "operation"),
+		dbSize:           registry.histogram("chirpy_db_operation_bytes", "Bytes read or written per database operation.", sizeBuckets, "operation"),
+		chirpsCreated:    registry.counter("chirpy_chirps_created_total", "Chirps created."),
+		logins:           registry.counter("chirpy_logins_total", "Password login attempts by result.", "result"),
+		webhookEvents:    registry.counter("chirpy_webhook_events_total", "Inbound webhook events by source and outcome: rejected, received, processed, retried or dead.", "source", "outcome"),
+		deliveries:       registry.counter("chirpy_webhook_deliveries_total", "Outbound webhook delivery attempts by outcome: delivered or failed.", "outcome"),
+	}
+}
+
+// observeDB is registered with the database to time every file operation.
+func (metrics *chirpyMetrics) observeDB(operation string, duration time.Duration, bytes int) {
+	metrics.dbDuration.observe(duration.Seconds(), operation)
+	metrics.dbSize.observe(float64(bytes), operation)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(data)
+}
+
+// middlewareHttpMetrics records every request served by mux under the
+// pattern it matched, so ids in paths don't create a series per chirp.
+func (cft *apiConfig) middlewareHttpMetrics(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, route := mux.Handler(req)
+		if route == "" {
+			route = "unmatched"
+		}
+		cft.metrics.requestsInFlight.add(1)
+		defer cft.metrics.requestsInFlight.add(-1)
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		mux.ServeHTTP(recorder, req)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		cft.metrics.requestDuration.observe(time.Since(start).Seconds(), route)
+		cft.metrics.requests.inc(route, strconv.Itoa(recorder.status))
+	})
+}
+
+// serveMetrics renders the metrics for Prometheus. When METRICS_TOKEN is
+// set the scraper must send it as a bearer token.
+func (cft *apiConfig) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if cft.metricsToken != "" {
+		given := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(cft.metricsToken)) != 1 {
+			respondWithError(w, http.StatusUnauthorized, "Invalid metrics token")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	cft.metrics.registry.writeTo(w)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const (
+	maxReportReasonLen     = 500
+	defaultSuspendDuration = time.Hour * 24 * 7
+)
+
+func (cft *apiConfig) reportChirp(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Reason string `json:"reason"`
+	}
+	chirpId, parseErr := strconv.Atoi(req.PathValue("chirpid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing chirpId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeChirpsWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if writableErr := cft.requireWritableAccount(req, id); writableErr != nil {
+		respondWithError(w, http.StatusForbidden, writableErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if params.Reason == "" || len(params.Reason) > maxReportReasonLen {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Reason must be between 1 and %d characters", maxReportReasonLen))
+		return
+	}
+	report, reportErr := cft.dbFor(req).CreateReport(chirpId, userId, params.Reason)
+	if reportErr != nil {
+		respondWithError(w, http.StatusBadRequest, reportErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusCreated, report)
+}
+
+func (cft *apiConfig) getModerationQueue(w http.ResponseWriter, req *http.Request) {
+	status := req.URL.Query().Get("status")
+	if status == "" {
+		status = database.ReportOpen
+	}
+	if status == "all" {
+		status = ""
+	}
+	reports, err := cft.dbFor(req).GetReports(status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, reports)
+}
+
+func (cft *apiConfig) moderateReport(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Action          string `json:"action"`
+		Reason          string `json:"reason"`
+		DurationSeconds int    `json:"duration_seconds"`
+	}
+	reportId, parseErr := strconv.Atoi(req.PathValue("reportid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing reportId")
+		return
+	}
+	moderator := req.Context().Value(userContextKey).(database.User)
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if !database.IsValidModerationAction(params.Action) {
+		respondWithError(w, http.StatusBadRequest, "Unknown moderation action")
+		return
+	}
+	suspendFor := defaultSuspendDuration
+	if params.DurationSeconds > 0 {
+		suspendFor = time.Duration(params.DurationSeconds) * time.Second
+	}
+	action, actionErr := cft.dbFor(req).ApplyModerationAction(reportId, moderator.Id, params.Action, params.Reason, time.Now().Add(suspendFor))
+	if errors.Is(actionErr, database.ErrOutranked) {
+		respondWithError(w, http.StatusForbidden, actionErr.Error())
+		return
+	}
+	if actionErr != nil {
+		respondWithError(w, http.StatusBadRequest, actionErr.Error())
+		return
+	}
+	if action.Action == database.ModerationDelete {
+		cft.publishChirpDeleted(action.ChirpId, action.TargetUserId)
+	}
+	if action.Action == database.ModerationWarn || action.Action == database.ModerationSuspend {
+		cft.notifyModeratedUser(action)
+	}
+	respondWithJson(w, http.StatusOK, action)
+}
+
+func (cft *apiConfig) notifyModeratedUser(action database.ModerationAction) {
+	author, authorErr := cft.db.GetUserById(action.TargetUserId)
+	if authorErr != nil {
+		return
+	}
+	body := fmt.Sprintf("A moderator reviewed your chirp:\n\n%s\n\nReason: %s\n", action.ChirpBody, action.Reason)
+	if action.Action == database.ModerationSuspend {
+		body += fmt.Sprintf("\nYour account is suspended until %s.\n", action.ExpiresAt.UTC().Format(time.RFC1123))
+	}
+	sendErr := cft.mailer.Send(emailMessage{
+		To:      author.Email,
+		Subject: "A moderator has reviewed your Chirpy activity",
+		Body:    body,
+	})
+	if sendErr != nil {
+		slog.Error("Error sending moderation notice", "user_id", author.Id, "error", sendErr)
+	}
+}
+
+func (cft *apiConfig) getModerationActions(w http.ResponseWriter, req *http.Request) {
+	actions, err := cft.dbFor(req).GetModerationActions()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, actions)
+}
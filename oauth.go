@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<html>
+
+<body>
+    <h1>Authorize {{.ClientName}}</h1>
+    <p>{{.ClientName}} would like to access your Chirpy account with these permissions:</p>
+    <ul>
+        {{range .Scopes}}<li>{{.}}</li>{{end}}
+    </ul>
+    {{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+    <form method="POST" action="/oauth/authorize">
+        <input type="hidden" name="response_type" value="code">
+        <input type="hidden" name="client_id" value="{{.ClientId}}">
+        <input type="hidden" name="redirect_uri" value="{{.RedirectUri}}">
+        <input type="hidden" name="scope" value="{{.Scope}}">
+        <input type="hidden" name="state" value="{{.State}}">
+        <input type="hidden" name="code_challenge" value="{{.CodeChallenge}}">
+        <input type="hidden" name="code_challenge_method" value="S256">
+        <p><label>Email <input type="email" name="email" required></label></p>
+        <p><label>Password <input type="password" name="password"></label></p>
+        <p><label>Two-factor code (if enabled) <input type="text" name="code" autocomplete="one-time-code"></label></p>
+        <button type="submit" name="decision" value="approve">Allow</button>
+        <button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+    </form>
+</body>
+
+</html>
+`))
+
+type authorizationRequest struct {
+	Client        database.OauthClient
+	RedirectUri   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// oauthError is an error defined by RFC 6749 that can be sent back to the
+// client, either in a redirect or as a JSON body.
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+func (e oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func respondWithOauthError(w http.ResponseWriter, code int, err oauthError) {
+	type errorResponse struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}
+	respondWithJson(w, code, errorResponse{Error: err.Code, ErrorDescription: err.Description})
+}
+
+func redirectWithParams(w http.ResponseWriter, req *http.Request, redirectUri string, params url.Values) {
+	target, parseErr := url.Parse(redirectUri)
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid redirect_uri")
+		return
+	}
+	query := target.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, req, target.String(), http.StatusFound)
+}
+
+func validateRedirectUri(redirectUri string) error {
+	parsed, parseErr := url.Parse(redirectUri)
+	if parseErr != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+		return errors.New("Redirect URIs must be absolute URLs without a fragment")
+	}
+	if parsed.Scheme == "http" && parsed.Hostname() != "localhost" && parsed.Hostname() != "127.0.0.1" {
+		return errors.New("Redirect URIs must use https outside of localhost")
+	}
+	return nil
+}
+
+// parseAuthorizationRequest validates the parameters of an authorization
+// request. Until the client and redirect URI are known to be good the
+// returned request has no RedirectUri, and errors must not be redirected.
+func (cft *apiConfig) parseAuthorizationRequest(req *http.Request, values url.Values) (authorizationRequest, error) {
+	authReq := authorizationRequest{}
+	client, clientErr := cft.dbFor(req).GetOauthClient(values.Get("client_id"))
+	if clientErr != nil {
+		return authReq, oauthError{Code: "invalid_client", Description: clientErr.Error()}
+	}
+	redirectUri := values.Get("redirect_uri")
+	if redirectUri == "" && len(client.RedirectUris) == 1 {
+		redirectUri = client.RedirectUris[0]
+	}
+	if !slices.Contains(client.RedirectUris, redirectUri) {
+		return authReq, oauthError{Code: "invalid_request", Description: "redirect_uri is not registered for this client"}
+	}
+	authReq.Client = client
+	authReq.RedirectUri = redirectUri
+	authReq.State = values.Get("state")
+	if values.Get("response_type") != "code" {
+		return authReq, oauthError{Code: "unsupported_response_type", Description: "Only the code response type is supported"}
+	}
+	authReq.CodeChallenge = values.Get("code_challenge")
+	if authReq.CodeChallenge == "" || values.Get("code_challenge_method") != "S256" {
+		return authReq, oauthError{Code: "invalid_request", Description: "PKCE with code_challenge_method S256 is required"}
+	}
+	scopes := strings.Fields(values.Get("scope"))
+	if len(scopes) == 0 {
+		return authReq, oauthError{Code: "invalid_scope", Description: "At least one scope is required"}
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(apiTokenScopes, scope) {
+			return authReq, oauthError{Code: "invalid_scope", Description: "Unknown scope: " + scope}
+		}
+	}
+	slices.Sort(scopes)
+	authReq.Scopes = slices.Compact(scopes)
+	return authReq, nil
+}
+
+func (cft *apiConfig) respondWithAuthorizationError(w http.ResponseWriter, req *http.Request, authReq authorizationRequest, err error) {
+	oauthErr := oauthError{}
+	if !errors.As(err, &oauthErr) {
+		oauthErr = oauthError{Code: "server_error", Description: err.Error()}
+	}
+	if authReq.RedirectUri == "" {
+		respondWithOauthError(w, http.StatusBadRequest, oauthErr)
+		return
+	}
+	params := url.Values{}
+	params.Set("error", oauthErr.Code)
+	params.Set("error_description", oauthErr.Description)
+	if authReq.State != "" {
+		params.Set("state", authReq.State)
+	}
+	redirectWithParams(w, req, authReq.RedirectUri, params)
+}
+
+func renderConsentPage(w http.ResponseWriter, code int, authReq authorizationRequest, errorMsg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	renderErr := consentTemplate.Execute(w, struct {
+		ClientName    string
+		ClientId      string
+		RedirectUri   string
+		Scopes        []string
+		Scope         string
+		State         string
+		CodeChallenge string
+		Error         string
+	}{
+		ClientName:    authReq.Client.Name,
+		ClientId:      authReq.Client.ClientId,
+		RedirectUri:   authReq.RedirectUri,
+		Scopes:        authReq.Scopes,
+		Scope:         strings.Join(authReq.Scopes, " "),
+		State:         authReq.State,
+		CodeChallenge: authReq.CodeChallenge,
+		Error:         errorMsg,
+	})
+	if renderErr != nil {
+		slog.Error("Error rendering consent page", "error", renderErr, "request_id", w.Header().Get(requestIdHeader))
+	}
+}
+
+func (cft *apiConfig) createOauthClient(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Name         string   `json:"name"`
+		RedirectUris []string `json:"redirect_uris"`
+		Confidential bool     `json:"confidential"`
+	}
+	type responseStruct struct {
+		ClientId     string    `json:"client_id"`
+		ClientSecret string    `json:"client_secret,omitempty"`
+		Name         string    `json:"name"`
+		RedirectUris []string  `json:"redirect_uris"`
+		CreatedAt    time.Time `json:"created_at"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, "Client name is required")
+		return
+	}
+	if len(params.RedirectUris) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one redirect URI is required")
+		return
+	}
+	for _, redirectUri := range params.RedirectUris {
+		if redirectErr := validateRedirectUri(redirectUri); redirectErr != nil {
+			respondWithError(w, http.StatusBadRequest, redirectErr.Error())
+			return
+		}
+	}
+	client, secret, createErr := cft.dbFor(req).CreateOauthClient(userId, params.Name, params.RedirectUris, params.Confidential)
+	if createErr != nil {
+		respondWithError(w, http.StatusInternalServerError, createErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusCreated, responseStruct{
+		ClientId:     client.ClientId,
+		ClientSecret: secret,
+		Name:         client.Name,
+		RedirectUris: client.RedirectUris,
+		CreatedAt:    client.CreatedAt,
+	})
+}
+
+func (cft *apiConfig) oauthAuthorize(w http.ResponseWriter, req *http.Request) {
+	authReq, parseErr := cft.parseAuthorizationRequest(req, req.URL.Query())
+	if parseErr != nil {
+		cft.respondWithAuthorizationError(w, req, authReq, parseErr)
+		return
+	}
+	renderConsentPage(w, http.StatusOK, authReq, "")
+}
+
+func (cft *apiConfig) oauthConsent(w http.ResponseWriter, req *http.Request) {
+	if formErr := req.ParseForm(); formErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode form")
+		return
+	}
+	authReq, parseErr := cft.parseAuthorizationRequest(req, req.PostForm)
+	if parseErr != nil {
+		cft.respondWithAuthorizationError(w, req, authReq, parseErr)
+		return
+	}
+	if req.PostForm.Get("decision") != "approve" {
+		cft.respondWithAuthorizationError(w, req, authReq, oauthError{Code: "access_denied", Description: "The user denied the request"})
+		return
+	}
+	email := req.PostForm.Get("email")
+	if wait, msg := cft.checkLoginThrottle(req, email); wait > 0 {
+		setRetryAfter(w, wait)
+		renderConsentPage(w, http.StatusTooManyRequests, authReq, msg)
+		return
+	}
+	// Approving an app only checks the credentials; it doesn't sign the user
+	// in here or cancel a scheduled deletion.
+	user, verifyErr := cft.dbFor(req).VerifyPassword(email, req.PostForm.Get("password"))
+	if verifyErr == nil && user.TotpEnabled {
+		verifyErr = cft.dbFor(req).VerifySecondFactor(user.Id, req.PostForm.Get("code"))
+	}
+	cft.recordLoginResult(req, email, verifyErr)
+	if database.IsAccountInactive(verifyErr) {
+		renderConsentPage(w, http.StatusForbidden, authReq, verifyErr.Error())
+		return
+	}
+	if verifyErr != nil {
+		renderConsentPage(w, http.StatusUnauthorized, authReq, "Invalid email, password or two-factor code")
+		return
+	}
+	if writableErr := checkCanWrite(user); writableErr != nil {
+		renderConsentPage(w, http.StatusForbidden, authReq, writableErr.Error())
+		return
+	}
+	code, codeErr := cft.dbFor(req).CreateOauthCode(authReq.Client.ClientId, user.Id, authReq.RedirectUri, authReq.Scopes, authReq.CodeChallenge)
+	if codeErr != nil {
+		cft.respondWithAuthorizationError(w, req, authReq, codeErr)
+		return
+	}
+	params := url.Values{}
+	params.Set("code", code)
+	if authReq.State != "" {
+		params.Set("state", authReq.State)
+	}
+	redirectWithParams(w, req, authReq.RedirectUri, params)
+}
+
+// authenticateOauthClient reads client credentials from HTTP Basic auth or,
+// failing that, from the form body.
+func (cft *apiConfig) authenticateOauthClient(req *http.Request) (database.OauthClient, error) {
+	clientId, clientSecret, hasBasic := req.BasicAuth()
+	if !hasBasic {
+		clientId = req.PostForm.Get("client_id")
+		clientSecret = req.PostForm.Get("client_secret")
+	}
+	return cft.dbFor(req).AuthenticateOauthClient(clientId, clientSecret)
+}
+
+func (cft *apiConfig) oauthToken(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if formErr := req.ParseForm(); formErr != nil {
+		respondWithOauthError(w, http.StatusBadRequest, oauthError{Code: "invalid_request", Description: "Couldn't decode form"})
+		return
+	}
+	client, clientErr := cft.authenticateOauthClient(req)
+	if clientErr != nil {
+		respondWithOauthError(w, http.StatusUnauthorized, oauthError{Code: "invalid_client", Description: clientErr.Error()})
+		return
+	}
+	var tokens database.OauthTokens
+	var grantErr error
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		tokens, grantErr = cft.dbFor(req).ExchangeOauthCode(
+			client.ClientId,
+			req.PostForm.Get("code"),
+			req.PostForm.Get("redirect_uri"),
+			req.PostForm.Get("code_verifier"),
+			cft.jwtSecret,
+		)
+	case "refresh_token":
+		tokens, grantErr = cft.dbFor(req).RefreshOauthToken(client.ClientId, req.PostForm.Get("refresh_token"), cft.jwtSecret)
+	default:
+		respondWithOauthError(w, http.StatusBadRequest, oauthError{Code: "unsupported_grant_type", Description: "Supported grants are authorization_code and refresh_token"})
+		return
+	}
+	if errors.Is(grantErr, database.ErrInvalidGrant) {
+		respondWithOauthError(w, http.StatusBadRequest, oauthError{Code: "invalid_grant", Description: grantErr.Error()})
+		return
+	}
+	if grantErr != nil {
+		respondWithOauthError(w, http.StatusInternalServerError, oauthError{Code: "server_error", Description: grantErr.Error()})
+		return
+	}
+	respondWithJson(w, http.StatusOK, tokens)
+}
+
+func (cft *apiConfig) oauthIntrospect(w http.ResponseWriter, req *http.Request) {
+	if formErr := req.ParseForm(); formErr != nil {
+		respondWithOauthError(w, http.StatusBadRequest, oauthError{Code: "invalid_request", Description: "Couldn't decode form"})
+		return
+	}
+	client, clientErr := cft.authenticateOauthClient(req)
+	if clientErr != nil || !client.IsConfidential() {
+		respondWithOauthError(w, http.StatusUnauthorized, oauthError{Code: "invalid_client", Description: "Introspection requires a confidential client"})
+		return
+	}
+	introspection, introspectErr := cft.dbFor(req).IntrospectOauthToken(client.ClientId, req.PostForm.Get("token"), cft.jwtSecret)
+	if introspectErr != nil {
+		respondWithOauthError(w, http.StatusInternalServerError, oauthError{Code: "server_error", Description: introspectErr.Error()})
+		return
+	}
+	respondWithJson(w, http.StatusOK, introspection)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func consentRequest(clientId, email string) *http.Request {
+	form := url.Values{}
+	form.Set("client_id", clientId)
+	form.Set("response_type", "code")
+	form.Set("code_challenge", "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+	form.Set("code_challenge_method", "S256")
+	form.Set("scope", scopeChirpsRead)
+	form.Set("decision", "approve")
+	form.Set("email", email)
+	form.Set("password", "pw")
+	req := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestOauthConsentDoesNotSignIn(t *testing.T) {
+	cft := newTestConfig(t)
+	handler := cft.routes()
+	owner, _ := createTestUser(t, cft, "owner@example.com")
+	client, _, clientErr := cft.db.CreateOauthClient(owner.Id, "app", []string{"https://app.example.com/callback"}, false)
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, consentRequest(client.ClientId, "owner@example.com"))
+	if recorder.Code != http.StatusFound || !strings.Contains(recorder.Header().Get("Location"), "code=") {
+		t.Fatalf("approval returned %d to %q, want a redirect with a code", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	leaving, _ := createTestUser(t, cft, "leaving@example.com")
+	if _, scheduleErr := cft.db.ScheduleAccountDeletion(leaving.Id, time.Now().Add(time.Hour)); scheduleErr != nil {
+		t.Fatal(scheduleErr)
+	}
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, consentRequest(client.ClientId, "leaving@example.com"))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("approval during the deletion grace period returned %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+	user, getErr := cft.db.GetUserById(leaving.Id)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if user.DeletionScheduledAt.IsZero() {
+		t.Error("approving an app cancelled the scheduled deletion")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const oidcLoginTTL = time.Minute * 10
+
+// pendingOidcLogin holds what we need to finish an authorization-code flow
+// once the provider redirects back with the matching state.
+type pendingOidcLogin struct {
+	codeVerifier string
+	nonce        string
+	exp          time.Time
+}
+
+type oidcClient struct {
+	verifier *oidc.IDTokenVerifier
+	config   oauth2.Config
+	mux      *sync.Mutex
+	pending  map[string]pendingOidcLogin
+}
+
+// newOidcClientFromEnv returns nil when no provider is configured.
+func newOidcClientFromEnv(ctx context.Context, baseUrl string) (*oidcClient, error) {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientId := os.Getenv("OIDC_CLIENT_ID")
+	if clientId == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required when OIDC_ISSUER_URL is set")
+	}
+	redirectUrl := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectUrl == "" {
+		redirectUrl = baseUrl + "/api/oidc/callback"
+	}
+	provider, providerErr := oidc.NewProvider(ctx, issuer)
+	if providerErr != nil {
+		return nil, providerErr
+	}
+	return &oidcClient{
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientId}),
+		config: oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  redirectUrl,
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		mux:     &sync.Mutex{},
+		pending: make(map[string]pendingOidcLogin),
+	}, nil
+}
+
+func randomUrlToken() (string, error) {
+	randBytes := make([]byte, 32)
+	_, readErr := rand.Read(randBytes)
+	if readErr != nil {
+		return "", readErr
+	}
+	return base64.RawURLEncoding.EncodeToString(randBytes), nil
+}
+
+func (c *oidcClient) startLogin() (string, error) {
+	state, stateErr := randomUrlToken()
+	if stateErr != nil {
+		return "", stateErr
+	}
+	nonce, nonceErr := randomUrlToken()
+	if nonceErr != nil {
+		return "", nonceErr
+	}
+	codeVerifier := oauth2.GenerateVerifier()
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	now := time.Now()
+	for pendingState, login := range c.pending {
+		if login.exp.Before(now) {
+			delete(c.pending, pendingState)
+		}
+	}
+	c.pending[state] = pendingOidcLogin{codeVerifier: codeVerifier, nonce: nonce, exp: now.Add(oidcLoginTTL)}
+	return c.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(codeVerifier)), nil
+}
+
+// takeLogin removes the pending login for state so it can only be used once.
+func (c *oidcClient) takeLogin(state string) (pendingOidcLogin, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	login, exists := c.pending[state]
+	delete(c.pending, state)
+	if !exists || login.exp.Before(time.Now()) {
+		return pendingOidcLogin{}, false
+	}
+	return login, true
+}
+
+func (cft *apiConfig) oidcLogin(w http.ResponseWriter, req *http.Request) {
+	authUrl, startErr := cft.oidc.startLogin()
+	if startErr != nil {
+		respondWithError(w, http.StatusInternalServerError, startErr.Error())
+		return
+	}
+	http.Redirect(w, req, authUrl, http.StatusFound)
+}
+
+func (cft *apiConfig) oidcCallback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	login, found := cft.oidc.takeLogin(query.Get("state"))
+	if !found {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired login state")
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		respondWithError(w, http.StatusUnauthorized, "Provider returned error: "+providerErr)
+		return
+	}
+	token, exchangeErr := cft.oidc.config.Exchange(req.Context(), query.Get("code"), oauth2.VerifierOption(login.codeVerifier))
+	if exchangeErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't exchange authorization code")
+		return
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Provider didn't return an ID token")
+		return
+	}
+	idToken, verifyErr := cft.oidc.verifier.Verify(req.Context(), rawIdToken)
+	if verifyErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid ID token")
+		return
+	}
+	if idToken.Nonce != login.nonce {
+		respondWithError(w, http.StatusUnauthorized, "Invalid ID token nonce")
+		return
+	}
+	claims := struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}{}
+	if claimsErr := idToken.Claims(&claims); claimsErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid ID token claims")
+		return
+	}
+	if !claims.EmailVerified || validateEmail(claims.Email) != nil {
+		respondWithError(w, http.StatusForbidden, "Provider account has no verified email")
+		return
+	}
+	user, loginErr := cft.dbFor(req).LoginOidcUser(idToken.Issuer, idToken.Subject, claims.Email, cft.jwtSecret)
+	if errors.Is(loginErr, database.ErrTotpRequired) {
+		cft.respondWithLoginChallenge(w, req, user.Id)
+		return
+	}
+	if database.IsAccountInactive(loginErr) {
+		respondWithError(w, http.StatusForbidden, loginErr.Error())
+		return
+	}
+	if errors.Is(loginErr, database.ErrOidcAccountUnverified) {
+		respondWithError(w, http.StatusConflict, loginErr.Error())
+		return
+	}
+	if loginErr != nil {
+		respondWithError(w, http.StatusInternalServerError, loginErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, user)
+}
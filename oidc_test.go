@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testOidcClientId = "chirpy-test"
+	testOidcKeyId    = "test-key"
+)
+
+// fakeIdentity is what the fake provider puts in the ID token it issues
+// for a code.
+type fakeIdentity struct {
+	subject       string
+	email         string
+	emailVerified bool
+	nonce         string
+}
+
+type issuedCode struct {
+	identity      fakeIdentity
+	codeChallenge string
+}
+
+// fakeOidcProvider is a minimal OpenID provider. Tests play the browser:
+// they read the authorization request off the redirect and call authorize
+// to get a code, as the provider would after the user signs in.
+type fakeOidcProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	mux    sync.Mutex
+	codes  map[string]issuedCode
+}
+
+func newFakeOidcProvider(t *testing.T) *fakeOidcProvider {
+	t.Helper()
+	key, keyErr := rsa.GenerateKey(rand.Reader, 2048)
+	if keyErr != nil {
+		t.Fatal(keyErr)
+	}
+	provider := &fakeOidcProvider{key: key, codes: make(map[string]issuedCode)}
+	routes := http.NewServeMux()
+	routes.HandleFunc("GET /.well-known/openid-configuration", provider.discovery)
+	routes.HandleFunc("GET /jwks", provider.jwks)
+	routes.HandleFunc("POST /token", provider.token)
+	provider.server = httptest.NewServer(routes)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (p *fakeOidcProvider) discovery(w http.ResponseWriter, req *http.Request) {
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"issuer":                                p.server.URL,
+		"authorization_endpoint":                p.server.URL + "/authorize",
+		"token_endpoint":                        p.server.URL + "/token",
+		"jwks_uri":                              p.server.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *fakeOidcProvider) jwks(w http.ResponseWriter, req *http.Request) {
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": testOidcKeyId,
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize checks the authorization request the way a provider would and
+// returns a code for identity. An empty identity nonce means the nonce
+// from the request.
+func (p *fakeOidcProvider) authorize(t *testing.T, authUrl string, identity fakeIdentity) url.Values {
+	t.Helper()
+	parsed, parseErr := url.Parse(authUrl)
+	if parseErr != nil {
+		t.Fatal(parseErr)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != testOidcClientId || query.Get("response_type") != "code" {
+		t.Fatalf("unexpected authorization request %s", authUrl)
+	}
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authorization request without an S256 PKCE challenge: %s", authUrl)
+	}
+	if query.Get("state") == "" || query.Get("nonce") == "" {
+		t.Fatalf("authorization request without state and nonce: %s", authUrl)
+	}
+	if identity.nonce == "" {
+		identity.nonce = query.Get("nonce")
+	}
+	code, codeErr := randomUrlToken()
+	if codeErr != nil {
+		t.Fatal(codeErr)
+	}
+	p.mux.Lock()
+	p.codes[code] = issuedCode{identity: identity, codeChallenge: query.Get("code_challenge")}
+	p.mux.Unlock()
+	return url.Values{"state": {query.Get("state")}, "code": {code}}
+}
+
+func (p *fakeOidcProvider) token(w http.ResponseWriter, req *http.Request) {
+	if parseErr := req.ParseForm(); parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	p.mux.Lock()
+	issued, exists := p.codes[req.PostForm.Get("code")]
+	delete(p.codes, req.PostForm.Get("code"))
+	p.mux.Unlock()
+	if !exists {
+		respondWithError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	challenge := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != issued.codeChallenge {
+		respondWithError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            p.server.URL,
+		"aud":            testOidcClientId,
+		"sub":            issued.identity.subject,
+		"email":          issued.identity.email,
+		"email_verified": issued.identity.emailVerified,
+		"nonce":          issued.identity.nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	})
+	idToken.Header["kid"] = testOidcKeyId
+	signed, signErr := idToken.SignedString(p.key)
+	if signErr != nil {
+		respondWithError(w, http.StatusInternalServerError, signErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     signed,
+	})
+}
+
+func newOidcTestConfig(t *testing.T) (*apiConfig, *fakeOidcProvider, http.Handler) {
+	t.Helper()
+	provider := newFakeOidcProvider(t)
+	cft := newTestConfig(t)
+	t.Setenv("OIDC_ISSUER_URL", provider.server.URL)
+	t.Setenv("OIDC_CLIENT_ID", testOidcClientId)
+	t.Setenv("OIDC_CLIENT_SECRET", "secret")
+	client, clientErr := newOidcClientFromEnv(context.Background(), cft.baseUrl)
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	cft.oidc = client
+	return cft, provider, cft.routes()
+}
+
+// startOidcLogin follows GET /api/oidc/login and returns the provider's
+// authorization url.
+func startOidcLogin(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want %d", recorder.Code, http.StatusFound)
+	}
+	return recorder.Header().Get("Location")
+}
+
+func oidcCallback(handler http.Handler, query url.Values) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/oidc/callback?"+query.Encode(), nil))
+	return recorder
+}
+
+func TestOidcLoginCreatesAccount(t *testing.T) {
+	cft, provider, handler := newOidcTestConfig(t)
+	query := provider.authorize(t, startOidcLogin(t, handler), fakeIdentity{subject: "sub-1", email: "new@example.com", emailVerified: true})
+	recorder := oidcCallback(handler, query)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	response := struct {
+		Id    int    `json:"id"`
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}{}
+	if decodeErr := json.NewDecoder(recorder.Body).Decode(&response); decodeErr != nil {
+		t.Fatal(decodeErr)
+	}
+	if response.Email != "new@example.com" || response.Token == "" {
+		t.Errorf("callback response = %+v, want a session for new@example.com", response)
+	}
+	user, getErr := cft.db.GetUserById(response.Id)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	if !user.EmailVerified || user.OidcIssuer != provider.server.URL || user.OidcSubject != "sub-1" {
+		t.Errorf("created user = %+v, want a verified account linked to sub-1", user)
+	}
+
+	// The subject identifies the account, even if the email changes at the
+	// provider.
+	query = provider.authorize(t, startOidcLogin(t, handler), fakeIdentity{subject: "sub-1", email: "renamed@example.com", emailVerified: true})
+	recorder = oidcCallback(handler, query)
+	again := struct {
+		Id int `json:"id"`
+	}{}
+	json.NewDecoder(recorder.Body).Decode(&again)
+	if recorder.Code != http.StatusOK || again.Id != response.Id {
+		t.Errorf("second login status = %d id = %d, want %d id = %d", recorder.Code, again.Id, http.StatusOK, response.Id)
+	}
+}
+
+func TestOidcState(t *testing.T) {
+	_, provider, handler := newOidcTestConfig(t)
+	identity := fakeIdentity{subject: "sub-1", email: "a@example.com", emailVerified: true}
+
+	query := provider.authorize(t, startOidcLogin(t, handler), identity)
+	if recorder := oidcCallback(handler, query); recorder.Code != http.StatusOK {
+		t.Fatalf("callback status = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	replayed := provider.authorize(t, startOidcLogin(t, handler), identity)
+	replayed.Set("state", query.Get("state"))
+	if recorder := oidcCallback(handler, replayed); recorder.Code != http.StatusBadRequest {
+		t.Errorf("reused state status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+
+	unknown := provider.authorize(t, startOidcLogin(t, handler), identity)
+	unknown.Set("state", "not-a-state")
+	if recorder := oidcCallback(handler, unknown); recorder.Code != http.StatusBadRequest {
+		t.Errorf("unknown state status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOidcPkce(t *testing.T) {
+	_, provider, handler := newOidcTestConfig(t)
+	identity := fakeIdentity{subject: "sub-1", email: "a@example.com", emailVerified: true}
+
+	// A code issued for one login can't be redeemed by another, since the
+	// other login's verifier doesn't match the code's challenge.
+	stolen := provider.authorize(t, startOidcLogin(t, handler), identity)
+	victim := provider.authorize(t, startOidcLogin(t, handler), identity)
+	victim.Set("code", stolen.Get("code"))
+	if recorder := oidcCallback(handler, victim); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("code with the wrong verifier status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOidcNonce(t *testing.T) {
+	_, provider, handler := newOidcTestConfig(t)
+	query := provider.authorize(t, startOidcLogin(t, handler), fakeIdentity{subject: "sub-1", email: "a@example.com", emailVerified: true, nonce: "replayed"})
+	if recorder := oidcCallback(handler, query); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("wrong nonce status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestOidcEmailLinking(t *testing.T) {
+	tests := []struct {
+		name          string
+		emailVerified bool
+		existing      string
+		status        int
+		linked        bool
+	}{
+		{name: "unverified provider email", emailVerified: false, status: http.StatusForbidden},
+		{name: "links verified account", emailVerified: true, existing: "verified", status: http.StatusOK, linked: true},
+		{name: "refuses unverified account", emailVerified: true, existing: "unverified", status: http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cft, provider, handler := newOidcTestConfig(t)
+			existingId := 0
+			switch test.existing {
+			case "verified":
+				user, _ := createTestUser(t, cft, "a@example.com")
+				existingId = user.Id
+			case "unverified":
+				user, createErr := cft.db.CreateUser("a@example.com", "pw")
+				if createErr != nil {
+					t.Fatal(createErr)
+				}
+				existingId = user.Id
+			}
+			query := provider.authorize(t, startOidcLogin(t, handler), fakeIdentity{subject: "sub-1", email: "a@example.com", emailVerified: test.emailVerified})
+			recorder := oidcCallback(handler, query)
+			if recorder.Code != test.status {
+				t.Fatalf("callback status = %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if existingId == 0 {
+				return
+			}
+			user, getErr := cft.db.GetUserById(existingId)
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			if linked := user.OidcSubject == "sub-1"; linked != test.linked {
+				t.Errorf("existing account linked = %v, want %v", linked, test.linked)
+			}
+		})
+	}
+}
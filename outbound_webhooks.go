@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const (
+	chirpySignatureHeader  = "Chirpy-Signature"
+	webhookDeliveryTimeout = time.Second * 10
+	finishedDeliveryMaxAge = time.Hour * 24 * 30
+)
+
+type webhookSubscriptionResponse struct {
+	Id        int       `json:"id"`
+	Url       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Global    bool      `json:"global"`
+	CreatedAt time.Time `json:"created_at"`
+	Secret    string    `json:"secret,omitempty"`
+}
+
+func newWebhookSubscriptionResponse(subscription database.WebhookSubscription) webhookSubscriptionResponse {
+	return webhookSubscriptionResponse{
+		Id:        subscription.Id,
+		Url:       subscription.Url,
+		Events:    subscription.Events,
+		Global:    subscription.Global,
+		CreatedAt: subscription.CreatedAt,
+	}
+}
+
+// publishEvent queues event for every subscription interested in activity
+// of subjectUserId. Failures are logged rather than failing the request
+// that caused the event.
+func (cft *apiConfig) publishEvent(event string, subjectUserId int, data any) {
+	queued, queueErr := cft.db.QueueOutboundEvent(event, subjectUserId, data, time.Now())
+	if queueErr != nil {
+		slog.Error("Error queueing event", "event", event, "error", queueErr)
+		return
+	}
+	if queued > 0 {
+		cft.wakeDeliveryWorker()
+	}
+}
+
+func (cft *apiConfig) publishChirpDeleted(chirpId, authorId int) {
+	type eventData struct {
+		ChirpId  int `json:"chirp_id"`
+		AuthorId int `json:"author_id"`
+	}
+	cft.publishEvent(database.EventChirpDeleted, authorId, eventData{ChirpId: chirpId, AuthorId: authorId})
+}
+
+func (cft *apiConfig) wakeDeliveryWorker() {
+	select {
+	case cft.deliveryWake <- struct{}{}:
+	default:
+	}
+}
+
+// runDeliveryWorker runs for the lifetime of the server, sending queued
+// outbound webhooks and retrying failed ones when they are due.
+func (cft *apiConfig) runDeliveryWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cft.sendDueDeliveries(time.Now())
+		select {
+		case <-ticker.C:
+		case <-cft.deliveryWake:
+		}
+	}
+}
+
+func (cft *apiConfig) sendDueDeliveries(now time.Time) {
+	due, dueErr := cft.db.GetDueOutboundDeliveries(now)
+	if dueErr != nil {
+		slog.Error("Error loading outbound deliveries", "error", dueErr)
+		return
+	}
+	for _, delivery := range due {
+		subscription, subscriptionErr := cft.db.GetWebhookSubscription(delivery.SubscriptionId, 0)
+		if subscriptionErr != nil {
+			continue
+		}
+		attempt := cft.sendDelivery(subscription, delivery)
+		delivered := attempt.Error == "" && attempt.StatusCode >= 200 && attempt.StatusCode < 300
+		updated, recordErr := cft.db.RecordDeliveryAttempt(delivery.Id, attempt, delivered)
+		if recordErr != nil {
+			slog.Error("Error recording delivery", "delivery_id", delivery.Id, "error", recordErr)
+			continue
+		}
+		if delivered {
+			cft.metrics.deliveries.inc("delivered")
+		} else {
+			cft.metrics.deliveries.inc("failed")
+		}
+		if updated.Status == database.DeliveryFailed {
+			slog.Warn("Delivery failed", "delivery_id", updated.Id, "subscription_id", subscription.Id, "attempts", len(updated.Attempts))
+		}
+	}
+}
+
+// sendDelivery posts the payload to the subscription, signed the same way
+// Polka signs the webhooks it sends to us.
+func (cft *apiConfig) sendDelivery(subscription database.WebhookSubscription, delivery database.OutboundDelivery) database.DeliveryAttempt {
+	start := time.Now()
+	attempt := database.DeliveryAttempt{At: start}
+	req, reqErr := http.NewRequest(http.MethodPost, subscription.Url, strings.NewReader(delivery.Payload))
+	if reqErr != nil {
+		attempt.Error = reqErr.Error()
+		return attempt
+	}
+	signature := signWebhook([]byte(subscription.Secret), start.Unix(), []byte(delivery.Payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Chirpy-Event", delivery.Event)
+	req.Header.Set("Chirpy-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set(chirpySignatureHeader, fmt.Sprintf("t=%d,v1=%s", start.Unix(), signature))
+	res, sendErr := cft.webhookClient.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if sendErr != nil {
+		attempt.Error = sendErr.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+	attempt.StatusCode = res.StatusCode
+	return attempt
+}
+
+func (cft *apiConfig) pruneOutboundDeliveries() {
+	pruned, pruneErr := cft.db.PruneOutboundDeliveries(time.Now().Add(-finishedDeliveryMaxAge))
+	if pruneErr != nil {
+		slog.Error("Error pruning outbound deliveries", "error", pruneErr)
+		return
+	}
+	if pruned > 0 {
+		slog.Info("Pruned outbound deliveries", "count", pruned)
+	}
+}
+
+var errPrivateWebhookAddress = errors.New("Webhook url must not point at a private or local address")
+
+// newWebhookClient returns the client outbound webhooks are sent with. Any
+// user can choose where deliveries go, so the client refuses to connect to
+// the server's own network. The check runs on the resolved address of every
+// connection, so DNS names can't be used to get around it, and redirects
+// are not followed.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: refusePrivateAddress}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func refusePrivateAddress(network, address string, conn syscall.RawConn) error {
+	host, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		return splitErr
+	}
+	ip, parseErr := netip.ParseAddr(host)
+	if parseErr != nil || !isPublicAddress(ip) {
+		return errPrivateWebhookAddress
+	}
+	return nil
+}
+
+// isPublicAddress reports whether ip is somewhere a webhook may be sent:
+// not loopback, link-local (which includes cloud metadata services),
+// private or unspecified.
+func isPublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!ip.IsUnspecified()
+}
+
+// validateWebhookUrl rejects urls that can never be delivered to. Hosts
+// given as a name are only checked when a delivery connects.
+func validateWebhookUrl(rawUrl string) error {
+	parsed, parseErr := url.Parse(rawUrl)
+	if parseErr != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("Webhook url must be an absolute http or https URL")
+	}
+	host := parsed.Hostname()
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return errPrivateWebhookAddress
+	}
+	if ip, ipErr := netip.ParseAddr(host); ipErr == nil && !isPublicAddress(ip) {
+		return errPrivateWebhookAddress
+	}
+	return nil
+}
+
+func (cft *apiConfig) createWebhookSubscription(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Url    string   `json:"url"`
+		Events []string `json:"events"`
+		Global bool     `json:"global"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if writableErr := cft.requireWritableAccount(req, id); writableErr != nil {
+		respondWithError(w, http.StatusForbidden, writableErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if urlErr := validateWebhookUrl(params.Url); urlErr != nil {
+		respondWithError(w, http.StatusBadRequest, urlErr.Error())
+		return
+	}
+	if len(params.Events) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one event is required")
+		return
+	}
+	for _, event := range params.Events {
+		if !database.IsValidOutboundEvent(event) {
+			respondWithError(w, http.StatusBadRequest, "Unknown event: "+event)
+			return
+		}
+	}
+	if params.Global {
+		user, userErr := cft.dbFor(req).GetUserById(userId)
+		if userErr != nil || !user.HasRole(database.RoleAdmin) {
+			respondWithError(w, http.StatusForbidden, "Only admins can create global webhooks")
+			return
+		}
+	}
+	slices.Sort(params.Events)
+	subscription, createErr := cft.dbFor(req).CreateWebhookSubscription(userId, params.Url, slices.Compact(params.Events), params.Global)
+	if createErr != nil {
+		respondWithError(w, http.StatusBadRequest, createErr.Error())
+		return
+	}
+	response := newWebhookSubscriptionResponse(subscription)
+	response.Secret = subscription.Secret
+	respondWithJson(w, http.StatusCreated, response)
+}
+
+func (cft *apiConfig) getWebhookSubscriptions(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	subscriptions, getErr := cft.dbFor(req).GetWebhookSubscriptions(userId)
+	if getErr != nil {
+		respondWithError(w, http.StatusInternalServerError, getErr.Error())
+		return
+	}
+	response := make([]webhookSubscriptionResponse, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		response = append(response, newWebhookSubscriptionResponse(subscription))
+	}
+	respondWithJson(w, http.StatusOK, response)
+}
+
+func (cft *apiConfig) deleteWebhookSubscription(w http.ResponseWriter, req *http.Request) {
+	subscriptionId, parseErr := strconv.Atoi(req.PathValue("subscriptionid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing subscriptionId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	deleteErr := cft.dbFor(req).DeleteWebhookSubscription(subscriptionId, userId)
+	if deleteErr != nil {
+		respondWithError(w, http.StatusNotFound, deleteErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cft *apiConfig) getWebhookDeliveries(w http.ResponseWriter, req *http.Request) {
+	subscriptionId, parseErr := strconv.Atoi(req.PathValue("subscriptionid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing subscriptionId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	deliveries, getErr := cft.dbFor(req).GetOutboundDeliveries(subscriptionId, userId)
+	if getErr != nil {
+		respondWithError(w, http.StatusNotFound, getErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, deliveries)
+}
+
+// pingWebhookSubscription queues a webhook.ping delivery so the receiver
+// can be tested without waiting for real activity.
+func (cft *apiConfig) pingWebhookSubscription(w http.ResponseWriter, req *http.Request) {
+	subscriptionId, parseErr := strconv.Atoi(req.PathValue("subscriptionid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing subscriptionId")
+		return
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	delivery, pingErr := cft.dbFor(req).QueuePing(subscriptionId, userId, time.Now())
+	if pingErr != nil {
+		respondWithError(w, http.StatusNotFound, pingErr.Error())
+		return
+	}
+	cft.wakeDeliveryWorker()
+	respondWithJson(w, http.StatusAccepted, delivery)
+}
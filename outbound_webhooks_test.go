@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver answers deliveries with the given status codes in turn
+// and keeps what it received.
+type webhookReceiver struct {
+	mux      sync.Mutex
+	statuses []int
+	received []receivedWebhook
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.received = append(r.received, receivedWebhook{header: req.Header.Clone(), body: body})
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status = r.statuses[0]
+		r.statuses = r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *webhookReceiver) count() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return len(r.received)
+}
+
+func TestSendDeliverySignsAndRetries(t *testing.T) {
+	receiver := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusNoContent}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	cft := newTestConfig(t)
+	// The real client refuses loopback addresses, which is where the test
+	// server listens.
+	cft.webhookClient = server.Client()
+	user, _ := createTestUser(t, cft, "a@example.com")
+	subscription, createErr := cft.db.CreateWebhookSubscription(user.Id, server.URL, []string{database.EventChirpCreated}, false)
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	delivery, pingErr := cft.db.QueuePing(subscription.Id, user.Id, time.Now())
+	if pingErr != nil {
+		t.Fatal(pingErr)
+	}
+
+	cft.sendDueDeliveries(time.Now())
+	if got := receiver.count(); got != 1 {
+		t.Fatalf("receiver got %d deliveries, want 1", got)
+	}
+	received := receiver.received[0]
+	if got := received.header.Get("Chirpy-Event"); got != database.EventPing {
+		t.Errorf("Chirpy-Event = %q, want %q", got, database.EventPing)
+	}
+	if got := received.header.Get("Chirpy-Delivery"); got != strconv.Itoa(delivery.Id) {
+		t.Errorf("Chirpy-Delivery = %q, want %d", got, delivery.Id)
+	}
+	if got := received.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	verifier := &webhookVerifier{
+		secrets:   [][]byte{[]byte(subscription.Secret)},
+		tolerance: webhookSignatureTolerance,
+		now:       time.Now,
+	}
+	if _, _, verifyErr := verifier.verify(received.header.Get(chirpySignatureHeader), received.body); verifyErr != nil {
+		t.Errorf("signature doesn't verify with the subscription secret: %v", verifyErr)
+	}
+	event := database.OutboundEvent{}
+	if decodeErr := json.Unmarshal(received.body, &event); decodeErr != nil {
+		t.Fatalf("payload isn't an event: %v", decodeErr)
+	}
+	if event.Event != database.EventPing || event.Id != delivery.EventId || string(received.body) != delivery.Payload {
+		t.Errorf("payload = %s, want the queued %s", received.body, delivery.Payload)
+	}
+
+	deliveries, getErr := cft.db.GetOutboundDeliveries(subscription.Id, user.Id)
+	if getErr != nil {
+		t.Fatal(getErr)
+	}
+	failed := deliveries[0]
+	if failed.Status != database.DeliveryPending || len(failed.Attempts) != 1 {
+		t.Fatalf("after a 500 delivery is %s with %d attempts, want pending with 1", failed.Status, len(failed.Attempts))
+	}
+	if got := failed.Attempts[0].StatusCode; got != http.StatusInternalServerError {
+		t.Errorf("logged status code = %d, want %d", got, http.StatusInternalServerError)
+	}
+	if got := failed.NextAttemptAt.Sub(failed.Attempts[0].At); got != time.Second*30 {
+		t.Errorf("retry scheduled after %v, want 30s", got)
+	}
+
+	cft.sendDueDeliveries(time.Now())
+	if got := receiver.count(); got != 1 {
+		t.Fatalf("delivery retried before its backoff: receiver got %d", got)
+	}
+	cft.sendDueDeliveries(failed.NextAttemptAt)
+	if got := receiver.count(); got != 2 {
+		t.Fatalf("receiver got %d deliveries once the retry was due, want 2", got)
+	}
+	deliveries, _ = cft.db.GetOutboundDeliveries(subscription.Id, user.Id)
+	if got := deliveries[0]; got.Status != database.DeliveryDelivered || got.Attempts[1].StatusCode != http.StatusNoContent {
+		t.Errorf("after a 204 delivery is %s with attempts %+v", got.Status, got.Attempts)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	client := newWebhookClient(time.Second)
+	_, getErr := client.Get(server.URL)
+	if !errors.Is(getErr, errPrivateWebhookAddress) {
+		t.Errorf("request to %s returned %v, want %v", server.URL, getErr, errPrivateWebhookAddress)
+	}
+	if got := receiver.count(); got != 0 {
+		t.Errorf("loopback server received %d requests", got)
+	}
+
+	redirect := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if redirectErr := client.CheckRedirect(redirect, nil); !errors.Is(redirectErr, http.ErrUseLastResponse) {
+		t.Errorf("CheckRedirect = %v, want redirects refused", redirectErr)
+	}
+}
+
+func TestValidateWebhookUrl(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{url: "https://example.com/hooks", valid: true},
+		{url: "http://93.184.216.34/hooks", valid: true},
+		{url: "ftp://example.com/hooks", valid: false},
+		{url: "/hooks", valid: false},
+		{url: "http://localhost:8080/hooks", valid: false},
+		{url: "http://api.localhost/hooks", valid: false},
+		{url: "http://127.0.0.1/hooks", valid: false},
+		{url: "http://[::1]/hooks", valid: false},
+		{url: "http://0.0.0.0/hooks", valid: false},
+		{url: "http://10.1.2.3/hooks", valid: false},
+		{url: "http://192.168.0.1/hooks", valid: false},
+		{url: "http://169.254.169.254/latest/meta-data", valid: false},
+		{url: "http://[::ffff:127.0.0.1]/hooks", valid: false},
+	}
+	for _, test := range tests {
+		if got := validateWebhookUrl(test.url) == nil; got != test.valid {
+			t.Errorf("validateWebhookUrl(%q) valid = %v, want %v", test.url, got, test.valid)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// A client may ask for forgotPasswordIpLimit reset emails per window, and
+// each address receives at most forgotPasswordEmailLimit of them.
+const (
+	forgotPasswordIpLimit    = 10
+	forgotPasswordEmailLimit = 3
+	forgotPasswordWindow     = time.Hour
+)
+
+func (cft *apiConfig) forgotPassword(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	// Both limits apply whether or not the account exists, so they don't
+	// give away which emails are registered.
+	if wait, allowed := cft.resetLimiter.allow("ip:"+clientIp(req), forgotPasswordIpLimit, forgotPasswordWindow); !allowed {
+		respondWithRetryAfter(w, wait, "Too many password reset requests")
+		return
+	}
+	if wait, allowed := cft.resetLimiter.allow("email:"+accountKey(params.Email), forgotPasswordEmailLimit, forgotPasswordWindow); !allowed {
+		respondWithRetryAfter(w, wait, "Too many password reset requests")
+		return
+	}
+	token, user, tokenErr := cft.dbFor(req).CreatePasswordResetToken(params.Email)
+	if tokenErr != nil {
+		// Answer the same way as for a real account so the endpoint can't be
+		// used to find out which emails are registered.
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	sendErr := cft.mailer.Send(emailMessage{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body:    fmt.Sprintf("Someone asked to reset the password for your Chirpy account.\n\nSubmit this token to POST /api/password/reset within the next hour:\n%s\n\nIf this wasn't you, you can ignore this email.\n", token),
+	})
+	if sendErr != nil {
+		slog.ErrorContext(req.Context(), "Error sending password reset email", "user_id", user.Id, "error", sendErr)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cft *apiConfig) resetPassword(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Password is required")
+		return
+	}
+	resetErr := cft.dbFor(req).ResetPassword(params.Token, params.Password)
+	if resetErr != nil {
+		respondWithError(w, http.StatusBadRequest, resetErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
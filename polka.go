@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const maxWebhookBytes = 1 << 16
+
+// authenticatePolka checks the signature of a Polka delivery and rejects
+// replays of one already seen. Without signing secrets configured it falls
+// back to the static API key, compared in constant time.
+func (cft *apiConfig) authenticatePolka(req *http.Request, body []byte) error {
+	if cft.polkaVerifier == nil {
+		apiKey := strings.TrimPrefix(req.Header.Get("Authorization"), "ApiKey ")
+		if cft.polkaApikey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(cft.polkaApikey)) != 1 {
+			return errors.New("Invalid API key")
+		}
+		return nil
+	}
+	signature, signedAt, verifyErr := cft.polkaVerifier.verify(req.Header.Get(polkaSignatureHeader), body)
+	if verifyErr != nil {
+		return verifyErr
+	}
+	forgetBefore := cft.polkaVerifier.now().Add(-2 * cft.polkaVerifier.tolerance)
+	return cft.dbFor(req).RecordWebhookDelivery(signature, signedAt, forgetBefore)
+}
+
+type polkaPayload struct {
+	Id    string                  `json:"id"`
+	Event string                  `json:"event"`
+	Data  database.PolkaEventData `json:"data"`
+}
+
+// polkaWebhook stores a verified Polka delivery in the webhook queue and
+// acknowledges it once it is persisted. The webhook worker applies it.
+func (cft *apiConfig) polkaWebhook(w http.ResponseWriter, req *http.Request) {
+	body, readErr := io.ReadAll(http.MaxBytesReader(w, req.Body, maxWebhookBytes))
+	if readErr != nil {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Webhook body too large")
+		return
+	}
+	if authErr := cft.authenticatePolka(req, body); authErr != nil {
+		cft.metrics.webhookEvents.inc(webhookSourcePolka, "rejected")
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	params := polkaPayload{}
+	err := json.Unmarshal(body, &params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	_, enqueueErr := cft.dbFor(req).EnqueueWebhook(webhookSourcePolka, string(body), time.Now())
+	if enqueueErr != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't store webhook")
+		return
+	}
+	cft.metrics.webhookEvents.inc(webhookSourcePolka, "received")
+	cft.wakeWebhookWorker()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// polkaEventId returns the id Polka gave the event. Events sent without one
+// look the same every billing period, so they are keyed by the queued
+// delivery instead; redeliveries of those are caught by the signature replay
+// window in authenticatePolka.
+func polkaEventId(params polkaPayload, webhook database.InboundWebhook) string {
+	if params.Id != "" {
+		return params.Id
+	}
+	return "webhook:" + strconv.Itoa(webhook.Id)
+}
+
+// applyPolkaWebhook applies a queued Polka event. Redeliveries of an event
+// that was already processed are not applied again. Events Chirpy doesn't
+// handle are dropped rather than retried.
+func (cft *apiConfig) applyPolkaWebhook(webhook database.InboundWebhook) error {
+	params := polkaPayload{}
+	err := json.Unmarshal([]byte(webhook.Payload), &params)
+	if err != nil {
+		return err
+	}
+	params.Id = polkaEventId(params, webhook)
+	user, duplicate, applyErr := cft.db.ApplyPolkaEvent(params.Id, params.Event, params.Data, time.Now())
+	if errors.Is(applyErr, database.ErrUnknownPolkaEvent) {
+		slog.Info("Ignoring unknown Polka event", "event", params.Event)
+		return nil
+	}
+	if applyErr != nil {
+		return applyErr
+	}
+	if duplicate {
+		slog.Info("Ignoring duplicate Polka event", "event_id", params.Id)
+		return nil
+	}
+	if params.Event == database.PolkaEventUpgraded {
+		type eventData struct {
+			UserId       int                   `json:"user_id"`
+			Subscription database.Subscription `json:"subscription"`
+		}
+		cft.publishEvent(database.EventUserUpgraded, user.Id, eventData{UserId: user.Id, Subscription: user.Subscription})
+	}
+	return nil
+}
+
+func (cft *apiConfig) expireSubscriptions() {
+	expired, expireErr := cft.db.ExpireSubscriptions(time.Now())
+	if expireErr != nil {
+		slog.Error("Error expiring subscriptions", "error", expireErr)
+		return
+	}
+	for _, userId := range expired {
+		slog.Info("Chirpy Red subscription expired", "user_id", userId)
+	}
+}
+
+func (cft *apiConfig) getSubscription(w http.ResponseWriter, req *http.Request) {
+	type responseStruct struct {
+		IsChirpyRed  bool                  `json:"is_chirpy_red"`
+		Subscription database.Subscription `json:"subscription"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		respondWithError(w, http.StatusNotFound, userErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, responseStruct{IsChirpyRed: user.HasChirpyRed(time.Now()), Subscription: user.Subscription})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPolkaRenewalWithoutIdAppliedEachPeriod(t *testing.T) {
+	cft := newTestConfig(t)
+	user, _ := createTestUser(t, cft, "red@example.com")
+	upgrade := `{"event":"user.upgraded","data":{"user_id":` + strconv.Itoa(user.Id) + `}}`
+	renewal := `{"event":"user.renewed","data":{"user_id":` + strconv.Itoa(user.Id) + `}}`
+	for _, payload := range []string{upgrade, renewal, renewal} {
+		webhook, enqueueErr := cft.db.EnqueueWebhook(webhookSourcePolka, payload, time.Now())
+		if enqueueErr != nil {
+			t.Fatal(enqueueErr)
+		}
+		if applyErr := cft.applyWebhook(webhook); applyErr != nil {
+			t.Fatal(applyErr)
+		}
+	}
+	ledger, ledgerErr := cft.db.GetLedger(user.Id)
+	if ledgerErr != nil {
+		t.Fatal(ledgerErr)
+	}
+	if len(ledger) != 3 {
+		t.Errorf("ledger has %d entries, want an upgrade and two renewals", len(ledger))
+	}
+
+	// Retrying a queued delivery that was already applied doesn't charge again.
+	webhook, enqueueErr := cft.db.EnqueueWebhook(webhookSourcePolka, renewal, time.Now())
+	if enqueueErr != nil {
+		t.Fatal(enqueueErr)
+	}
+	for i := 0; i < 2; i++ {
+		if applyErr := cft.applyWebhook(webhook); applyErr != nil {
+			t.Fatal(applyErr)
+		}
+	}
+	ledger, ledgerErr = cft.db.GetLedger(user.Id)
+	if ledgerErr != nil {
+		t.Fatal(ledgerErr)
+	}
+	if len(ledger) != 4 {
+		t.Errorf("ledger has %d entries, want an upgrade and three renewals", len(ledger))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const maxAvatarBytes = 1 << 20
+
+// publicProfileResponse is all that is shown about a user to others. It must
+// never carry the email address or password hash.
+type publicProfileResponse struct {
+	Id          int    `json:"id"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"display_name"`
+	Bio         string `json:"bio"`
+	AvatarUrl   string `json:"avatar_url"`
+	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Private     bool   `json:"private"`
+}
+
+func (cft *apiConfig) publicProfile(user database.User) publicProfileResponse {
+	avatarUrl := ""
+	if user.AvatarFile != "" {
+		avatarUrl = cft.baseUrl + "/media/avatars/" + user.AvatarFile
+	}
+	return publicProfileResponse{
+		Id:          user.Id,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarUrl:   avatarUrl,
+		IsChirpyRed: user.HasChirpyRed(time.Now()),
+		Private:     user.Private,
+	}
+}
+
+func (cft *apiConfig) avatarPath(avatarFile string) string {
+	return cft.mediaPath(avatarDir, avatarFile)
+}
+
+func (cft *apiConfig) removeAvatar(avatarFile string) {
+	cft.removeMediaFile(avatarDir, avatarFile)
+}
+
+func (cft *apiConfig) getUserProfile(w http.ResponseWriter, req *http.Request) {
+	userId, parseErr := strconv.Atoi(req.PathValue("userid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+		return
+	}
+	user, userErr := cft.dbFor(req).GetPublicUser(userId)
+	if userErr != nil {
+		respondWithError(w, http.StatusNotFound, userErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, cft.publicProfile(user))
+}
+
+func (cft *apiConfig) getUserProfileByHandle(w http.ResponseWriter, req *http.Request) {
+	user, userErr := cft.dbFor(req).GetPublicUserByHandle(req.PathValue("handle"))
+	if userErr != nil {
+		respondWithError(w, http.StatusNotFound, userErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, cft.publicProfile(user))
+}
+
+func (cft *apiConfig) updateProfile(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := database.Profile{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	user, updateErr := cft.dbFor(req).UpdateProfile(userId, params)
+	if errors.Is(updateErr, database.ErrHandleTaken) {
+		respondWithError(w, http.StatusConflict, updateErr.Error())
+		return
+	}
+	if updateErr != nil {
+		respondWithError(w, http.StatusBadRequest, updateErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, cft.publicProfile(user))
+}
+
+// uploadAvatar takes the raw image as the request body. The type is sniffed
+// from the content rather than trusted from the Content-Type header.
+func (cft *apiConfig) uploadAvatar(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	avatarFile, _, storeErr := cft.storeImageUpload(w, req, avatarDir, userId, maxAvatarBytes)
+	if storeErr != nil {
+		respondWithUploadError(w, storeErr)
+		return
+	}
+	previous, setErr := cft.dbFor(req).SetAvatar(userId, avatarFile)
+	if setErr != nil {
+		cft.removeAvatar(avatarFile)
+		respondWithError(w, http.StatusInternalServerError, setErr.Error())
+		return
+	}
+	cft.removeAvatar(previous)
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		respondWithError(w, http.StatusInternalServerError, userErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, cft.publicProfile(user))
+}
+
+func (cft *apiConfig) serveAvatar(w http.ResponseWriter, req *http.Request) {
+	cft.serveMediaFile(w, req, avatarDir)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const (
+	loginIpLimit         = 30
+	loginIpWindow        = time.Minute * 5
+	loginAccountWindow   = time.Minute * 15
+	loginFreeFailures    = 3
+	loginMaxDelay        = time.Minute
+	loginLockoutFailures = 10
+	loginLockoutDuration = time.Minute * 15
+)
+
+// loginLimiter keeps sliding windows of login attempts per client IP and of
+// failed attempts per account. now is swappable so tests can use a fake clock.
+type loginLimiter struct {
+	mux             *sync.Mutex
+	now             func() time.Time
+	ipAttempts      map[string][]time.Time
+	accountFailures map[string][]time.Time
+}
+
+func newLoginLimiter(now func() time.Time) *loginLimiter {
+	return &loginLimiter{
+		mux:             &sync.Mutex{},
+		now:             now,
+		ipAttempts:      make(map[string][]time.Time),
+		accountFailures: make(map[string][]time.Time),
+	}
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// allowIp records an attempt from ip. When the window is full the attempt
+// is not recorded and the time until the oldest attempt expires is returned.
+func (l *loginLimiter) allowIp(ip string) (time.Duration, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	attempts := pruneBefore(l.ipAttempts[ip], now.Add(-loginIpWindow))
+	if len(attempts) >= loginIpLimit {
+		l.ipAttempts[ip] = attempts
+		return attempts[0].Add(loginIpWindow).Sub(now), false
+	}
+	l.ipAttempts[ip] = append(attempts, now)
+	return 0, true
+}
+
+// accountDelay returns how long the account must wait before another
+// attempt. Each failure past loginFreeFailures doubles the delay.
+func (l *loginLimiter) accountDelay(account string) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	failures := pruneBefore(l.accountFailures[account], now.Add(-loginAccountWindow))
+	if len(failures) == 0 {
+		delete(l.accountFailures, account)
+		return 0
+	}
+	l.accountFailures[account] = failures
+	if len(failures) < loginFreeFailures {
+		return 0
+	}
+	exponent := float64(len(failures) - loginFreeFailures)
+	delay := time.Duration(math.Min(float64(time.Second)*math.Pow(2, exponent), float64(loginMaxDelay)))
+	wait := failures[len(failures)-1].Add(delay).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// recordFailure returns true once the account has failed often enough to
+// be locked out. The failure history is cleared at that point so the
+// lockout recorded on the user takes over.
+func (l *loginLimiter) recordFailure(account string) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	failures := pruneBefore(l.accountFailures[account], now.Add(-loginAccountWindow))
+	failures = append(failures, now)
+	if len(failures) >= loginLockoutFailures {
+		delete(l.accountFailures, account)
+		return true
+	}
+	l.accountFailures[account] = failures
+	return false
+}
+
+func (l *loginLimiter) recordSuccess(account string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	delete(l.accountFailures, account)
+}
+
+// sweep drops every IP and account whose attempts have all left their
+// window, so clients that stop calling don't stay in memory.
+func (l *loginLimiter) sweep() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	sweepWindows(l.ipAttempts, now.Add(-loginIpWindow))
+	sweepWindows(l.accountFailures, now.Add(-loginAccountWindow))
+}
+
+func sweepWindows(windows map[string][]time.Time, cutoff time.Time) {
+	for key, times := range windows {
+		if len(pruneBefore(times, cutoff)) == 0 {
+			delete(windows, key)
+		}
+	}
+}
+
+// actionLimiter keeps a sliding window of actions per key. Unlike the login
+// limiter the limit is passed per call, since it depends on the user's
+// entitlements.
+type actionLimiter struct {
+	mux     *sync.Mutex
+	now     func() time.Time
+	actions map[string][]time.Time
+}
+
+func newActionLimiter(now func() time.Time) *actionLimiter {
+	return &actionLimiter{
+		mux:     &sync.Mutex{},
+		now:     now,
+		actions: make(map[string][]time.Time),
+	}
+}
+
+// allow records an action for key unless limit actions already happened in
+// the window, in which case it returns how long until one expires.
+func (l *actionLimiter) allow(key string, limit int, window time.Duration) (time.Duration, bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	now := l.now()
+	actions := pruneBefore(l.actions[key], now.Add(-window))
+	if len(actions) >= limit {
+		l.actions[key] = actions
+		return actions[0].Add(window).Sub(now), false
+	}
+	l.actions[key] = append(actions, now)
+	return 0, true
+}
+
+// sweep drops every key whose actions are all older than window.
+func (l *actionLimiter) sweep(window time.Duration) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	sweepWindows(l.actions, l.now().Add(-window))
+}
+
+func clientIp(req *http.Request) string {
+	host, _, splitErr := net.SplitHostPort(req.RemoteAddr)
+	if splitErr != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// accountKey normalizes an email for the per-account limits, so changing its
+// case or padding it doesn't start a fresh window.
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginThrottle applies the per-IP, lockout and per-account limits to a
+// password login attempt. It returns how long the client has to wait along
+// with the reason, or zero if the attempt may go ahead.
+func (cft *apiConfig) checkLoginThrottle(req *http.Request, email string) (time.Duration, string) {
+	if wait, allowed := cft.loginLimiter.allowIp(clientIp(req)); !allowed {
+		return wait, "Too many login attempts"
+	}
+	return cft.checkAccountThrottle(req, email)
+}
+
+// checkAccountThrottle applies the lockout and per-account limits, which
+// also cover the two-factor step of a login.
+func (cft *apiConfig) checkAccountThrottle(req *http.Request, email string) (time.Duration, string) {
+	lockedUntil, lockErr := cft.dbFor(req).GetLockedUntil(email)
+	if now := cft.loginLimiter.now(); lockErr == nil && lockedUntil.After(now) {
+		return lockedUntil.Sub(now), "Account temporarily locked"
+	}
+	if wait := cft.loginLimiter.accountDelay(accountKey(email)); wait > 0 {
+		return wait, "Too many failed login attempts"
+	}
+	return 0, ""
+}
+
+func (cft *apiConfig) recordLoginResult(req *http.Request, email string, verifyErr error) {
+	// A user asked for a second factor has only passed the first step, so
+	// earlier failed codes still count against the account.
+	if errors.Is(verifyErr, database.ErrTotpRequired) {
+		cft.metrics.logins.inc("success")
+		return
+	}
+	// A suspended or banned user still supplied the right password.
+	if verifyErr == nil || database.IsAccountInactive(verifyErr) {
+		cft.metrics.logins.inc("success")
+		cft.loginLimiter.recordSuccess(accountKey(email))
+		return
+	}
+	cft.metrics.logins.inc("failure")
+	if cft.loginLimiter.recordFailure(accountKey(email)) {
+		cft.dbFor(req).LockUser(email, cft.loginLimiter.now().Add(loginLockoutDuration))
+	}
+}
+
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+func respondWithRetryAfter(w http.ResponseWriter, wait time.Duration, msg string) {
+	setRetryAfter(w, wait)
+	respondWithError(w, http.StatusTooManyRequests, msg)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	current time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{current: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+func TestAllowIpWindow(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newLoginLimiter(clock.now)
+	for i := 0; i < loginIpLimit; i++ {
+		if _, allowed := limiter.allowIp("10.0.0.1"); !allowed {
+			t.Fatalf("attempt %d was refused", i+1)
+		}
+		clock.advance(time.Second)
+	}
+	wait, allowed := limiter.allowIp("10.0.0.1")
+	if allowed {
+		t.Fatal("attempt past the limit was allowed")
+	}
+	if want := loginIpWindow - loginIpLimit*time.Second; wait != want {
+		t.Errorf("wait = %v, want %v", wait, want)
+	}
+	if _, allowed := limiter.allowIp("10.0.0.2"); !allowed {
+		t.Error("another IP was refused")
+	}
+	clock.advance(wait + time.Second)
+	if _, allowed := limiter.allowIp("10.0.0.1"); !allowed {
+		t.Error("attempt after the oldest one expired was refused")
+	}
+}
+
+func TestAccountDelayIsProgressive(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newLoginLimiter(clock.now)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: 0},
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Second},
+		{failures: 4, want: time.Second * 2},
+		{failures: 5, want: time.Second * 4},
+		{failures: 6, want: time.Second * 8},
+	}
+	for _, test := range tests {
+		if limiter.recordFailure("a@example.com") {
+			t.Fatalf("locked out after %d failures", test.failures)
+		}
+		if got := limiter.accountDelay("a@example.com"); got != test.want {
+			t.Errorf("delay after %d failures = %v, want %v", test.failures, got, test.want)
+		}
+	}
+	clock.advance(time.Second * 8)
+	if got := limiter.accountDelay("a@example.com"); got != 0 {
+		t.Errorf("delay once it has passed = %v, want 0", got)
+	}
+	limiter.recordSuccess("a@example.com")
+	limiter.recordFailure("a@example.com")
+	if got := limiter.accountDelay("a@example.com"); got != 0 {
+		t.Errorf("delay after a success reset = %v, want 0", got)
+	}
+}
+
+func TestAccountDelayIsCapped(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newLoginLimiter(clock.now)
+	for i := 0; i < loginLockoutFailures-1; i++ {
+		limiter.recordFailure("a@example.com")
+	}
+	if got := limiter.accountDelay("a@example.com"); got > loginMaxDelay {
+		t.Errorf("delay = %v, want at most %v", got, loginMaxDelay)
+	}
+}
+
+func TestAccountFailuresExpire(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newLoginLimiter(clock.now)
+	for i := 0; i < loginLockoutFailures-1; i++ {
+		limiter.recordFailure("a@example.com")
+	}
+	clock.advance(loginAccountWindow + time.Second)
+	if got := limiter.accountDelay("a@example.com"); got != 0 {
+		t.Errorf("delay after the window = %v, want 0", got)
+	}
+	if limiter.recordFailure("a@example.com") {
+		t.Error("expired failures counted towards the lockout")
+	}
+}
+
+func TestRecordFailureLocksOut(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newLoginLimiter(clock.now)
+	for i := 1; i < loginLockoutFailures; i++ {
+		if limiter.recordFailure("a@example.com") {
+			t.Fatalf("locked out after %d failures", i)
+		}
+		clock.advance(time.Second)
+	}
+	if !limiter.recordFailure("a@example.com") {
+		t.Fatalf("not locked out after %d failures", loginLockoutFailures)
+	}
+	if _, tracked := limiter.accountFailures["a@example.com"]; tracked {
+		t.Error("failure history kept after the lockout")
+	}
+}
+
+func TestAccountThrottleIgnoresEmailCase(t *testing.T) {
+	cft := newTestConfig(t)
+	for _, email := range []string{"a@example.com", "A@example.com", " a@EXAMPLE.com", "A@Example.Com"} {
+		cft.recordLoginResult(httptest.NewRequest(http.MethodPost, "/api/login", nil), email, errors.New("Wrong password"))
+	}
+	if wait, _ := cft.checkAccountThrottle(httptest.NewRequest(http.MethodPost, "/api/login", nil), "a@example.com"); wait == 0 {
+		t.Errorf("%d failures spread over differently cased emails weren't throttled", loginFreeFailures+1)
+	}
+}
+
+func TestLoginLimiterSweep(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newLoginLimiter(clock.now)
+	limiter.allowIp("10.0.0.1")
+	limiter.recordFailure("a@example.com")
+	clock.advance(loginIpWindow + time.Second)
+	limiter.allowIp("10.0.0.2")
+	limiter.sweep()
+	if _, tracked := limiter.ipAttempts["10.0.0.1"]; tracked {
+		t.Error("idle IP kept after sweep")
+	}
+	if _, tracked := limiter.ipAttempts["10.0.0.2"]; !tracked {
+		t.Error("active IP dropped by sweep")
+	}
+	if _, tracked := limiter.accountFailures["a@example.com"]; !tracked {
+		t.Error("account dropped before its window ended")
+	}
+	clock.advance(loginAccountWindow)
+	limiter.sweep()
+	if len(limiter.ipAttempts) != 0 || len(limiter.accountFailures) != 0 {
+		t.Errorf("sweep left %d IPs and %d accounts", len(limiter.ipAttempts), len(limiter.accountFailures))
+	}
+}
+
+func TestActionLimiter(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newActionLimiter(clock.now)
+	for i := 0; i < 3; i++ {
+		if _, allowed := limiter.allow("1", 3, time.Hour); !allowed {
+			t.Fatalf("action %d was refused", i+1)
+		}
+		clock.advance(time.Minute)
+	}
+	wait, allowed := limiter.allow("1", 3, time.Hour)
+	if allowed {
+		t.Fatal("action past the limit was allowed")
+	}
+	if want := time.Hour - time.Minute*3; wait != want {
+		t.Errorf("wait = %v, want %v", wait, want)
+	}
+	clock.advance(time.Hour)
+	limiter.sweep(time.Hour)
+	if len(limiter.actions) != 0 {
+		t.Errorf("sweep left %d keys", len(limiter.actions))
+	}
+}
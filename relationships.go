@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// addRelationship returns a handler that blocks or mutes the user given in
+// the request body, depending on kind.
+func (cft *apiConfig) addRelationship(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		type parameters struct {
+			UserId int `json:"user_id"`
+		}
+		id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+		if authErr != nil {
+			respondWithError(w, http.StatusUnauthorized, authErr.Error())
+			return
+		}
+		if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+			respondWithError(w, http.StatusForbidden, activeErr.Error())
+			return
+		}
+		userId, convErr := strconv.Atoi(id)
+		if convErr != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+			return
+		}
+		decoder := json.NewDecoder(req.Body)
+		params := parameters{}
+		err := decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+			return
+		}
+		relationship, addErr := cft.dbFor(req).AddRelationship(userId, params.UserId, kind)
+		if addErr != nil {
+			respondWithError(w, http.StatusBadRequest, addErr.Error())
+			return
+		}
+		respondWithJson(w, http.StatusCreated, relationship)
+	}
+}
+
+func (cft *apiConfig) removeRelationship(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		targetId, parseErr := strconv.Atoi(req.PathValue("userid"))
+		if parseErr != nil {
+			respondWithError(w, http.StatusBadRequest, "Error parsing userId")
+			return
+		}
+		id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+		if authErr != nil {
+			respondWithError(w, http.StatusUnauthorized, authErr.Error())
+			return
+		}
+		if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+			respondWithError(w, http.StatusForbidden, activeErr.Error())
+			return
+		}
+		userId, convErr := strconv.Atoi(id)
+		if convErr != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+			return
+		}
+		removeErr := cft.dbFor(req).RemoveRelationship(userId, targetId, kind)
+		if removeErr != nil {
+			respondWithError(w, http.StatusNotFound, removeErr.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (cft *apiConfig) getRelationships(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		id, authErr := cft.getUserIdFromRequest(req, scopeProfileWrite)
+		if authErr != nil {
+			respondWithError(w, http.StatusUnauthorized, authErr.Error())
+			return
+		}
+		userId, convErr := strconv.Atoi(id)
+		if convErr != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+			return
+		}
+		relationships, getErr := cft.dbFor(req).GetRelationships(userId, kind)
+		if getErr != nil {
+			respondWithError(w, http.StatusInternalServerError, getErr.Error())
+			return
+		}
+		respondWithJson(w, http.StatusOK, relationships)
+	}
+}
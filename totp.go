@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+func (cft *apiConfig) respondWithLoginChallenge(w http.ResponseWriter, req *http.Request, userId int) {
+	type responseStruct struct {
+		TotpRequired   bool   `json:"totp_required"`
+		ChallengeToken string `json:"challenge_token"`
+	}
+	challenge, challengeErr := cft.dbFor(req).CreateLoginChallenge(userId, cft.jwtSecret)
+	if challengeErr != nil {
+		respondWithError(w, http.StatusInternalServerError, challengeErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, responseStruct{TotpRequired: true, ChallengeToken: challenge})
+}
+
+func (cft *apiConfig) completeTotpLogin(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		ChallengeToken   string `json:"challenge_token"`
+		Code             string `json:"code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+	}
+	if wait, allowed := cft.loginLimiter.allowIp(clientIp(req)); !allowed {
+		respondWithRetryAfter(w, wait, "Too many login attempts")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	email, challengeErr := cft.dbFor(req).GetLoginChallengeEmail(params.ChallengeToken, cft.jwtSecret)
+	if challengeErr != nil {
+		respondWithError(w, http.StatusUnauthorized, challengeErr.Error())
+		return
+	}
+	if wait, msg := cft.checkAccountThrottle(req, email); wait > 0 {
+		respondWithRetryAfter(w, wait, msg)
+		return
+	}
+	user, loginErr := cft.dbFor(req).CompleteTotpLogin(params.ChallengeToken, params.Code, cft.jwtSecret, params.ExpiresInSeconds)
+	cft.recordLoginResult(req, email, loginErr)
+	if database.IsAccountInactive(loginErr) {
+		respondWithError(w, http.StatusForbidden, loginErr.Error())
+		return
+	}
+	if loginErr != nil {
+		respondWithError(w, http.StatusUnauthorized, loginErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, user)
+}
+
+func (cft *apiConfig) enrollTotp(w http.ResponseWriter, req *http.Request) {
+	type responseStruct struct {
+		Secret          string `json:"secret"`
+		ProvisioningUri string `json:"provisioning_uri"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	secret, uri, enrollErr := cft.dbFor(req).BeginTotpEnrollment(userId)
+	if enrollErr != nil {
+		respondWithError(w, http.StatusConflict, enrollErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, responseStruct{Secret: secret, ProvisioningUri: uri})
+}
+
+func (cft *apiConfig) confirmTotp(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type responseStruct struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	codes, confirmErr := cft.dbFor(req).ConfirmTotpEnrollment(userId, params.Code)
+	if confirmErr != nil {
+		respondWithError(w, http.StatusBadRequest, confirmErr.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, responseStruct{RecoveryCodes: codes})
+}
+
+func (cft *apiConfig) disableTotp(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	if activeErr := cft.requireActiveAccount(req, id); activeErr != nil {
+		respondWithError(w, http.StatusForbidden, activeErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	disableErr := cft.dbFor(req).DisableTotp(userId, params.Code)
+	if disableErr != nil {
+		respondWithError(w, http.StatusBadRequest, disableErr.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const maxMemorySpans = 1000
+
+var serverTracer = otel.Tracer("github.com/GavinDevelops/chirpy")
+
+// newTracerProviderFromEnv sets up tracing from OTEL_TRACES_EXPORTER:
+// "otlp" exports over OTLP/HTTP, configured by the standard
+// OTEL_EXPORTER_OTLP_* variables, and "memory" keeps recent spans for
+// GET /api/admin/traces. Tracing is off when it is unset or "none".
+func newTracerProviderFromEnv(ctx context.Context) (*sdktrace.TracerProvider, *memoryExporter, error) {
+	switch os.Getenv("OTEL_TRACES_EXPORTER") {
+	case "", "none":
+		return nil, nil, nil
+	case "otlp":
+		exporter, exporterErr := otlptracehttp.New(ctx)
+		if exporterErr != nil {
+			return nil, nil, exporterErr
+		}
+		return newTracerProvider(sdktrace.WithBatcher(exporter)), nil, nil
+	case "memory":
+		exporter := newMemoryExporter(maxMemorySpans)
+		return newTracerProvider(sdktrace.WithSyncer(exporter)), exporter, nil
+	}
+	return nil, nil, errors.New("Unknown OTEL_TRACES_EXPORTER")
+}
+
+// newTracerProvider installs a tracer provider sending spans to the given
+// exporter, and W3C trace context propagation.
+func newTracerProvider(exporter sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	serviceResource, _ := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "chirpy")))
+	provider := sdktrace.NewTracerProvider(exporter, sdktrace.WithResource(serviceResource))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider
+}
+
+// memoryExporter keeps the most recent spans in memory. It backs the admin
+// traces endpoint and lets tests inspect the spans a request produced.
+type memoryExporter struct {
+	mux   sync.Mutex
+	limit int
+	spans []sdktrace.ReadOnlySpan
+}
+
+func newMemoryExporter(limit int) *memoryExporter {
+	return &memoryExporter{limit: limit}
+}
+
+func (exporter *memoryExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	exporter.mux.Lock()
+	defer exporter.mux.Unlock()
+	exporter.spans = append(exporter.spans, spans...)
+	if overflow := len(exporter.spans) - exporter.limit; overflow > 0 {
+		exporter.spans = exporter.spans[overflow:]
+	}
+	return nil
+}
+
+func (exporter *memoryExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+type recordedSpan struct {
+	TraceId      string            `json:"trace_id"`
+	SpanId       string            `json:"span_id"`
+	ParentSpanId string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Start        time.Time         `json:"start"`
+	DurationMs   float64           `json:"duration_ms"`
+	Status       string            `json:"status"`
+	Attributes   map[string]string `json:"attributes"`
+}
+
+// Spans returns the recorded spans, optionally only those of one trace,
+// oldest first.
+func (exporter *memoryExporter) Spans(traceId string) []recordedSpan {
+	exporter.mux.Lock()
+	defer exporter.mux.Unlock()
+	recorded := []recordedSpan{}
+	for _, span := range exporter.spans {
+		if traceId != "" && span.SpanContext().TraceID().String() != traceId {
+			continue
+		}
+		record := recordedSpan{
+			TraceId:    span.SpanContext().TraceID().String(),
+			SpanId:     span.SpanContext().SpanID().String(),
+			Name:       span.Name(),
+			Start:      span.StartTime(),
+			DurationMs: float64(span.EndTime().Sub(span.StartTime()).Microseconds()) / 1000,
+			Status:     span.Status().Code.String(),
+			Attributes: map[string]string{},
+		}
+		if span.Parent().IsValid() {
+			record.ParentSpanId = span.Parent().SpanID().String()
+		}
+		for _, attr := range span.Attributes() {
+			record.Attributes[string(attr.Key)] = attr.Value.Emit()
+		}
+		recorded = append(recorded, record)
+	}
+	return recorded
+}
+
+// dbFor returns the database traced as part of req.
+func (cft *apiConfig) dbFor(req *http.Request) *database.DB {
+	return cft.db.WithContext(req.Context())
+}
+
+// middlewareTracing starts a server span for every request to next,
+// continuing the trace from the caller's traceparent header when there is
+// one. Spans are named after the pattern the request matched in mux.
+func (cft *apiConfig) middlewareTracing(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, route := mux.Handler(req)
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := serverTracer.Start(ctx, route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", req.URL.Path),
+			),
+		)
+		defer span.End()
+		info := requestInfoFrom(ctx)
+		if info != nil && span.SpanContext().IsValid() {
+			info.traceId = span.SpanContext().TraceID().String()
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if info != nil && info.userId != "" {
+			span.SetAttributes(attribute.String("enduser.id", info.userId))
+		}
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, strconv.Itoa(recorder.status))
+		}
+	})
+}
+
+func (cft *apiConfig) getTraces(w http.ResponseWriter, req *http.Request) {
+	if cft.traceExporter == nil {
+		respondWithError(w, http.StatusNotFound, "In-memory tracing is not enabled")
+		return
+	}
+	respondWithJson(w, http.StatusOK, cft.traceExporter.Spans(req.URL.Query().Get("trace_id")))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	testExporterOnce sync.Once
+	testExporter     *memoryExporter
+)
+
+// tracingTestExporter installs one in-memory tracer provider for the whole
+// test binary, since tracers obtained from the global provider stay bound
+// to the first one installed.
+func tracingTestExporter() *memoryExporter {
+	testExporterOnce.Do(func() {
+		testExporter = newMemoryExporter(maxMemorySpans)
+		newTracerProvider(sdktrace.WithSyncer(testExporter))
+	})
+	return testExporter
+}
+
+func TestLoginSpanTree(t *testing.T) {
+	exporter := tracingTestExporter()
+	cft := newTestConfig(t)
+	createTestUser(t, cft, "a@example.com")
+
+	const traceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const callerSpanId = "00f067aa0ba902b7"
+	req := newJsonRequest(t, http.MethodPost, "/api/login", "", map[string]string{
+		"email":    "a@example.com",
+		"password": "pw",
+	})
+	req.Header.Set("traceparent", "00-"+traceId+"-"+callerSpanId+"-01")
+	recorder := doJson(t, cft.routes(), req, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("login status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+
+	spans := exporter.Spans(traceId)
+	if len(spans) == 0 {
+		t.Fatal("no spans recorded for the caller's trace")
+	}
+	byId := map[string]recordedSpan{}
+	for _, span := range spans {
+		byId[span.SpanId] = span
+	}
+	parentName := func(span recordedSpan) string {
+		if parent, exists := byId[span.ParentSpanId]; exists {
+			return parent.Name
+		}
+		return ""
+	}
+
+	server := recordedSpan{}
+	for _, span := range spans {
+		if span.Name == "POST /api/login" {
+			server = span
+		}
+	}
+	if server.SpanId == "" {
+		t.Fatal("no server span for POST /api/login")
+	}
+	if server.ParentSpanId != callerSpanId {
+		t.Errorf("server span parent = %q, want the caller's span %q", server.ParentSpanId, callerSpanId)
+	}
+	if server.Attributes["http.response.status_code"] != "200" {
+		t.Errorf("server span status code = %q, want 200", server.Attributes["http.response.status_code"])
+	}
+
+	wantParents := map[string]string{
+		"db.GetLockedUntil": "POST /api/login",
+		"db.VerifyUser":     "POST /api/login",
+		"bcrypt.compare":    "db.VerifyUser",
+		"jwt.sign":          "db.VerifyUser",
+	}
+	seen := map[string]bool{}
+	for _, span := range spans {
+		seen[span.Name] = true
+		if want, checked := wantParents[span.Name]; checked && parentName(span) != want {
+			t.Errorf("%s parent = %q, want %q", span.Name, parentName(span), want)
+		}
+		if span.Name == "db.load" || span.Name == "db.write" {
+			if parent := parentName(span); parent != "db.GetLockedUntil" && parent != "db.VerifyUser" {
+				t.Errorf("%s parent = %q, want a db operation", span.Name, parent)
+			}
+		}
+		if span.Name == "db.VerifyUser" && span.Attributes["db.operation"] != "VerifyUser" {
+			t.Errorf("db.operation = %q, want VerifyUser", span.Attributes["db.operation"])
+		}
+	}
+	for name := range wantParents {
+		if !seen[name] {
+			t.Errorf("no %s span", name)
+		}
+	}
+	if !seen["db.load"] {
+		t.Error("no db.load span")
+	}
+}
+
+func TestUntracedRequestStartsNewTrace(t *testing.T) {
+	exporter := tracingTestExporter()
+	cft := newTestConfig(t)
+	req := newJsonRequest(t, http.MethodPost, "/api/login", "", map[string]string{
+		"email":    "nobody@example.com",
+		"password": "pw",
+	})
+	before := len(exporter.Spans(""))
+	doJson(t, cft.routes(), req, nil)
+	for _, span := range exporter.Spans("")[before:] {
+		if span.Name == "POST /api/login" && span.ParentSpanId != "" {
+			t.Errorf("server span without traceparent has parent %q", span.ParentSpanId)
+		}
+	}
+}
+
+func TestInvalidResetTokenSkipsBcrypt(t *testing.T) {
+	exporter := tracingTestExporter()
+	cft := newTestConfig(t)
+	const traceId = "0af7651916cd43dd8448eb211c80319c"
+	req := newJsonRequest(t, http.MethodPost, "/api/password/reset", "", map[string]string{
+		"token":    "not-a-reset-token",
+		"password": "new-pw",
+	})
+	req.Header.Set("traceparent", "00-"+traceId+"-b7ad6b7169203331-01")
+	recorder := doJson(t, cft.routes(), req, nil)
+	if recorder.Code == http.StatusNoContent || recorder.Code == http.StatusOK {
+		t.Fatalf("reset with an unknown token returned %d", recorder.Code)
+	}
+	for _, span := range exporter.Spans(traceId) {
+		if span.Name == "bcrypt.hash" {
+			t.Error("hashed the new password for an unknown reset token")
+		}
+	}
+}
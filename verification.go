@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+)
+
+func validateEmail(email string) error {
+	address, parseErr := mail.ParseAddress(email)
+	if parseErr != nil || address.Address != email {
+		return errors.New("Invalid email address")
+	}
+	return nil
+}
+
+func (cft *apiConfig) sendVerificationEmail(userId int, email string) {
+	token, tokenErr := cft.db.CreateEmailVerificationToken(userId, cft.jwtSecret)
+	if tokenErr != nil {
+		slog.Error("Error creating verification token", "user_id", userId, "error", tokenErr)
+		return
+	}
+	link := fmt.Sprintf("%s/api/users/verify?token=%s", cft.baseUrl, url.QueryEscape(token))
+	sendErr := cft.mailer.Send(emailMessage{
+		To:      email,
+		Subject: "Verify your Chirpy account",
+		Body:    fmt.Sprintf("Welcome to Chirpy!\n\nConfirm your email address by visiting:\n%s\n\nOr submit this token to /api/users/verify:\n%s\n", link, token),
+	})
+	if sendErr != nil {
+		slog.Error("Error sending verification email", "user_id", userId, "error", sendErr)
+	}
+}
+
+func (cft *apiConfig) verifyEmail(w http.ResponseWriter, req *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+	params := parameters{Token: req.URL.Query().Get("token")}
+	if params.Token == "" {
+		decoder := json.NewDecoder(req.Body)
+		err := decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+			return
+		}
+	}
+	user, verifyErr := cft.dbFor(req).VerifyEmail(params.Token, cft.jwtSecret)
+	if verifyErr != nil {
+		respondWithError(w, http.StatusBadRequest, verifyErr.Error())
+		return
+	}
+	cft.bootstrapAdmins()
+	respondWithJson(w, http.StatusOK, user)
+}
+
+func (cft *apiConfig) resendVerificationEmail(w http.ResponseWriter, req *http.Request) {
+	id, authErr := cft.getUserIdFromRequest(req, scopeSessionOnly)
+	if authErr != nil {
+		respondWithError(w, http.StatusUnauthorized, authErr.Error())
+		return
+	}
+	userId, convErr := strconv.Atoi(id)
+	if convErr != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid token subject")
+		return
+	}
+	user, userErr := cft.dbFor(req).GetUserById(userId)
+	if userErr != nil {
+		respondWithError(w, http.StatusNotFound, userErr.Error())
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email already verified")
+		return
+	}
+	cft.sendVerificationEmail(user.Id, user.Email)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/GavinDevelops/chirpy/database"
+)
+
+const (
+	webhookSourcePolka     = "polka"
+	webhookPollInterval    = time.Second * 10
+	processedWebhookMaxAge = time.Hour * 24 * 7
+)
+
+// wakeWebhookWorker asks the worker to process the queue now instead of at
+// its next poll. It never blocks; one pending wake-up is enough.
+func (cft *apiConfig) wakeWebhookWorker() {
+	select {
+	case cft.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// runWebhookWorker runs for the lifetime of the server, applying queued
+// webhooks as they arrive and retrying failed ones when they are due.
+func (cft *apiConfig) runWebhookWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		cft.processWebhooks()
+		select {
+		case <-ticker.C:
+		case <-cft.webhookWake:
+		}
+	}
+}
+
+func (cft *apiConfig) processWebhooks() {
+	due, dueErr := cft.db.GetDueWebhooks(time.Now())
+	if dueErr != nil {
+		slog.Error("Error loading queued webhooks", "error", dueErr)
+		return
+	}
+	for _, webhook := range due {
+		processErr := cft.applyWebhook(webhook)
+		updated, recordErr := cft.db.RecordWebhookAttempt(webhook.Id, processErr, time.Now())
+		if recordErr != nil {
+			slog.Error("Error recording webhook attempt", "webhook_id", webhook.Id, "error", recordErr)
+			continue
+		}
+		switch updated.Status {
+		case database.WebhookProcessed:
+			cft.metrics.webhookEvents.inc(updated.Source, "processed")
+		case database.WebhookDead:
+			cft.metrics.webhookEvents.inc(updated.Source, "dead")
+			slog.Warn("Webhook dead-lettered", "webhook_id", updated.Id, "attempts", updated.Attempts, "error", updated.LastError)
+		case database.WebhookPending:
+			cft.metrics.webhookEvents.inc(updated.Source, "retried")
+			slog.Warn("Webhook failed, retrying", "webhook_id", updated.Id, "next_attempt_at", updated.NextAttemptAt, "error", updated.LastError)
+		}
+	}
+}
+
+func (cft *apiConfig) applyWebhook(webhook database.InboundWebhook) error {
+	switch webhook.Source {
+	case webhookSourcePolka:
+		return cft.applyPolkaWebhook(webhook)
+	}
+	return errors.New("Unknown webhook source")
+}
+
+func (cft *apiConfig) pruneWebhooks() {
+	pruned, pruneErr := cft.db.PruneWebhooks(time.Now().Add(-processedWebhookMaxAge))
+	if pruneErr != nil {
+		slog.Error("Error pruning webhooks", "error", pruneErr)
+		return
+	}
+	if pruned > 0 {
+		slog.Info("Pruned processed webhooks", "count", pruned)
+	}
+}
+
+func (cft *apiConfig) getWebhooks(w http.ResponseWriter, req *http.Request) {
+	status := req.URL.Query().Get("status")
+	if status == "" {
+		status = database.WebhookDead
+	}
+	if status == "all" {
+		status = ""
+	}
+	if status != "" && !database.IsValidWebhookStatus(status) {
+		respondWithError(w, http.StatusBadRequest, "Unknown webhook status")
+		return
+	}
+	webhooks, err := cft.dbFor(req).GetWebhooks(status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, webhooks)
+}
+
+func (cft *apiConfig) getWebhook(w http.ResponseWriter, req *http.Request) {
+	webhookId, parseErr := strconv.Atoi(req.PathValue("webhookid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing webhookId")
+		return
+	}
+	webhook, err := cft.dbFor(req).GetWebhook(webhookId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	respondWithJson(w, http.StatusOK, webhook)
+}
+
+func (cft *apiConfig) replayWebhook(w http.ResponseWriter, req *http.Request) {
+	webhookId, parseErr := strconv.Atoi(req.PathValue("webhookid"))
+	if parseErr != nil {
+		respondWithError(w, http.StatusBadRequest, "Error parsing webhookId")
+		return
+	}
+	webhook, err := cft.dbFor(req).ReplayWebhook(webhookId, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cft.wakeWebhookWorker()
+	respondWithJson(w, http.StatusAccepted, webhook)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	polkaSignatureHeader      = "Polka-Signature"
+	webhookSignatureTolerance = time.Minute * 5
+)
+
+var errInvalidSignature = errors.New("Invalid webhook signature")
+
+// webhookVerifier checks signature headers of the form "t=<unix>,v1=<hex>"
+// where v1 is HMAC-SHA256 over "<t>.<body>". Any of secrets may have signed
+// the payload, so a new key can be added before the old one is retired.
+type webhookVerifier struct {
+	secrets   [][]byte
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+// newPolkaVerifierFromEnv reads POLKA_WEBHOOK_SECRETS, a comma separated
+// list of signing secrets. It returns nil when none are configured.
+func newPolkaVerifierFromEnv() *webhookVerifier {
+	secrets := [][]byte{}
+	for _, secret := range strings.Split(os.Getenv("POLKA_WEBHOOK_SECRETS"), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	if len(secrets) == 0 {
+		return nil
+	}
+	return &webhookVerifier{secrets: secrets, tolerance: webhookSignatureTolerance, now: time.Now}
+}
+
+func signWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify returns the signature that matched, which identifies the delivery
+// for replay protection.
+func (v *webhookVerifier) verify(header string, body []byte) (string, time.Time, error) {
+	timestamp := int64(0)
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "t":
+			parsed, parseErr := strconv.ParseInt(value, 10, 64)
+			if parseErr != nil {
+				return "", time.Time{}, errInvalidSignature
+			}
+			timestamp = parsed
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return "", time.Time{}, errInvalidSignature
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if age := v.now().Sub(signedAt); age > v.tolerance || age < -v.tolerance {
+		return "", time.Time{}, errors.New("Webhook timestamp outside tolerance")
+	}
+	for _, secret := range v.secrets {
+		expected := []byte(signWebhook(secret, timestamp, body))
+		for _, signature := range signatures {
+			if hmac.Equal(expected, []byte(signature)) {
+				return signature, signedAt, nil
+			}
+		}
+	}
+	return "", time.Time{}, errInvalidSignature
+}